@@ -0,0 +1,228 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminAPI is a module that serves the /user_ip/ endpoints of the admin API,
+// for inspecting and editing the live stores:
+//
+//	GET    /user_ip/users                     list all users and their IPs
+//	GET    /user_ip/users/{email}             show one user
+//	DELETE /user_ip/users/{email}             revoke a user
+//	POST   /user_ip/users/{email}/ips         add an IP to a user; body {"ip": "..."}
+//	DELETE /user_ip/users/{email}/ips/{ip}    remove one IP from a user
+//	GET    /user_ip/ips/{ip}                  show which users an IP belongs to
+//
+// Every endpoint acts on the default store unless a store is named with the
+// store query parameter, e.g. /user_ip/users?store=admins.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.user_ip",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for the user_ip endpoints.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminAPIPrefix,
+			Handler: caddy.AdminHandlerFunc(a.handleAPI),
+		},
+	}
+}
+
+// adminAPIPrefix is the path under which the user_ip endpoints are served.
+const adminAPIPrefix = "/user_ip/"
+
+// seedIPRequest is the body of a POST to /user_ip/users/{email}/ips.
+type seedIPRequest struct {
+	IP string `json:"ip"`
+}
+
+// ipUsersResponse is the response to GET /user_ip/ips/{ip}.
+type ipUsersResponse struct {
+	IP    string                 `json:"ip"`
+	Users map[string]*ipUserInfo `json:"users"`
+}
+
+// ipUserInfo is one user's record of an IP, as reported by the admin API.
+type ipUserInfo struct {
+	FirstSeen int64 `json:"first_seen,omitempty"`
+	LastSeen  int64 `json:"last_seen"`
+}
+
+// handleAPI routes a request under /user_ip/ to its handler.
+func (a *adminAPI) handleAPI(w http.ResponseWriter, r *http.Request) error {
+	storeName := r.URL.Query().Get("store")
+	if storeName == "" {
+		storeName = defaultStoreName
+	}
+	storage := lookupStorage(storeName)
+	if storage == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no live store named %q", storeName),
+		}
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminAPIPrefix), "/"), "/")
+	if len(parts) >= 2 && parts[0] == "users" && strings.TrimSpace(parts[1]) == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("empty email in %s", r.URL.Path),
+		}
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "users":
+		return a.handleUsers(w, r, storage)
+	case len(parts) == 2 && parts[0] == "users":
+		return a.handleUser(w, r, storage, parts[1])
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "ips":
+		return a.handleUserIPs(w, r, storage, parts[1])
+	case len(parts) == 4 && parts[0] == "users" && parts[2] == "ips":
+		return a.handleUserIP(w, r, storage, parts[1], parts[3])
+	case len(parts) == 2 && parts[0] == "ips":
+		return a.handleIP(w, r, storage, parts[1])
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown endpoint %s", r.URL.Path),
+		}
+	}
+}
+
+// handleUsers serves /user_ip/users.
+func (a *adminAPI) handleUsers(w http.ResponseWriter, r *http.Request, storage *UserIPStorage) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(r)
+	}
+	return writeJSON(w, http.StatusOK, storage.GetUsers())
+}
+
+// handleUser serves /user_ip/users/{email}.
+func (a *adminAPI) handleUser(w http.ResponseWriter, r *http.Request, storage *UserIPStorage, email string) error {
+	switch r.Method {
+	case http.MethodGet:
+		userData, exists := storage.GetUser(email)
+		if !exists {
+			return userNotFound(email)
+		}
+		return writeJSON(w, http.StatusOK, userData)
+
+	case http.MethodDelete:
+		if !storage.RemoveUser(email) {
+			return userNotFound(email)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handleUserIPs serves /user_ip/users/{email}/ips.
+func (a *adminAPI) handleUserIPs(w http.ResponseWriter, r *http.Request, storage *UserIPStorage, email string) error {
+	if r.Method != http.MethodPost {
+		return methodNotAllowed(r)
+	}
+
+	var req seedIPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	if _, ok := normalizeIP(req.IP); !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid IP address %q", req.IP),
+		}
+	}
+
+	storage.AddUserIP(email, req.IP)
+
+	userData, _ := storage.GetUser(email)
+	return writeJSON(w, http.StatusCreated, userData)
+}
+
+// handleUserIP serves /user_ip/users/{email}/ips/{ip}.
+func (a *adminAPI) handleUserIP(w http.ResponseWriter, r *http.Request, storage *UserIPStorage, email, ip string) error {
+	if r.Method != http.MethodDelete {
+		return methodNotAllowed(r)
+	}
+	if !storage.RemoveUserIP(email, ip) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("user %q has no IP %q", email, ip),
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleIP serves /user_ip/ips/{ip}.
+func (a *adminAPI) handleIP(w http.ResponseWriter, r *http.Request, storage *UserIPStorage, ip string) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(r)
+	}
+	canonicalIP, ok := normalizeIP(ip)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid IP address %q", ip),
+		}
+	}
+
+	resp := ipUsersResponse{
+		IP:    canonicalIP,
+		Users: make(map[string]*ipUserInfo),
+	}
+	for _, entry := range storage.GetEntriesInNetwork(canonicalIP, 0, 0) {
+		resp.Users[entry.User] = &ipUserInfo{
+			FirstSeen: entry.FirstSeen,
+			LastSeen:  entry.LastSeen,
+		}
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// methodNotAllowed returns the error for a method an endpoint does not support.
+func methodNotAllowed(r *http.Request) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method %s not allowed for %s", r.Method, r.URL.Path),
+	}
+}
+
+// userNotFound returns the error for an unknown user.
+func userNotFound(email string) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("user %q not found", email),
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
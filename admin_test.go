@@ -0,0 +1,152 @@
+package caddy_user_ip
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminRequest sends a request to the admin API and returns the response.
+func adminRequest(t *testing.T, method, path, body string) *http.Response {
+	t.Helper()
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, "http://localhost:2999"+path, reqBody)
+	if err != nil {
+		t.Fatalf("Failed to create admin request: %v", err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send admin request: %v", err)
+	}
+	return resp
+}
+
+// TestAdminAPI exercises the admin API endpoints against a live store, and asserts
+// that edits are reflected by the matcher and written to disk.
+func TestAdminAPI(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route / {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+        route /check {
+            @user_ip user_ip
+            respond @user_ip "Matched" 200
+            respond "Unmatched" 404
+        }
+    }
+  `)
+
+	checkMatch := func(ip string, want bool) {
+		t.Helper()
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", ip, "")
+		_ = resp.Body.Close()
+		if got := resp.StatusCode == http.StatusOK; got != want {
+			t.Errorf("Expected match=%v for IP %s, but got status code %d", want, ip, resp.StatusCode)
+		}
+	}
+	decode := func(resp *http.Response, wantStatus int, v any) {
+		t.Helper()
+		defer func() {
+			// Ignoring error in test cleanup
+			_ = resp.Body.Close()
+		}()
+		if resp.StatusCode != wantStatus {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Expected status code %d from %s %s, but got %d: %s",
+				wantStatus, resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, body)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("Failed to decode response from %s: %v", resp.Request.URL.Path, err)
+			}
+		}
+	}
+
+	// Setup: alice shares 1.1.1.1 with bob, who also uses 2.2.2.2
+	for _, req := range []struct{ email, ip string }{
+		{"alice@example.com", "1.1.1.1"},
+		{"bob@example.com", "2.2.2.2"},
+		{"bob@example.com", "1.1.1.1"},
+	} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", req.email, req.ip, "")
+		_ = resp.Body.Close()
+	}
+
+	// GET /user_ip/users lists every user
+	var users map[string]*UserData
+	decode(adminRequest(t, "GET", "/user_ip/users", ""), http.StatusOK, &users)
+	if len(users) != 2 || users["alice@example.com"] == nil || users["bob@example.com"] == nil {
+		t.Fatalf("Expected users alice and bob, but got %v", users)
+	}
+
+	// GET /user_ip/users/{email} shows one user, most recent IP first
+	var bob UserData
+	decode(adminRequest(t, "GET", "/user_ip/users/bob@example.com", ""), http.StatusOK, &bob)
+	if len(bob.IPs) != 2 || bob.IPs[0].IP != "1.1.1.1" || bob.IPs[1].IP != "2.2.2.2" {
+		t.Errorf("Expected bob to have IPs ['1.1.1.1', '2.2.2.2'], but got %v", bob.IPs)
+	}
+	decode(adminRequest(t, "GET", "/user_ip/users/nobody@example.com", ""), http.StatusNotFound, nil)
+
+	// GET /user_ip/ips/{ip} shows the users of an IP
+	var ipUsers ipUsersResponse
+	decode(adminRequest(t, "GET", "/user_ip/ips/::ffff:1.1.1.1", ""), http.StatusOK, &ipUsers)
+	if ipUsers.IP != "1.1.1.1" || len(ipUsers.Users) != 2 {
+		t.Errorf("Expected IP '1.1.1.1' to belong to alice and bob, but got %+v", ipUsers)
+	}
+
+	// POST /user_ip/users/{email}/ips pre-seeds an IP
+	var carol UserData
+	decode(adminRequest(t, "POST", "/user_ip/users/carol@example.com/ips", `{"ip": "3.3.3.3"}`), http.StatusCreated, &carol)
+	if len(carol.IPs) != 1 || carol.IPs[0].IP != "3.3.3.3" {
+		t.Errorf("Expected carol to have IPs ['3.3.3.3'], but got %v", carol.IPs)
+	}
+	decode(adminRequest(t, "POST", "/user_ip/users/carol@example.com/ips", `{"ip": "unknown"}`), http.StatusBadRequest, nil)
+	checkMatch("3.3.3.3", true)
+
+	// An email that is blank is rejected rather than made a user
+	decode(adminRequest(t, "POST", "/user_ip/users/%20/ips", `{"ip": "4.4.4.4"}`), http.StatusBadRequest, nil)
+	decode(adminRequest(t, "GET", "/user_ip/users/%20%20", ""), http.StatusBadRequest, nil)
+	checkMatch("4.4.4.4", false)
+
+	// DELETE /user_ip/users/{email}/ips/{ip} removes one IP
+	decode(adminRequest(t, "DELETE", "/user_ip/users/bob@example.com/ips/2.2.2.2", ""), http.StatusNoContent, nil)
+	decode(adminRequest(t, "DELETE", "/user_ip/users/bob@example.com/ips/2.2.2.2", ""), http.StatusNotFound, nil)
+	checkMatch("2.2.2.2", false)
+	checkMatch("1.1.1.1", true)
+
+	// DELETE /user_ip/users/{email} revokes a user; a shared IP still matches
+	// until its last user is gone
+	decode(adminRequest(t, "DELETE", "/user_ip/users/alice@example.com", ""), http.StatusNoContent, nil)
+	checkMatch("1.1.1.1", true)
+	decode(adminRequest(t, "DELETE", "/user_ip/users/bob@example.com", ""), http.StatusNoContent, nil)
+	checkMatch("1.1.1.1", false)
+
+	// Edits are written to disk
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
+	persistedData := readPersistedData(t, persistPath)
+	if len(persistedData) != 1 || persistedData["carol@example.com"] == nil {
+		t.Errorf("Expected only carol in persisted data, but got %v", persistedData)
+	}
+
+	// Unknown stores and endpoints are reported as such
+	decode(adminRequest(t, "GET", "/user_ip/users?store=nope", ""), http.StatusNotFound, nil)
+	decode(adminRequest(t, "GET", "/user_ip/bogus", ""), http.StatusNotFound, nil)
+	decode(adminRequest(t, "PUT", "/user_ip/users", ""), http.StatusMethodNotAllowed, nil)
+}
@@ -0,0 +1,84 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// trackingApp is the user_ip app. Caddy creates one for every loaded config
+// whose user_ip_tracking handlers ask for it, and they register the stores
+// they set up with it. On a config reload, the new settings of a store that
+// is already live are only staged while the new config is provisioned, and
+// are applied once the previous config is stopped, which Caddy only does once
+// the new config is running. If loading the new config fails, its settings
+// are dropped, and the store carries on with the previous config's.
+type trackingApp struct {
+	// Names of the stores the handlers of this config set up
+	stores map[string]struct{}
+
+	// Logger for the app
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*trackingApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "user_ip",
+		New: func() caddy.Module { return new(trackingApp) },
+	}
+}
+
+// Provision sets up the app.
+func (a *trackingApp) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+	a.stores = make(map[string]struct{})
+	return nil
+}
+
+// register records that a handler of this config set up the named store.
+func (a *trackingApp) register(name string) {
+	a.stores[name] = struct{}{}
+}
+
+// Start implements caddy.App.
+func (a *trackingApp) Start() error {
+	return nil
+}
+
+// Stop implements caddy.App. When this config is replaced, the settings the
+// new config staged for its stores are applied, as the new config is running
+// by now.
+func (a *trackingApp) Stop() error {
+	for name := range a.stores {
+		storage := lookupStorage(name)
+		if storage == nil {
+			continue
+		}
+		if err := storage.applyStaged(a); err != nil {
+			// The store carries on with the settings it had
+			a.logger.Error("Failed to apply the new config to store",
+				zap.String("store", name),
+				zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. Settings this config staged that
+// were never applied, because loading it failed, are dropped.
+func (a *trackingApp) Cleanup() error {
+	for name := range a.stores {
+		if storage := lookupStorage(name); storage != nil {
+			storage.dropStaged(a)
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.App          = (*trackingApp)(nil)
+	_ caddy.Provisioner  = (*trackingApp)(nil)
+	_ caddy.CleanerUpper = (*trackingApp)(nil)
+)
@@ -0,0 +1,519 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/jonboulle/clockwork"
+)
+
+// Backend persists the serialized state of a store.
+type Backend interface {
+	// Load returns the saved state, or nil if nothing has been saved yet.
+	Load(ctx context.Context) ([]byte, error)
+
+	// Save replaces the saved state with data.
+	Save(ctx context.Context, data []byte) error
+
+	// Delete removes the saved state. Deleting state that was never saved is
+	// not an error.
+	Delete(ctx context.Context) error
+
+	// String describes where the state is kept. Two backends with the same
+	// description share their state.
+	String() string
+}
+
+// Watcher is implemented by backends that can tell when their saved state was
+// changed by someone else, such as another Caddy instance sharing the storage.
+type Watcher interface {
+	// Watch calls changed whenever the saved state may have changed, until ctx
+	// is canceled.
+	Watch(ctx context.Context, changed func()) error
+}
+
+// recordBackend is implemented by backends that keep each user's data as a
+// separate record, so that changes are saved by rewriting just the records
+// they touch rather than the whole state.
+type recordBackend interface {
+	Backend
+
+	// Records returns the saved state, read from the records without
+	// encoding it.
+	Records(ctx context.Context) (persistData, error)
+
+	// Replace replaces every record with those of pd in a single transaction.
+	Replace(ctx context.Context, pd persistData) error
+
+	// Apply applies entries, in order, in a single transaction.
+	Apply(ctx context.Context, entries []journalEntry) error
+}
+
+// quarantineBackend is implemented by backends that can set aside saved state
+// that cannot be read, so that loading can fall back to a backup of it.
+type quarantineBackend interface {
+	// Quarantine moves the saved state aside, to its location with suffix
+	// appended, and returns where it went.
+	Quarantine(ctx context.Context, suffix string) (string, error)
+
+	// Backups returns the backups of the saved state that exist, newest first.
+	Backups(ctx context.Context) []Backend
+}
+
+// lockingBackend is implemented by backends shared by several writers that
+// can lock the saved state against the others, so that reading, merging and
+// writing it back is not interleaved with another writer doing the same,
+// whose changes would then be lost.
+type lockingBackend interface {
+	// Lock waits until the state is locked, or ctx is canceled.
+	Lock(ctx context.Context) error
+
+	// Unlock releases the lock taken by Lock.
+	Unlock(ctx context.Context) error
+}
+
+// backupBackend is implemented by backends that can keep a copy of the saved
+// state next to it, e.g. before it is migrated to a newer format.
+type backupBackend interface {
+	// Backup saves data as a copy of the state, named after the state's
+	// location with suffix appended, unless that copy already exists. Returns
+	// true if it saved the copy.
+	Backup(ctx context.Context, suffix string, data []byte) (bool, error)
+}
+
+// copyBackend is implemented by backends that keep copies of the saved state
+// next to it: its backups, state moved aside by Quarantine, and copies saved
+// by Backup.
+type copyBackend interface {
+	// Copies returns the copies of the saved state that exist.
+	Copies(ctx context.Context) ([]Backend, error)
+}
+
+// isCopySuffix returns true if suffix, appended to the location of the saved
+// state, names a copy of it: a backup (".<n>"), state moved aside as corrupt
+// (".corrupt-<timestamp>") or a copy made before migrating it
+// (".v<version>.bak").
+func isCopySuffix(suffix string) bool {
+	rest, ok := strings.CutPrefix(suffix, ".")
+	if !ok || rest == "" {
+		return false
+	}
+	if strings.Trim(rest, "0123456789") == "" {
+		return true
+	}
+	if strings.HasPrefix(rest, "corrupt-") {
+		return true
+	}
+	return strings.HasPrefix(rest, "v") && strings.HasSuffix(rest, ".bak")
+}
+
+// fileBackend keeps the state in a JSON file on the local disk.
+type fileBackend struct {
+	path string
+
+	// Number of previous versions of the file kept as path.1 (the newest) to
+	// path.<backups>
+	backups int
+
+	// How often Watch checks the file for changes made by other writers, by
+	// clock. 0 disables watching.
+	watchInterval time.Duration
+	clock         clockwork.Clock
+
+	// Guards written
+	mu sync.Mutex
+
+	// The file as this backend last saved it, so that Watch does not report
+	// the backend's own saves
+	written fileStamp
+}
+
+// fileStamp tells versions of a file apart by its metadata. Saving replaces
+// the file with a new one, so a save by anyone changes its stamp.
+type fileStamp struct {
+	info fs.FileInfo
+}
+
+// statFile returns the stamp of the file at path, which is empty if there is
+// no file.
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileStamp{}, nil
+	}
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{info: info}, nil
+}
+
+// same returns true if both stamps are of the same version of the file.
+func (a fileStamp) same(b fileStamp) bool {
+	if a.info == nil || b.info == nil {
+		return a.info == nil && b.info == nil
+	}
+	return os.SameFile(a.info, b.info) && a.info.ModTime().Equal(b.info.ModTime()) && a.info.Size() == b.info.Size()
+}
+
+// Load implements Backend.
+func (b *fileBackend) Load(ctx context.Context) ([]byte, error) {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save implements Backend. The data is written and synced to a temporary
+// file which is then renamed over the previous one, and the rename is synced
+// too, so readers never see a partial file and a power loss cannot lose it.
+// The previous file becomes the newest backup once it has been replaced. As
+// the data is personal, the file is only readable by its owner.
+func (b *fileBackend) Save(ctx context.Context, data []byte) error {
+	// Every save has a temporary file of its own, so that writers sharing the
+	// file do not write to each other's
+	f, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempFile := f.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = os.Remove(tempFile)
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	previous := b.path + ".prev" + strings.TrimPrefix(filepath.Base(tempFile), filepath.Base(b.path)+".tmp")
+	kept, err := b.keepPrevious(previous)
+	if err != nil {
+		return fmt.Errorf("keeping a backup of %s: %v", b.path, err)
+	}
+	if err := os.Rename(tempFile, b.path); err != nil {
+		if kept {
+			_ = os.Remove(previous)
+		}
+		return err
+	}
+	renamed = true
+	if b.watchInterval > 0 {
+		// Another writer saving right after this one is missed by Watch, but
+		// still picked up by the next periodic sync
+		if stamp, err := statFile(b.path); err == nil {
+			b.mu.Lock()
+			b.written = stamp
+			b.mu.Unlock()
+		}
+	}
+	if kept {
+		if err := b.rotateBackups(previous); err != nil {
+			return fmt.Errorf("rotating backups of %s: %v", b.path, err)
+		}
+	}
+	return syncDir(filepath.Dir(b.path))
+}
+
+// Watch implements Watcher. The file is checked every watchInterval, and
+// changed is called when it was replaced by anyone other than this backend.
+// Returns at once if watchInterval is 0.
+func (b *fileBackend) Watch(ctx context.Context, changed func()) error {
+	if b.watchInterval <= 0 {
+		return nil
+	}
+	last, err := statFile(b.path)
+	if err != nil {
+		return err
+	}
+	ticker := b.clock.NewTicker(b.watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.Chan():
+		}
+		current, err := statFile(b.path)
+		if err != nil {
+			return err
+		}
+		if current.same(last) {
+			continue
+		}
+		last = current
+		b.mu.Lock()
+		own := current.same(b.written)
+		b.mu.Unlock()
+		if !own {
+			changed()
+		}
+	}
+}
+
+// backupPath returns the path of the nth newest backup, counting from 1.
+func (b *fileBackend) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", b.path, n)
+}
+
+// keepPrevious keeps the current file at previous, a path unique to the save,
+// so that it can become the newest backup once it is replaced. It is
+// hard-linked rather than moved, so that it stays in place until then, or
+// copied where hard links are not supported. Returns false if no backups are
+// kept or nothing was saved yet.
+func (b *fileBackend) keepPrevious(previous string) (bool, error) {
+	if b.backups <= 0 {
+		return false, nil
+	}
+	if _, err := os.Lstat(b.path); errors.Is(err, fs.ErrNotExist) {
+		// Nothing saved yet, so nothing to keep
+		return false, nil
+	}
+	if err := os.Link(b.path, previous); err == nil {
+		return true, nil
+	}
+	if err := copyFile(b.path, previous); err != nil {
+		_ = os.Remove(previous)
+		return false, err
+	}
+	return true, nil
+}
+
+// rotateBackups shifts every backup one place older, replacing the oldest,
+// and makes previous the newest. It is only called once the file has been
+// replaced, so a failed save never costs a backup.
+func (b *fileBackend) rotateBackups(previous string) error {
+	for n := b.backups - 1; n >= 1; n-- {
+		if err := os.Rename(b.backupPath(n), b.backupPath(n+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(previous, b.backupPath(1))
+}
+
+// copyFile copies the file at src to dst, which is only readable by its owner.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Quarantine implements quarantineBackend.
+func (b *fileBackend) Quarantine(ctx context.Context, suffix string) (string, error) {
+	quarantined := b.path + suffix
+	if err := os.Rename(b.path, quarantined); err != nil {
+		return "", err
+	}
+	return quarantined, syncDir(filepath.Dir(b.path))
+}
+
+// Backups implements quarantineBackend.
+func (b *fileBackend) Backups(ctx context.Context) []Backend {
+	var backups []Backend
+	for n := 1; n <= b.backups; n++ {
+		if _, err := os.Stat(b.backupPath(n)); err == nil {
+			backups = append(backups, &fileBackend{path: b.backupPath(n)})
+		}
+	}
+	return backups
+}
+
+// Copies implements copyBackend. Backups beyond the configured number, e.g.
+// kept before it was lowered, are included.
+func (b *fileBackend) Copies(ctx context.Context) ([]Backend, error) {
+	entries, err := os.ReadDir(filepath.Dir(b.path))
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(b.path)
+	var copies []Backend
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), base)
+		if ok && entry.Type().IsRegular() && isCopySuffix(suffix) {
+			copies = append(copies, &fileBackend{path: b.path + suffix})
+		}
+	}
+	return copies, nil
+}
+
+// Backup implements backupBackend. The copy is a file next to the state's.
+func (b *fileBackend) Backup(ctx context.Context, suffix string, data []byte) (bool, error) {
+	backup := fileBackend{path: b.path + suffix}
+	if _, err := os.Stat(backup.path); err == nil {
+		return false, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return true, backup.Save(ctx, data)
+}
+
+// syncDir flushes the entries of dir, such as a file renamed into it, to disk.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Directories cannot be opened for syncing on Windows
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	return d.Sync()
+}
+
+// Delete implements Backend.
+func (b *fileBackend) Delete(ctx context.Context) error {
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// String implements Backend.
+func (b *fileBackend) String() string {
+	return "file:" + b.path
+}
+
+// storageBackend keeps the state under a key of Caddy's configured storage,
+// so that instances sharing the storage (file_system on a shared volume,
+// redis, consul, ...) share their user IP data.
+type storageBackend struct {
+	storage certmagic.Storage
+	key     string
+}
+
+// Load implements Backend.
+func (b *storageBackend) Load(ctx context.Context) ([]byte, error) {
+	data, err := b.storage.Load(ctx, b.key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save implements Backend.
+func (b *storageBackend) Save(ctx context.Context, data []byte) error {
+	return b.storage.Store(ctx, b.key, data)
+}
+
+// Lock implements lockingBackend, using the storage's locks, which work
+// across the instances sharing it.
+func (b *storageBackend) Lock(ctx context.Context) error {
+	return b.storage.Lock(ctx, b.key)
+}
+
+// Unlock implements lockingBackend.
+func (b *storageBackend) Unlock(ctx context.Context) error {
+	return b.storage.Unlock(ctx, b.key)
+}
+
+// Backup implements backupBackend. The copy is kept under the state's key
+// with suffix appended.
+func (b *storageBackend) Backup(ctx context.Context, suffix string, data []byte) (bool, error) {
+	if b.storage.Exists(ctx, b.key+suffix) {
+		return false, nil
+	}
+	return true, b.storage.Store(ctx, b.key+suffix, data)
+}
+
+// Quarantine implements quarantineBackend. The state is copied to its key with
+// suffix appended and then deleted.
+func (b *storageBackend) Quarantine(ctx context.Context, suffix string) (string, error) {
+	data, err := b.storage.Load(ctx, b.key)
+	if err != nil {
+		return "", err
+	}
+	if err := b.storage.Store(ctx, b.key+suffix, data); err != nil {
+		return "", err
+	}
+	return b.key + suffix, b.storage.Delete(ctx, b.key)
+}
+
+// Backups implements quarantineBackend. No backups are kept in the storage,
+// which is why loading it is strict unless strict_load is turned off.
+func (b *storageBackend) Backups(ctx context.Context) []Backend {
+	return nil
+}
+
+// Copies implements copyBackend.
+func (b *storageBackend) Copies(ctx context.Context) ([]Backend, error) {
+	keys, err := b.storage.List(ctx, path.Dir(b.key), false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var copies []Backend
+	for _, key := range keys {
+		if suffix, ok := strings.CutPrefix(key, b.key); ok && isCopySuffix(suffix) {
+			copies = append(copies, &storageBackend{storage: b.storage, key: key})
+		}
+	}
+	return copies, nil
+}
+
+// Delete implements Backend.
+func (b *storageBackend) Delete(ctx context.Context) error {
+	if err := b.storage.Delete(ctx, b.key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// String implements Backend.
+func (b *storageBackend) String() string {
+	if stringer, ok := b.storage.(fmt.Stringer); ok {
+		return fmt.Sprintf("storage:%s:%s", stringer, b.key)
+	}
+	return "storage:" + b.key
+}
+
+// Interface guards
+var (
+	_ Backend           = (*fileBackend)(nil)
+	_ Backend           = (*storageBackend)(nil)
+	_ backupBackend     = (*fileBackend)(nil)
+	_ backupBackend     = (*storageBackend)(nil)
+	_ quarantineBackend = (*fileBackend)(nil)
+	_ quarantineBackend = (*storageBackend)(nil)
+	_ copyBackend       = (*fileBackend)(nil)
+	_ Watcher           = (*fileBackend)(nil)
+	_ copyBackend       = (*storageBackend)(nil)
+	_ lockingBackend    = (*storageBackend)(nil)
+)
@@ -0,0 +1,1057 @@
+package caddy_user_ip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/jonboulle/clockwork"
+)
+
+func init() {
+	caddy.RegisterModule(memoryStorage{})
+}
+
+// memoryStorage is a Caddy storage module that keeps everything in memory.
+// Every instance shares memoryStorageData, like Caddy instances sharing a
+// cluster storage.
+type memoryStorage struct{}
+
+// memoryStorageData holds the contents of every memoryStorage.
+var memoryStorageData = struct {
+	sync.Mutex
+	values   map[string][]byte
+	modified map[string]time.Time
+}{
+	values:   make(map[string][]byte),
+	modified: make(map[string]time.Time),
+}
+
+// CaddyModule returns the Caddy module information.
+func (memoryStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.user_ip_memory",
+		New: func() caddy.Module { return new(memoryStorage) },
+	}
+}
+
+// CertMagicStorage implements caddy.StorageConverter.
+func (memoryStorage) CertMagicStorage() (certmagic.Storage, error) {
+	return memoryStorage{}, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (memoryStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume storage module name
+	return nil
+}
+
+// memoryLocks holds a lock for each name locked in any memoryStorage.
+var memoryLocks sync.Map
+
+// Lock implements certmagic.Locker.
+func (memoryStorage) Lock(ctx context.Context, name string) error {
+	lock, _ := memoryLocks.LoadOrStore(name, new(sync.Mutex))
+	lock.(*sync.Mutex).Lock()
+	return nil
+}
+
+// Unlock implements certmagic.Locker.
+func (memoryStorage) Unlock(ctx context.Context, name string) error {
+	lock, ok := memoryLocks.Load(name)
+	if !ok {
+		return fmt.Errorf("%s is not locked", name)
+	}
+	lock.(*sync.Mutex).Unlock()
+	return nil
+}
+
+// Store implements certmagic.Storage.
+func (memoryStorage) Store(ctx context.Context, key string, value []byte) error {
+	memoryStorageData.Lock()
+	defer memoryStorageData.Unlock()
+	memoryStorageData.values[key] = append([]byte(nil), value...)
+	memoryStorageData.modified[key] = time.Now()
+	return nil
+}
+
+// Load implements certmagic.Storage.
+func (memoryStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	memoryStorageData.Lock()
+	defer memoryStorageData.Unlock()
+	value, exists := memoryStorageData.values[key]
+	if !exists {
+		return nil, fs.ErrNotExist
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// Delete implements certmagic.Storage.
+func (memoryStorage) Delete(ctx context.Context, key string) error {
+	memoryStorageData.Lock()
+	defer memoryStorageData.Unlock()
+	if _, exists := memoryStorageData.values[key]; !exists {
+		return fs.ErrNotExist
+	}
+	delete(memoryStorageData.values, key)
+	delete(memoryStorageData.modified, key)
+	return nil
+}
+
+// Exists implements certmagic.Storage.
+func (memoryStorage) Exists(ctx context.Context, key string) bool {
+	memoryStorageData.Lock()
+	defer memoryStorageData.Unlock()
+	_, exists := memoryStorageData.values[key]
+	return exists
+}
+
+// List implements certmagic.Storage.
+func (memoryStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	memoryStorageData.Lock()
+	defer memoryStorageData.Unlock()
+	var keys []string
+	for key := range memoryStorageData.values {
+		if strings.HasPrefix(key, path+"/") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Stat implements certmagic.Storage.
+func (memoryStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	memoryStorageData.Lock()
+	defer memoryStorageData.Unlock()
+	value, exists := memoryStorageData.values[key]
+	if !exists {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   memoryStorageData.modified[key],
+		Size:       int64(len(value)),
+		IsTerminal: true,
+	}, nil
+}
+
+// readMemoryStorageData unmarshals the user data stored under key in the
+// memory storage, failing the test if there is none.
+func readMemoryStorageData(t *testing.T, key string) map[string]*UserData {
+	t.Helper()
+	value, err := memoryStorage{}.Load(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Failed to load %s from memory storage: %v", key, err)
+	}
+	var pd persistData
+	if err := json.Unmarshal(value, &pd); err != nil {
+		t.Fatalf("Failed to unmarshal %s from memory storage: %v", key, err)
+	}
+	return pd.UserData
+}
+
+// TestStorageBackend verifies that the storage backend saves the store in Caddy's
+// configured storage, and that an instance starting on the same storage picks
+// up the data.
+func TestStorageBackend(t *testing.T) {
+	setupFakeClock(t)
+	t.Cleanup(func() {
+		for _, key := range []string{"user_ip/default.json", "shared/ips.json"} {
+			// Ignoring error in test cleanup
+			_ = memoryStorage{}.Delete(context.Background(), key)
+		}
+	})
+
+	const globalOptions = "    storage user_ip_memory"
+	caddyfile := func(storageKey string) string {
+		return `
+    localhost:9080 {
+        route / {
+            user_ip_tracking {
+                backend storage
+                ` + storageKey + `
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+        route /check {
+            @user_ip user_ip
+            respond @user_ip "Matched" 200
+            respond "Unmatched" 404
+        }
+    }
+  `
+	}
+
+	tester := createTesterWithOptions(t, globalOptions, caddyfile(""))
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
+	_ = resp.Body.Close()
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
+
+	// Assert: The store is saved under its default key
+	userData := readMemoryStorageData(t, "user_ip/default.json")["user1@test.com"]
+	if userData == nil || len(userData.IPs) != 1 || userData.IPs[0].IP != "1.1.1.1" {
+		t.Fatalf("Expected user1@test.com to be stored with IP 1.1.1.1, but got %+v", userData)
+	}
+
+	// Action: Start over on the same storage, as another instance would, with a
+	// different key. The previous store is destroyed first.
+	tester = createTesterWithOptions(t, globalOptions, caddyfile("storage_key shared/ips.json"))
+	resp = sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user2@test.com", "2.2.2.2", "")
+	_ = resp.Body.Close()
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
+
+	// Assert: The new key holds only what this instance saved
+	sharedData := readMemoryStorageData(t, "shared/ips.json")
+	if len(sharedData) != 1 || sharedData["user2@test.com"] == nil {
+		t.Errorf("Expected only user2@test.com under the custom key, but got %v", sharedData)
+	}
+
+	// Action: Start over with the default key again
+	tester = createTesterWithOptions(t, globalOptions, caddyfile(""))
+
+	// Assert: The IP saved by the first instance matches without being tracked again
+	resp = sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", "1.1.1.1", "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected IP 1.1.1.1 loaded from storage to match, but got status code %d", resp.StatusCode)
+	}
+}
+
+// TestSyncBetweenInstances runs two stores against one file, as two Caddy
+// instances sharing a backend would, and verifies that each merges the other's
+// changes into its own when saving and when syncing.
+func TestSyncBetweenInstances(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route /a {
+            user_ip_tracking {
+                store node_a
+                persist_path `+persistPath+`
+                max_ips_per_user 2
+                sync_interval 1m
+            }
+            respond "OK"
+        }
+        route /b {
+            user_ip_tracking {
+                store node_b
+                persist_path `+persistPath+`
+                max_ips_per_user 2
+                sync_interval 1m
+            }
+            respond "OK"
+        }
+        route /check_a {
+            @user_ip user_ip store node_a
+            respond @user_ip "Matched" 200
+            respond "Unmatched" 404
+        }
+        route /check_b {
+            @user_ip user_ip store node_b
+            respond @user_ip "Matched" 200
+            respond "Unmatched" 404
+        }
+    }
+  `)
+	nodeA := getLiveStorage(t, "node_a")
+	nodeB := getLiveStorage(t, "node_b")
+
+	track := func(node, email, ip string) {
+		t.Helper()
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/"+node, email, ip, "")
+		_ = resp.Body.Close()
+	}
+	matches := func(node, ip string) bool {
+		t.Helper()
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check_"+node, "", ip, "")
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+	waitForMatch := func(node, ip string, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for matches(node, ip) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timeout waiting for match=%v of IP %s on node %s", want, ip, node)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Setup: user1 is seen on node A, then on node B from another IP, along with user2
+	fakeClock.Advance(10 * time.Second)
+	track("a", "user1@test.com", "1.1.1.1")
+	waitForPersist(t, nodeA, 2*time.Second)
+	fakeClock.Advance(10 * time.Second)
+	track("b", "user1@test.com", "2.2.2.2")
+	track("b", "user2@test.com", "3.3.3.3")
+	waitForPersist(t, nodeB, 2*time.Second)
+
+	// Assert: Node B's save kept node A's IP instead of overwriting it
+	persistedData := readPersistedData(t, persistPath)
+	if ips := persistedData["user1@test.com"]; ips == nil || len(ips.IPs) != 2 ||
+		ips.IPs[0].IP != "2.2.2.2" || ips.IPs[1].IP != "1.1.1.1" {
+		t.Fatalf("Expected user1@test.com to have IPs ['2.2.2.2', '1.1.1.1'], but got %+v", ips)
+	}
+	if persistedData["user2@test.com"] == nil {
+		t.Fatalf("Expected user2@test.com in persisted data, but got %v", persistedData)
+	}
+
+	// Action: user1 shows up on node A from a third IP, exceeding max_ips_per_user
+	fakeClock.Advance(10 * time.Second)
+	track("a", "user1@test.com", "4.4.4.4")
+	waitForPersist(t, nodeA, 2*time.Second)
+
+	// Assert: The merged list is ordered by last_seen and cut to the limit
+	persistedData = readPersistedData(t, persistPath)
+	if ips := persistedData["user1@test.com"]; ips == nil || len(ips.IPs) != 2 ||
+		ips.IPs[0].IP != "4.4.4.4" || ips.IPs[1].IP != "2.2.2.2" {
+		t.Fatalf("Expected user1@test.com to have IPs ['4.4.4.4', '2.2.2.2'], but got %+v", ips)
+	}
+	// Saving merged node B's users into node A
+	if !matches("a", "3.3.3.3") {
+		t.Errorf("Expected node A to know user2's IP after saving")
+	}
+
+	// Action: Let the sync interval elapse. Node B may have picked up node A's
+	// save already, by watching the file.
+	fakeClock.Advance(time.Minute)
+
+	// Assert: Node B picks up node A's IP and drops the one cut from the list
+	waitForMatch("b", "4.4.4.4", true)
+	if matches("b", "1.1.1.1") {
+		t.Errorf("Expected IP 1.1.1.1 to be dropped from node B by the merge")
+	}
+
+	// Action: user2 is removed on node A
+	if !nodeA.RemoveUser("user2@test.com") {
+		t.Fatalf("Expected user2@test.com to exist on node A")
+	}
+	waitForPersist(t, nodeA, 2*time.Second)
+	fakeClock.Advance(time.Minute)
+
+	// Assert: The removal reaches node B instead of being undone by it
+	waitForMatch("b", "3.3.3.3", false)
+	track("b", "user1@test.com", "4.4.4.4")
+	fakeClock.Advance(time.Minute)
+	waitForPersist(t, nodeB, 2*time.Second)
+	if _, exists := readPersistedData(t, persistPath)["user2@test.com"]; exists {
+		t.Errorf("Expected the removed user2@test.com not to be written back by node B")
+	}
+}
+
+// TestFileWatch verifies that a file shared through sync_interval is watched,
+// so that a change saved to it by another writer is merged in without waiting
+// for the next sync, while the store's own saves are not reported as changes.
+func TestFileWatch(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                sync_interval 1h
+            }
+            respond "OK"
+        }
+    }
+  `)
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Action: Another writer replaces the file
+	data := `{"version": 1, "user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "last_seen": 1}]}}}`
+	if err := os.WriteFile(persistPath+".other", []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if err := os.Rename(persistPath+".other", persistPath); err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+
+	// Assert: The change is merged in within a few watch intervals, long
+	// before the next sync
+	deadline := time.Now().Add(2 * time.Second)
+	for len(storage.GetIPsForUser("user1@test.com")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for the change to the file to be merged in")
+		}
+		fakeClock.Advance(fileWatchInterval)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Action: Watch a file this backend saves to itself
+	watched := &fileBackend{path: persistPath + ".watched", watchInterval: fileWatchInterval, clock: fakeClock.FakeClock}
+	var changes atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Ignoring error, as the test only counts the changes reported
+		_ = watched.Watch(ctx, func() { changes.Add(1) })
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := watched.Save(ctx, []byte(data)); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	for range 3 {
+		fakeClock.Advance(fileWatchInterval)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert: Its own save is not reported
+	if n := changes.Load(); n != 0 {
+		t.Errorf("Expected the backend's own save not to be reported, but got %d changes", n)
+	}
+}
+
+// TestFailedWriteIsRetried verifies that a failed write schedules a retry,
+// backing off while the writes keep failing.
+func TestFailedWriteIsRetried(t *testing.T) {
+	persistDir := filepath.Join(filepath.Dir(createTempPersistFile(t)), "missing")
+	fakeClock := clockwork.NewFakeClock()
+	storage := newUserIPStorage("retry")
+	storage.clock = fakeClock
+	storage.storageConfig = storageConfig{backend: &fileBackend{path: filepath.Join(persistDir, "user_ips.json")}, maxIPsPerUser: 5}
+	flushRequested := func() bool {
+		select {
+		case <-storage.flushCh:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	// Setup: A change, whose flush is requested right away
+	storage.AddUserIP("user1@test.com", "1.1.1.1")
+	if !flushRequested() {
+		t.Fatalf("Expected a flush to be requested for the new IP")
+	}
+
+	for _, delay := range []time.Duration{minRetryDelay, 2 * minRetryDelay} {
+		// Action: The write fails, as the directory does not exist
+		if err := storage.Persist(false); err == nil {
+			t.Fatalf("Expected Persist to fail")
+		}
+
+		// Assert: A retry is requested once the delay has passed, and not before
+		fakeClock.Advance(delay - time.Millisecond)
+		if flushRequested() {
+			t.Fatalf("Expected no retry before %v", delay)
+		}
+		fakeClock.Advance(time.Millisecond)
+		if !flushRequested() {
+			t.Fatalf("Expected a retry after %v", delay)
+		}
+	}
+
+	// Action: The retry succeeds
+	if err := os.MkdirAll(persistDir, 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := storage.Persist(false); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: Nothing is left to retry
+	if storage.IsDirty() || storage.failedWrites != 0 {
+		t.Errorf("Expected no pending changes or failures after the retry")
+	}
+}
+
+// TestRemovalRetention verifies that removals are remembered for
+// removal_retention without a TTL, and forgotten after it.
+func TestRemovalRetention(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := clockwork.NewFakeClockAt(time.Unix(1000, 0))
+	storage := newUserIPStorage("removal_retention")
+	storage.clock = fakeClock
+	storage.storageConfig = storageConfig{
+		backend:          &fileBackend{path: persistPath},
+		maxIPsPerUser:    5,
+		removalRetention: time.Hour,
+	}
+	savedRemovals := func() map[string]map[string]int64 {
+		t.Helper()
+		data, err := os.ReadFile(persistPath)
+		if err != nil {
+			t.Fatalf("Failed to read persisted data: %v", err)
+		}
+		var pd persistData
+		if err := json.Unmarshal(data, &pd); err != nil {
+			t.Fatalf("Failed to decode persisted data: %v", err)
+		}
+		return pd.Removed
+	}
+
+	// Setup: A user is removed
+	storage.AddUserIP("user1@test.com", "1.1.1.1")
+	storage.RemoveUser("user1@test.com")
+
+	// Action: Save within the retention
+	fakeClock.Advance(30 * time.Minute)
+	if err := storage.Persist(true); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: The removal is kept
+	if removals := savedRemovals(); removals["user1@test.com"] == nil {
+		t.Errorf("Expected the removal of user1@test.com to be kept, but got %v", removals)
+	}
+
+	// Action: Save after the retention
+	fakeClock.Advance(time.Hour)
+	if err := storage.Persist(true); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: The removal is forgotten
+	if removals := savedRemovals(); len(removals) != 0 {
+		t.Errorf("Expected the removal of user1@test.com to be forgotten, but got %v", removals)
+	}
+}
+
+// TestExclusiveFileNotReadBack verifies that a file that no other instance
+// syncs with is read back before the store's first save to it, so that data
+// it must not overwrite is noticed, but not before the saves after that.
+func TestExclusiveFileNotReadBack(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	storage := newUserIPStorage("exclusive_file")
+	storage.storageConfig = storageConfig{backend: &fileBackend{path: persistPath}, maxIPsPerUser: 5}
+	writeUser := func(user string) {
+		t.Helper()
+		data := `{"version": 1, "user_data": {"` + user + `": {"ips": [{"ip": "9.9.9.9", "last_seen": 1}]}}}`
+		if err := os.WriteFile(persistPath, []byte(data), 0600); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+	}
+
+	// Action: The first save, over data written meanwhile
+	writeUser("user1@test.com")
+	storage.AddUserIP("user2@test.com", "2.2.2.2")
+	if err := storage.Persist(true); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: The data was read back and merged
+	if _, exists := readPersistedData(t, persistPath)["user1@test.com"]; !exists {
+		t.Errorf("Expected the first save to merge in user1@test.com")
+	}
+
+	// Action: A later save, over data written meanwhile
+	writeUser("user3@test.com")
+	if err := storage.Persist(true); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: The file was taken to hold what the store last wrote
+	persistedData := readPersistedData(t, persistPath)
+	if _, exists := persistedData["user3@test.com"]; exists {
+		t.Errorf("Expected the later save not to read the file back")
+	}
+	if _, exists := persistedData["user2@test.com"]; !exists {
+		t.Errorf("Expected the later save to hold user2@test.com")
+	}
+}
+
+// gatedBackend is a Backend whose saves wait until the test lets them through,
+// or fail with saveErr if it is set. Loads fail with loadErr if it is set.
+type gatedBackend struct {
+	mu      sync.Mutex
+	data    []byte
+	saveErr error
+	loadErr error
+
+	// Receives the data of each save, which then waits on release
+	saving  chan []byte
+	release chan struct{}
+}
+
+func (b *gatedBackend) Load(ctx context.Context) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.loadErr != nil {
+		return nil, b.loadErr
+	}
+	return b.data, nil
+}
+
+func (b *gatedBackend) Save(ctx context.Context, data []byte) error {
+	b.saving <- data
+	<-b.release
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.saveErr != nil {
+		return b.saveErr
+	}
+	b.data = data
+	return nil
+}
+
+func (b *gatedBackend) Delete(ctx context.Context) error { return nil }
+
+func (b *gatedBackend) String() string { return "gated" }
+
+// TestPersistOutsideLock verifies that tracking and matching carry on while a
+// save is being written, and that changes made meanwhile, or lost to a failed
+// write, stay pending for the next one.
+func TestPersistOutsideLock(t *testing.T) {
+	backend := &gatedBackend{saving: make(chan []byte), release: make(chan struct{})}
+	storage := newUserIPStorage("persist_outside_lock")
+	storage.storageConfig = storageConfig{backend: backend, maxIPsPerUser: 5}
+	savedUsers := func(data []byte) map[string]*UserData {
+		t.Helper()
+		var pd persistData
+		if err := json.Unmarshal(data, &pd); err != nil {
+			t.Fatalf("Failed to decode saved data: %v", err)
+		}
+		return pd.UserData
+	}
+
+	// Setup: user1 is tracked, and a save of it starts
+	storage.AddUserIP("user1@test.com", "1.1.1.1")
+	persisted := make(chan error, 1)
+	go func() { persisted <- storage.Persist(false) }()
+	data := <-backend.saving
+
+	// Action: user2 is tracked while the save is being written
+	tracked := make(chan struct{})
+	go func() {
+		storage.AddUserIP("user2@test.com", "2.2.2.2")
+		close(tracked)
+	}()
+	select {
+	case <-tracked:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected tracking not to wait for the save")
+	}
+
+	// Assert: Lookups see both users, while the save holds the snapshot it started with
+	if !storage.HasIP("1.1.1.1") || !storage.HasIP("2.2.2.2") {
+		t.Errorf("Expected both IPs to match during the save")
+	}
+	if users := savedUsers(data); len(users) != 1 || users["user1@test.com"] == nil {
+		t.Errorf("Expected the save to hold only user1@test.com, but got %v", users)
+	}
+	close(backend.release)
+	if err := <-persisted; err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+	if !storage.IsDirty() {
+		t.Errorf("Expected the change made during the save to be pending")
+	}
+
+	// Action: The next save fails
+	backend.release = make(chan struct{})
+	backend.saveErr = fs.ErrPermission
+	go func() { persisted <- storage.Persist(false) }()
+	<-backend.saving
+	if !storage.IsDirty() {
+		t.Errorf("Expected the data to count as unsaved while it is written")
+	}
+	close(backend.release)
+	if err := <-persisted; err == nil {
+		t.Fatalf("Expected Persist to fail")
+	}
+
+	// Assert: The changes stay pending, and the retry saves both users
+	if !storage.IsDirty() {
+		t.Errorf("Expected the changes of the failed save to be pending")
+	}
+	backend.mu.Lock()
+	backend.saveErr = nil
+	backend.mu.Unlock()
+	go func() { persisted <- storage.Persist(false) }()
+	data = <-backend.saving
+	if err := <-persisted; err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+	if users := savedUsers(data); len(users) != 2 {
+		t.Errorf("Expected the retry to save both users, but got %v", users)
+	}
+	if storage.IsDirty() {
+		t.Errorf("Expected no pending changes after the retry")
+	}
+}
+
+// TestSaveLeavesUnreadableData verifies that a save does not overwrite saved
+// data it cannot read, which may be fine, but does overwrite data that is
+// corrupt.
+func TestSaveLeavesUnreadableData(t *testing.T) {
+	backend := &gatedBackend{saving: make(chan []byte), release: make(chan struct{}), loadErr: fs.ErrPermission}
+	storage := newUserIPStorage("save_unreadable")
+	storage.storageConfig = storageConfig{backend: backend, maxIPsPerUser: 5}
+	storage.AddUserIP("user1@test.com", "1.1.1.1")
+
+	// Action: Save while the saved data cannot be read
+	persisted := make(chan error, 1)
+	go func() { persisted <- storage.Persist(false) }()
+
+	// Assert: The save fails without writing, and the changes stay pending
+	select {
+	case err := <-persisted:
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("Expected Persist to fail with the read error, but got: %v", err)
+		}
+	case <-backend.saving:
+		t.Fatalf("Expected data that cannot be read not to be overwritten")
+	}
+	if !storage.IsDirty() {
+		t.Errorf("Expected the changes to stay pending")
+	}
+
+	// Action: Save over data that is corrupt
+	backend.mu.Lock()
+	backend.loadErr = nil
+	backend.data = []byte("{not json")
+	backend.mu.Unlock()
+	close(backend.release)
+	go func() { persisted <- storage.Persist(false) }()
+
+	// Assert: The data in memory replaces it
+	if data := <-backend.saving; !strings.Contains(string(data), "user1@test.com") {
+		t.Errorf("Expected the save to hold user1@test.com, but got %s", data)
+	}
+	if err := <-persisted; err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+}
+
+// TestBackupRotation verifies that each save of the file backend keeps the
+// previous file as the newest backup, up to the configured number.
+func TestBackupRotation(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                backups 2
+            }
+            respond "OK"
+        }
+    }
+  `)
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Action: Four users are tracked, each saved separately
+	for _, email := range []string{"user1@test.com", "user2@test.com", "user3@test.com", "user4@test.com"} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", email, "1.1.1.1", "")
+		_ = resp.Body.Close()
+		waitForPersist(t, storage, 2*time.Second)
+	}
+
+	// Assert: The two previous saves are kept, newest first
+	if users := readPersistedData(t, persistPath); len(users) != 4 {
+		t.Errorf("Expected 4 users in the file, but got %v", users)
+	}
+	if users := readPersistedData(t, persistPath+".1"); len(users) != 3 {
+		t.Errorf("Expected 3 users in the newest backup, but got %v", users)
+	}
+	if users := readPersistedData(t, persistPath+".2"); len(users) != 2 {
+		t.Errorf("Expected 2 users in the oldest backup, but got %v", users)
+	}
+	if _, err := os.Stat(persistPath + ".3"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected no third backup, but got: %v", err)
+	}
+}
+
+// TestLoadCorruptFallsBackToBackup verifies that a corrupt file is moved aside
+// and the newest backup that can be read is loaded and saved in its place.
+func TestLoadCorruptFallsBackToBackup(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	// Setup: A truncated file, a damaged newest backup, and a good older one
+	truncated := `{"version": 1, "user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "last_se`
+	files := map[string]string{
+		persistPath:        truncated,
+		persistPath + ".1": "\x00\x00\x00\x00",
+		persistPath + ".2": `{"version": 1, "user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "last_seen": 1}]}}}`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `)
+	storage := getLiveStorage(t, defaultStoreName)
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: The good backup was loaded
+	if got := storage.GetIPsForUser("user1@test.com"); len(got) != 1 || got[0] != "1.1.1.1" {
+		t.Errorf("Expected user1@test.com to have IPs ['1.1.1.1'] from the backup, but got %v", got)
+	}
+
+	// Assert: The corrupt file was moved aside as it was
+	quarantined, _ := filepath.Glob(persistPath + ".corrupt-*")
+	if len(quarantined) != 1 {
+		t.Fatalf("Expected one quarantined file, but got %v", quarantined)
+	}
+	if data, _ := os.ReadFile(quarantined[0]); string(data) != truncated {
+		t.Errorf("Expected the quarantined file to hold the corrupt data, but got %s", data)
+	}
+
+	// Assert: The recovered data was saved in its place
+	if users := readPersistedData(t, persistPath); users["user1@test.com"] == nil {
+		t.Errorf("Expected the recovered data to be saved, but got %v", users)
+	}
+}
+
+// TestLoadCorruptWithoutBackup verifies that a corrupt file without a backup
+// is moved aside and the store starts empty, unless strict_load is set, in
+// which case loading fails and the file is left alone.
+func TestLoadCorruptWithoutBackup(t *testing.T) {
+	corrupt := `{"user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1"`
+
+	for _, strict := range []bool{false, true} {
+		persistPath := createTempPersistFile(t)
+		if err := os.WriteFile(persistPath, []byte(corrupt), 0644); err != nil {
+			t.Fatalf("Failed to write corrupt data: %v", err)
+		}
+		storage := newUserIPStorage("corrupt")
+		storage.storageConfig = storageConfig{
+			backend:       &fileBackend{path: persistPath, backups: defaultBackups},
+			maxIPsPerUser: 5,
+			strictLoad:    strict,
+		}
+
+		// Action: Load the data
+		err := storage.Load()
+
+		// Assert: Only strict mode fails, and only the other sets the file aside
+		quarantined, _ := filepath.Glob(persistPath + ".corrupt-*")
+		if strict {
+			if !errors.Is(err, errCorrupt) {
+				t.Errorf("Expected strict loading to fail with errCorrupt, but got: %v", err)
+			}
+			if data, _ := os.ReadFile(persistPath); string(data) != corrupt || len(quarantined) != 0 {
+				t.Errorf("Expected strict loading to leave the file alone, but got %q and %v", data, quarantined)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected loading to recover, but got: %v", err)
+		}
+		if users := storage.GetUsers(); len(users) != 0 {
+			t.Errorf("Expected no users without a backup, but got %v", users)
+		}
+		if len(quarantined) != 1 {
+			t.Errorf("Expected one quarantined file, but got %v", quarantined)
+		}
+		if !storage.IsDirty() {
+			t.Errorf("Expected the recovered state to be saved")
+		}
+	}
+}
+
+// TestStorageLoadIsStrict verifies that corrupt data in Caddy's storage, of
+// which no backups are kept, fails the config rather than being set aside for
+// an empty store, unless strict_load is turned off.
+func TestStorageLoadIsStrict(t *testing.T) {
+	setupFakeClock(t)
+	const key = "user_ip/default.json"
+	corrupt := []byte(`{"user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1"`)
+	if err := (memoryStorage{}).Store(context.Background(), key, corrupt); err != nil {
+		t.Fatalf("Failed to store corrupt data: %v", err)
+	}
+	t.Cleanup(func() {
+		// Ignoring error in test cleanup
+		_ = memoryStorage{}.Delete(context.Background(), key)
+	})
+	caddyfile := func(strictLoad string) string {
+		return fullTestCaddyfileWithOptions("    storage user_ip_memory", `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                backend storage
+                max_ips_per_user 5
+                `+strictLoad+`
+            }
+            respond "OK"
+        }
+    }
+  `)
+	}
+
+	// Action 1: Load a config without strict_load
+	unloadStores(t)
+	err := loadCaddyfile(t, caddyfile(""))
+
+	// Assertion 1: The config fails, and the data is left alone
+	if err == nil {
+		t.Fatalf("Expected corrupt data in the storage to fail the config")
+	}
+	if data, _ := (memoryStorage{}).Load(context.Background(), key); string(data) != string(corrupt) {
+		t.Errorf("Expected the corrupt data to be left alone, but got %q", data)
+	}
+
+	// Action 2: Load it again with strict_load turned off
+	err = loadCaddyfile(t, caddyfile("strict_load off"))
+
+	// Assertion 2: The data is set aside and the store starts empty
+	if err != nil {
+		t.Fatalf("Expected the config to load with strict_load off, but got: %v", err)
+	}
+	if users := getLiveStorage(t, defaultStoreName).GetUsers(); len(users) != 0 {
+		t.Errorf("Expected no users, but got %v", users)
+	}
+	if data, _ := (memoryStorage{}).Load(context.Background(), key); string(data) == string(corrupt) {
+		t.Errorf("Expected the corrupt data to be set aside")
+	}
+}
+
+// TestFailedSaveKeepsBackups verifies that a save of the file backend that
+// fails does not rotate the backups, so none of them is lost to it.
+func TestFailedSaveKeepsBackups(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	backend := &fileBackend{path: persistPath, backups: 2}
+	ctx := context.Background()
+	for _, data := range []string{"one", "two", "three"} {
+		if err := backend.Save(ctx, []byte(data)); err != nil {
+			t.Fatalf("Failed to save %q: %v", data, err)
+		}
+	}
+
+	// Action: Save over something that cannot be replaced or kept as a backup
+	if err := os.Remove(persistPath); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(persistPath, "sub"), 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	err := backend.Save(ctx, []byte("four"))
+
+	// Assert: The save fails, and the backups are as they were
+	if err == nil {
+		t.Fatalf("Expected the save to fail")
+	}
+	for n, want := range map[int]string{1: "two", 2: "one"} {
+		if data, err := os.ReadFile(backend.backupPath(n)); string(data) != want {
+			t.Errorf("Expected backup %d to hold %q, but got %q and %v", n, want, data, err)
+		}
+	}
+	for _, pattern := range []string{".tmp-*", ".prev-*"} {
+		if leftover, _ := filepath.Glob(persistPath + pattern); len(leftover) != 0 {
+			t.Errorf("Expected no temporary or previous file to be left behind, but got %v", leftover)
+		}
+	}
+}
+
+// TestConcurrentWriters verifies that writers sharing a file or a storage key
+// can save at the same time: no save fails, readers never see a partial file,
+// and with the storage backend, which is locked while a save merges and
+// writes, no writer's changes are lost to another's.
+func TestConcurrentWriters(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	const saves = 200
+
+	// Action: Two file backends save to one path, while it is being read
+	var wg sync.WaitGroup
+	var failed, invalid atomic.Int32
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if data, err := os.ReadFile(persistPath); err == nil && !json.Valid(data) {
+				invalid.Add(1)
+			}
+		}
+	}()
+	for writer := range 2 {
+		backend := &fileBackend{path: persistPath, backups: 2}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range saves {
+				data := fmt.Sprintf(`{"version": 1, "user_data": {"writer%d-%d@test.com": {"ips": []}}}`, writer, n)
+				if err := backend.Save(context.Background(), []byte(data)); err != nil {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+
+	// Assert: Every save succeeded, the file was always whole, and nothing
+	// was left behind
+	if n := failed.Load(); n != 0 {
+		t.Errorf("Expected every save to succeed, but %d of %d failed", n, 2*saves)
+	}
+	if n := invalid.Load(); n != 0 {
+		t.Errorf("Expected every read to see a whole file, but %d did not", n)
+	}
+	for _, pattern := range []string{".tmp-*", ".prev-*"} {
+		if leftover, _ := filepath.Glob(persistPath + pattern); len(leftover) != 0 {
+			t.Errorf("Expected no temporary or previous file to be left behind, but got %v", leftover)
+		}
+	}
+
+	// Action: Two stores on one storage key each track users and save them
+	// at the same time
+	const key = "user_ip/concurrent.json"
+	t.Cleanup(func() {
+		// Ignoring error in test cleanup
+		_ = memoryStorage{}.Delete(context.Background(), key)
+	})
+	const users = 50
+	for node := range 2 {
+		storage := newUserIPStorage(fmt.Sprintf("concurrent_%d", node))
+		storage.storageConfig = storageConfig{
+			backend:       &storageBackend{storage: memoryStorage{}, key: key},
+			maxIPsPerUser: 5,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range users {
+				storage.AddUserIP(fmt.Sprintf("node%d-%d@test.com", node, n), "1.1.1.1")
+				if err := storage.Persist(true); err != nil {
+					t.Errorf("Persist failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Assert: The saved data holds every user of both stores
+	if saved := readMemoryStorageData(t, key); len(saved) != 2*users {
+		t.Errorf("Expected %d users to be saved, but got %d", 2*users, len(saved))
+	}
+}
@@ -0,0 +1,467 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of a bolt database.
+var (
+	// Each user's UserData (JSON), by user
+	boltUsers = []byte("users")
+
+	// Each user's record of an IP (IPData, JSON), by ipKey, so that the users
+	// of an IP, and of the addresses in a network, are next to each other
+	boltIPs = []byte("ips")
+
+	// Each user's removals (JSON, as in persistData.Removed), by user
+	boltRemoved = []byte("removed")
+
+	// Unix timestamp (seconds, decimal) of each import_json, by imported path
+	boltImports = []byte("imports")
+)
+
+// boltOpenTimeout is how long opening a database waits for another process,
+// e.g. a second Caddy, to release its lock on the file.
+const boltOpenTimeout = 5 * time.Second
+
+// boltDBs holds the open bolt databases, keyed by path. A database file is
+// locked while it is open, so every handler using it, including those of the
+// next config during a reload, shares one handle to it.
+var boltDBs = caddy.NewUsagePool()
+
+// boltDB is a shared handle to an open bolt database.
+type boltDB struct {
+	db *bolt.DB
+}
+
+// Destruct implements caddy.Destructor.
+func (db boltDB) Destruct() error {
+	return db.db.Close()
+}
+
+// boltBackend keeps the state in a bolt database, with each user's data as a
+// separate record, and an index of the users of each IP. Changes are applied
+// in a transaction that only rewrites the records they touch, so the cost of
+// a write does not grow with the number of users. New IPs and removals are
+// written before AddUserIP or RemoveUser returns, while IPs seen again are
+// batched by the store's writer. Unless the store's cache is turned off, the
+// store still loads every record on startup and serves lookups from memory;
+// with it off, lookups read the index, and only the users with changes not
+// written yet are kept in memory.
+type boltBackend struct {
+	path string
+	db   *bolt.DB
+}
+
+// openBoltBackend opens the bolt database at path, creating it if necessary,
+// and adds a reference to it. Every call must be paired with Close.
+func openBoltBackend(path string) (*boltBackend, error) {
+	val, _, err := boltDBs.LoadOrNew(path, func() (caddy.Destructor, error) {
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+		if err != nil {
+			return nil, err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			indexed := tx.Bucket(boltIPs) != nil
+			for _, name := range [][]byte{boltUsers, boltIPs, boltRemoved, boltImports} {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			if !indexed {
+				// Some earlier versions did not keep the index
+				return indexUsers(tx)
+			}
+			return nil
+		})
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		return boltDB{db}, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt database %s: %v", path, err)
+	}
+	return &boltBackend{path: path, db: val.(boltDB).db}, nil
+}
+
+// indexUsers adds the IPs of every user record to the IP index.
+func indexUsers(tx *bolt.Tx) error {
+	ips := tx.Bucket(boltIPs)
+	return tx.Bucket(boltUsers).ForEach(func(user, value []byte) error {
+		var userData UserData
+		if err := json.Unmarshal(value, &userData); err != nil {
+			return fmt.Errorf("decoding user %q: %v", user, err)
+		}
+		for _, ipData := range userData.IPs {
+			if err := putRecord(ips, ipKey(ipData.IP, string(user)), ipData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close drops the reference taken by openBoltBackend. The database is closed
+// once the last reference is dropped.
+func (b *boltBackend) Close() error {
+	_, err := boltDBs.Delete(b.path)
+	return err
+}
+
+// Load implements Backend. The store reads the records with Records instead,
+// which does not encode them.
+func (b *boltBackend) Load(ctx context.Context) ([]byte, error) {
+	pd, err := b.Records(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(pd.UserData) == 0 && len(pd.Removed) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(pd)
+}
+
+// Records implements recordBackend.
+func (b *boltBackend) Records(ctx context.Context) (persistData, error) {
+	pd := persistData{
+		// The records are always written in the current format
+		Version:  persistVersion,
+		UserData: make(map[string]*UserData),
+	}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltUsers).ForEach(func(user, value []byte) error {
+			var userData UserData
+			if err := json.Unmarshal(value, &userData); err != nil {
+				return fmt.Errorf("decoding user %q: %v", user, err)
+			}
+			pd.UserData[string(user)] = &userData
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		pd.Removed, err = readRemovals(tx)
+		return err
+	})
+	if err != nil {
+		return persistData{}, err
+	}
+	return pd, nil
+}
+
+// Save implements Backend. Every record is replaced in a single transaction.
+func (b *boltBackend) Save(ctx context.Context, data []byte) error {
+	var pd persistData
+	if err := json.Unmarshal(data, &pd); err != nil {
+		return err
+	}
+	return b.Replace(ctx, pd)
+}
+
+// Delete implements Backend. The records are removed, but the database file
+// is kept, as it may still be open.
+func (b *boltBackend) Delete(ctx context.Context) error {
+	return b.Replace(ctx, persistData{})
+}
+
+// Replace implements recordBackend.
+func (b *boltBackend) Replace(ctx context.Context, pd persistData) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsers, boltIPs, boltRemoved} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		users, ips, removed := tx.Bucket(boltUsers), tx.Bucket(boltIPs), tx.Bucket(boltRemoved)
+		for user, userData := range pd.UserData {
+			if err := putRecord(users, []byte(user), userData); err != nil {
+				return err
+			}
+			for _, ipData := range userData.IPs {
+				if err := putRecord(ips, ipKey(ipData.IP, user), ipData); err != nil {
+					return err
+				}
+			}
+		}
+		for user, removals := range pd.Removed {
+			if err := putRecord(removed, []byte(user), removals); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Apply implements recordBackend. The records of the users the entries touch
+// are read, the entries applied to them as when replaying a journal, and the
+// results written back along with their IP index records. Users left without
+// IPs or removals lose their records.
+func (b *boltBackend) Apply(ctx context.Context, entries []journalEntry) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		users, ips, removed := tx.Bucket(boltUsers), tx.Bucket(boltIPs), tx.Bucket(boltRemoved)
+
+		// IPs of each touched user before the changes
+		before := make(map[string][]IPData)
+		pd := persistData{
+			UserData: make(map[string]*UserData),
+			Removed:  make(map[string]map[string]int64),
+		}
+		for _, entry := range entries {
+			if _, loaded := before[entry.User]; loaded {
+				continue
+			}
+			var userData UserData
+			exists, err := getRecord(users, []byte(entry.User), &userData)
+			if err != nil {
+				return err
+			}
+			if exists {
+				pd.UserData[entry.User] = &userData
+			}
+			before[entry.User] = slices.Clone(userData.IPs)
+
+			var removals map[string]int64
+			if _, err := getRecord(removed, []byte(entry.User), &removals); err != nil {
+				return err
+			}
+			if removals != nil {
+				pd.Removed[entry.User] = removals
+			}
+		}
+
+		for _, entry := range entries {
+			pd.apply(entry)
+		}
+
+		for user, oldIPs := range before {
+			var newIPs []IPData
+			if userData, exists := pd.UserData[user]; exists {
+				newIPs = userData.IPs
+				if err := putRecord(users, []byte(user), userData); err != nil {
+					return err
+				}
+			} else if err := users.Delete([]byte(user)); err != nil {
+				return err
+			}
+
+			for _, ipData := range oldIPs {
+				if slices.ContainsFunc(newIPs, func(newIPData IPData) bool { return newIPData.IP == ipData.IP }) {
+					continue
+				}
+				if err := ips.Delete(ipKey(ipData.IP, user)); err != nil {
+					return err
+				}
+			}
+			for _, ipData := range newIPs {
+				if err := putRecord(ips, ipKey(ipData.IP, user), ipData); err != nil {
+					return err
+				}
+			}
+
+			if removals, exists := pd.Removed[user]; exists {
+				if err := putRecord(removed, []byte(user), removals); err != nil {
+					return err
+				}
+			} else if err := removed.Delete([]byte(user)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// user returns the record of user, and false if there is none.
+func (b *boltBackend) user(user string) (*UserData, bool, error) {
+	var userData UserData
+	var exists bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		exists, err = getRecord(tx.Bucket(boltUsers), []byte(user), &userData)
+		return err
+	})
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	return &userData, true, nil
+}
+
+// forEachUser calls fn with every user record, in the order of the users,
+// until fn returns false. The records are read in a single transaction, which
+// is held open while fn runs.
+func (b *boltBackend) forEachUser(fn func(user string, userData *UserData) bool) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltUsers).Cursor()
+		for user, value := cursor.First(); user != nil; user, value = cursor.Next() {
+			var userData UserData
+			if err := json.Unmarshal(value, &userData); err != nil {
+				return fmt.Errorf("decoding user %q: %v", user, err)
+			}
+			if !fn(string(user), &userData) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// removals returns every user's removals.
+func (b *boltBackend) removals() (map[string]map[string]int64, error) {
+	var removals map[string]map[string]int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		removals, err = readRemovals(tx)
+		return err
+	})
+	return removals, err
+}
+
+// readRemovals returns every user's removals.
+func readRemovals(tx *bolt.Tx) (map[string]map[string]int64, error) {
+	removals := make(map[string]map[string]int64)
+	err := tx.Bucket(boltRemoved).ForEach(func(user, value []byte) error {
+		var userRemovals map[string]int64
+		if err := json.Unmarshal(value, &userRemovals); err != nil {
+			return fmt.Errorf("decoding removals of user %q: %v", user, err)
+		}
+		removals[string(user)] = userRemovals
+		return nil
+	})
+	return removals, err
+}
+
+// lookup calls fn with every user's record of each IP within network, from
+// the IP index, in the order of the addresses, until fn returns false. If
+// withUser is set, fn also receives the record of the user, or nil if there
+// is none.
+func (b *boltBackend) lookup(network netip.Prefix, withUser bool, fn func(user string, ipData IPData, userData *UserData) bool) error {
+	network = network.Masked()
+	start := network.Addr().As16()
+	return b.db.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket(boltUsers)
+		cursor := tx.Bucket(boltIPs).Cursor()
+		for key, value := cursor.Seek(start[:]); key != nil; key, value = cursor.Next() {
+			if len(key) < 16 {
+				continue
+			}
+			// The addresses of a network are next to each other, so the first
+			// one outside it ends the walk
+			if !network.Contains(netip.AddrFrom16([16]byte(key[:16])).Unmap()) {
+				return nil
+			}
+			var ipData IPData
+			if err := json.Unmarshal(value, &ipData); err != nil {
+				return fmt.Errorf("decoding IP index record %q: %v", key, err)
+			}
+			user := string(key[16:])
+			var userData *UserData
+			if withUser {
+				userData = &UserData{}
+				exists, err := getRecord(users, key[16:], userData)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					userData = nil
+				}
+			}
+			if !fn(user, ipData, userData) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// counts returns the number of users and of distinct IPs in the database.
+func (b *boltBackend) counts() (int, int, error) {
+	var users, ips int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		users = tx.Bucket(boltUsers).Stats().KeyN
+		var last []byte
+		return tx.Bucket(boltIPs).ForEach(func(key, _ []byte) error {
+			if len(key) >= 16 && !bytes.Equal(key[:16], last) {
+				ips++
+				last = key[:16]
+			}
+			return nil
+		})
+	})
+	return users, ips, err
+}
+
+// imported returns true if the JSON file at path was imported before.
+func (b *boltBackend) imported(path string) (bool, error) {
+	var imported bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(boltImports).Get([]byte(path)) != nil
+		return nil
+	})
+	return imported, err
+}
+
+// markImported records that the JSON file at path was imported at the given
+// Unix time.
+func (b *boltBackend) markImported(path string, at int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltImports).Put([]byte(path), fmt.Appendf(nil, "%d", at))
+	})
+}
+
+// String implements Backend.
+func (b *boltBackend) String() string {
+	return "bolt:" + b.path
+}
+
+// ipKey returns the key of user's record of ip in the IP index: the 16-byte
+// form of the address followed by the user, so that the records of an IP, and
+// those of the addresses in a network, are next to each other.
+func ipKey(ip, user string) []byte {
+	// Stored IPs are in canonical form, so they always parse
+	addr, _ := netip.ParseAddr(ip)
+	key := addr.As16()
+	return append(key[:], user...)
+}
+
+// getRecord decodes the record stored under key into v. Returns false if
+// there is none.
+func getRecord(bucket *bolt.Bucket, key []byte, v any) (bool, error) {
+	value := bucket.Get(key)
+	if value == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return true, fmt.Errorf("decoding record %q: %v", key, err)
+	}
+	return true, nil
+}
+
+// putRecord stores v under key.
+func putRecord(bucket *bolt.Bucket, key []byte, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, value)
+}
+
+// Interface guards
+var (
+	_ Backend          = (*boltBackend)(nil)
+	_ recordBackend    = (*boltBackend)(nil)
+	_ caddy.Destructor = boltDB{}
+)
@@ -0,0 +1,357 @@
+package caddy_user_ip
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	bolt "go.etcd.io/bbolt"
+)
+
+// readBoltDB returns the users saved in the bolt database at path, which the
+// running config may have open, and its IP index as "<ip> <user>" strings.
+func readBoltDB(t *testing.T, path string) (map[string]*UserData, []string) {
+	t.Helper()
+	backend, err := openBoltBackend(path)
+	if err != nil {
+		t.Fatalf("Failed to open bolt database: %v", err)
+	}
+	defer func() { _ = backend.Close() }()
+
+	pd, err := backend.Records(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to load bolt database: %v", err)
+	}
+
+	var index []string
+	err = backend.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIPs).ForEach(func(key, _ []byte) error {
+			addr := netip.AddrFrom16([16]byte(key[:16])).Unmap()
+			index = append(index, addr.String()+" "+string(key[16:]))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to read IP index: %v", err)
+	}
+	return pd.UserData, index
+}
+
+// ipStrings returns the IPs of userData, in order, or nil if it is nil.
+func ipStrings(userData *UserData) []string {
+	if userData == nil {
+		return nil
+	}
+	ips := make([]string, len(userData.IPs))
+	for i, ipData := range userData.IPs {
+		ips[i] = ipData.IP
+	}
+	return ips
+}
+
+// TestBoltBackend verifies that the bolt backend saves each user as a record,
+// indexes the users of each IP, applies additions and evictions to both, and
+// loads the data back on startup.
+func TestBoltBackend(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "user_ips.db")
+	setupFakeClock(t)
+
+	caddyfile := `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                backend bolt
+                persist_path ` + dbPath + `
+                max_ips_per_user 2
+            }
+            respond "OK"
+        }
+    }
+  `
+	tester := createTester(t, caddyfile)
+	track := func(email, ip string) {
+		t.Helper()
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", email, ip, "")
+		_ = resp.Body.Close()
+	}
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Action: Two users share an IP, and one of them has a second one
+	track("user1@test.com", "1.1.1.1")
+	track("user2@test.com", "1.1.1.1")
+	track("user1@test.com", "2.2.2.2")
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: Each user is a record, and each of their IPs is indexed
+	users, index := readBoltDB(t, dbPath)
+	if len(users) != 2 || users["user1@test.com"] == nil || users["user2@test.com"] == nil {
+		t.Errorf("Expected records for both users, but got %v", users)
+	}
+	want := []string{"1.1.1.1 user1@test.com", "1.1.1.1 user2@test.com", "2.2.2.2 user1@test.com"}
+	if !slices.Equal(index, want) {
+		t.Errorf("Expected IP index %v, but got %v", want, index)
+	}
+
+	// Action: A third IP evicts user1's oldest
+	track("user1@test.com", "3.3.3.3")
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: The evicted IP left user1's record and the index, while user2
+	// keeps it
+	users, index = readBoltDB(t, dbPath)
+	want = []string{"1.1.1.1 user2@test.com", "2.2.2.2 user1@test.com", "3.3.3.3 user1@test.com"}
+	if !slices.Equal(index, want) {
+		t.Errorf("Expected IP index %v, but got %v", want, index)
+	}
+	if got := ipStrings(users["user1@test.com"]); !slices.Equal(got, []string{"3.3.3.3", "2.2.2.2"}) {
+		t.Errorf("Expected user1@test.com's record to hold IPs ['3.3.3.3', '2.2.2.2'], but got %v", got)
+	}
+	if got := ipStrings(users["user2@test.com"]); !slices.Equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("Expected user2@test.com's record to hold IPs ['1.1.1.1'], but got %v", got)
+	}
+
+	// Action: Start over
+	createTester(t, caddyfile)
+	storage = getLiveStorage(t, defaultStoreName)
+
+	// Assert: The data was loaded from the database
+	if got := storage.GetIPsForUser("user1@test.com"); !slices.Equal(got, []string{"3.3.3.3", "2.2.2.2"}) {
+		t.Errorf("Expected user1@test.com to have IPs ['3.3.3.3', '2.2.2.2'], but got %v", got)
+	}
+	if got := storage.GetUsersForIP("1.1.1.1"); !slices.Equal(got, []string{"user2@test.com"}) {
+		t.Errorf("Expected 1.1.1.1 to belong to user2@test.com only, but got %v", got)
+	}
+}
+
+// TestBoltImport verifies that import_json copies the data of a JSON file
+// saved by the file backend into the bolt database, only the first time.
+func TestBoltImport(t *testing.T) {
+	jsonPath := createTempPersistFile(t)
+	dbPath := filepath.Join(filepath.Dir(jsonPath), "user_ips.db")
+	setupFakeClock(t)
+
+	// Setup: A JSON file with user1
+	initial := `{"user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "first_seen": 1, "last_seen": 1}]}}}`
+	if err := os.WriteFile(jsonPath, []byte(initial), 0644); err != nil {
+		t.Fatalf("Failed to write JSON file: %v", err)
+	}
+
+	caddyfile := `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                backend bolt
+                persist_path ` + dbPath + `
+                import_json ` + jsonPath + `
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `
+	createTester(t, caddyfile)
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Assert: user1 was imported into the store and the database
+	if got := storage.GetIPsForUser("user1@test.com"); !slices.Equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("Expected user1@test.com to have IPs ['1.1.1.1'], but got %v", got)
+	}
+	users, _ := readBoltDB(t, dbPath)
+	if len(users) != 1 || !slices.Equal(ipStrings(users["user1@test.com"]), []string{"1.1.1.1"}) {
+		t.Errorf("Expected user1@test.com with IP 1.1.1.1 in the database, but got %v", users)
+	}
+
+	// Setup: The JSON file changes afterwards
+	changed := `{"user_data": {"user2@test.com": {"ips": [{"ip": "2.2.2.2", "first_seen": 1, "last_seen": 1}]}}}`
+	if err := os.WriteFile(jsonPath, []byte(changed), 0644); err != nil {
+		t.Fatalf("Failed to write JSON file: %v", err)
+	}
+
+	// Action: Start over
+	createTester(t, caddyfile)
+	storage = getLiveStorage(t, defaultStoreName)
+
+	// Assert: The file was not imported again
+	users = storage.GetUsers()
+	if len(users) != 1 || users["user1@test.com"] == nil {
+		t.Errorf("Expected only user1@test.com, but got %v", users)
+	}
+}
+
+// newUncachedStorage returns a store keeping its data in the bolt database at
+// path with the cache turned off, and the fake clock it uses. Its data is
+// loaded, but its writer is not started, so tests persist it explicitly.
+func newUncachedStorage(t *testing.T, name, path string) (*UserIPStorage, *clockwork.FakeClock) {
+	t.Helper()
+	backend, err := openBoltBackend(path)
+	if err != nil {
+		t.Fatalf("Failed to open bolt database: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+
+	fakeClock := clockwork.NewFakeClockAt(time.Unix(1000, 0))
+	storage := newUserIPStorage(name)
+	storage.clock = fakeClock
+	storage.storageConfig = storageConfig{
+		backend:          backend,
+		maxIPsPerUser:    5,
+		removalRetention: time.Hour,
+		uncached:         true,
+	}
+	storage.view.configure(fakeClock, 0, 0, backend, storage.logger)
+	if err := storage.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return storage, fakeClock
+}
+
+// TestBoltUncached verifies that with the cache turned off, new IPs and
+// removals are written to the database before AddUserIP and RemoveUser
+// return, lookups read the database's IP index, and users only stay in memory
+// while they have changes not written yet.
+func TestBoltUncached(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "user_ips.db")
+	storage, fakeClock := newUncachedStorage(t, "bolt_uncached", dbPath)
+
+	// Action: Two users share an IP, and one of them has a second one
+	storage.AddUserIP("user1@test.com", "1.1.1.1")
+	storage.AddUserIP("user2@test.com", "1.1.1.1")
+	storage.AddUserIP("user1@test.com", "2.2.2.2")
+
+	// Assert: The records and index were written at once, and nothing is
+	// left in memory
+	users, index := readBoltDB(t, dbPath)
+	if got := ipStrings(users["user1@test.com"]); !slices.Equal(got, []string{"2.2.2.2", "1.1.1.1"}) {
+		t.Errorf("Expected user1@test.com's record to hold IPs ['2.2.2.2', '1.1.1.1'], but got %v", got)
+	}
+	want := []string{"1.1.1.1 user1@test.com", "1.1.1.1 user2@test.com", "2.2.2.2 user1@test.com"}
+	if !slices.Equal(index, want) {
+		t.Errorf("Expected IP index %v, but got %v", want, index)
+	}
+	if len(storage.userData) != 0 {
+		t.Errorf("Expected no users in memory, but got %v", storage.userData)
+	}
+
+	// Assert: Lookups are served from the database
+	if !storage.HasIP("2.2.2.2") {
+		t.Error("Expected 2.2.2.2 to be tracked")
+	}
+	got := storage.GetUsersForIP("1.1.1.1")
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"user1@test.com", "user2@test.com"}) {
+		t.Errorf("Expected 1.1.1.1 to belong to both users, but got %v", got)
+	}
+	if entries := storage.GetEntriesInNetwork("1.1.1.9", 24, 64); len(entries) != 2 {
+		t.Errorf("Expected 2 records in 1.1.1.0/24, but got %v", entries)
+	}
+	if got := storage.GetIPsForUser("user1@test.com"); !slices.Equal(got, []string{"2.2.2.2", "1.1.1.1"}) {
+		t.Errorf("Expected user1@test.com to have IPs ['2.2.2.2', '1.1.1.1'], but got %v", got)
+	}
+
+	// Action: A known IP is seen again
+	fakeClock.Advance(time.Minute)
+	storage.AddUserIP("user2@test.com", "1.1.1.1")
+
+	// Assert: It waits for the writer in memory, and is dropped from memory
+	// once written
+	if _, cached := storage.userData["user2@test.com"]; !cached {
+		t.Error("Expected user2@test.com to stay in memory until written")
+	}
+	if err := storage.Persist(false); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+	users, _ = readBoltDB(t, dbPath)
+	if lastSeen := users["user2@test.com"].IPs[0].LastSeen; lastSeen != 1060 {
+		t.Errorf("Expected user2@test.com's last_seen to be 1060, but got %d", lastSeen)
+	}
+	if len(storage.userData) != 0 {
+		t.Errorf("Expected no users in memory, but got %v", storage.userData)
+	}
+
+	// Action: user1 is removed
+	if !storage.RemoveUser("user1@test.com") {
+		t.Fatal("Expected user1@test.com to be removed")
+	}
+
+	// Assert: The removal was written at once
+	users, index = readBoltDB(t, dbPath)
+	if _, exists := users["user1@test.com"]; exists {
+		t.Errorf("Expected user1@test.com's record to be deleted, but got %v", users)
+	}
+	if want := []string{"1.1.1.1 user2@test.com"}; !slices.Equal(index, want) {
+		t.Errorf("Expected IP index %v, but got %v", want, index)
+	}
+	if storage.HasIP("2.2.2.2") {
+		t.Error("Expected 2.2.2.2 to no longer be tracked")
+	}
+}
+
+// TestBoltApplyForgetsRemovals verifies that once a removal is older than
+// removal_retention, its record is deleted from the database.
+func TestBoltApplyForgetsRemovals(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "user_ips.db")
+	storage, fakeClock := newUncachedStorage(t, "bolt_forget_removals", dbPath)
+	storage.AddUserIP("user1@test.com", "1.1.1.1")
+	storage.RemoveUser("user1@test.com")
+
+	backend := storage.backend.(*boltBackend)
+	removals, err := backend.removals()
+	if err != nil {
+		t.Fatalf("Failed to read removals: %v", err)
+	}
+	if _, exists := removals["user1@test.com"]; !exists {
+		t.Fatalf("Expected the removal of user1@test.com to be saved, but got %v", removals)
+	}
+
+	// Action: The removal outlives the retention, and the store is written
+	fakeClock.Advance(2 * time.Hour)
+	if err := storage.Persist(false); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: The removal's record is gone
+	removals, err = backend.removals()
+	if err != nil {
+		t.Fatalf("Failed to read removals: %v", err)
+	}
+	if len(removals) != 0 {
+		t.Errorf("Expected no removals left, but got %v", removals)
+	}
+}
+
+// TestBoltRebuildsIndex verifies that opening a database without an IP index
+// builds one from the user records.
+func TestBoltRebuildsIndex(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "user_ips.db")
+
+	// Setup: A database with user records but no IP index
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to create bolt database: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucket(boltUsers)
+		if err != nil {
+			return err
+		}
+		userData := UserData{IPs: []IPData{{IP: "2001:db8::1", FirstSeen: 1, LastSeen: 1}, {IP: "1.1.1.1", FirstSeen: 1, LastSeen: 1}}}
+		return putRecord(users, []byte("user1@test.com"), userData)
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to write user record: %v", err)
+	}
+
+	// Assert: The index holds both of the user's IPs
+	_, index := readBoltDB(t, dbPath)
+	if want := []string{"1.1.1.1 user1@test.com", "2001:db8::1 user1@test.com"}; !slices.Equal(index, want) {
+		t.Errorf("Expected IP index %v, but got %v", want, index)
+	}
+}
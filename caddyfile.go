@@ -3,6 +3,7 @@ package caddy_user_ip
 import (
 	"strconv"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -36,12 +37,92 @@ func (m *UserIpTracking) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	// Process the block
 	for d.NextBlock(0) {
 		switch d.Val() {
+		case "store":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Store = d.Val()
+
+		case "identity":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.Identity = append(m.Identity, args...)
+
+		case "backend":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Backend = d.Val()
+
 		case "persist_path":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
 			m.PersistPath = d.Val()
 
+		case "storage_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.StorageKey = d.Val()
+
+		case "backups":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			backups, err := strconv.Atoi(d.Val())
+			if err != nil || backups < 0 {
+				return d.Errf("invalid backups %q: must be a number of files", d.Val())
+			}
+			m.Backups = &backups
+
+		case "strict_load":
+			strict := true
+			if d.NextArg() {
+				switch d.Val() {
+				case "on":
+				case "off":
+					strict = false
+				default:
+					return d.Errf("invalid strict_load %q: must be on or off", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+			m.StrictLoad = &strict
+
+		case "cache":
+			cache := true
+			if d.NextArg() {
+				switch d.Val() {
+				case "on":
+				case "off":
+					cache = false
+				default:
+					return d.Errf("invalid cache %q: must be on or off", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+			m.Cache = &cache
+
+		case "encryption_key":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			m.EncryptionKeys = append(m.EncryptionKeys, EncryptionKey{ID: args[0], Key: args[1]})
+
+		case "import_json":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ImportJSON = d.Val()
+
 		case "max_ips_per_user":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -62,6 +143,109 @@ func (m *UserIpTracking) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return err
 			}
 
+		case "ip_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var err error
+			m.IPTTL, err = strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return err
+			}
+
+		case "persist_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid persist_interval %q: %v", d.Val(), err)
+			}
+			m.PersistInterval = caddy.Duration(interval)
+
+		case "flush_delay":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			delay, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid flush_delay %q: %v", d.Val(), err)
+			}
+			m.FlushDelay = caddy.Duration(delay)
+
+		case "new_ip_flush_delay":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			delay, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid new_ip_flush_delay %q: %v", d.Val(), err)
+			}
+			m.NewIPFlushDelay = caddy.Duration(delay)
+
+		case "sync_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid sync_interval %q: %v", d.Val(), err)
+			}
+			m.SyncInterval = caddy.Duration(interval)
+
+		case "sweep_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid sweep_interval %q: %v", d.Val(), err)
+			}
+			m.SweepInterval = caddy.Duration(interval)
+
+		case "removal_retention":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			retention, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid removal_retention %q: %v", d.Val(), err)
+			}
+			m.RemovalRetention = caddy.Duration(retention)
+
+		case "journal":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Journal = true
+
+		case "journal_max_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil || size <= 0 {
+				return d.Errf("invalid journal_max_size %q: must be a positive number of bytes", d.Val())
+			}
+			m.JournalMaxSize = size
+
+		case "journal_max_age":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			age, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid journal_max_age %q: %v", d.Val(), err)
+			}
+			m.JournalMaxAge = caddy.Duration(age)
+
+		case "trusted_proxies":
+			ranges, err := unmarshalTrustedProxies(d)
+			if err != nil {
+				return err
+			}
+			m.TrustedProxies = append(m.TrustedProxies, ranges...)
+
 		default:
 			return d.Errf("unknown subdirective %q", d.Val())
 		}
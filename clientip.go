@@ -0,0 +1,151 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// parseTrustedProxies converts a list of CIDR expressions (or bare IPs) into prefixes.
+func parseTrustedProxies(exprs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(exprs))
+	for _, expr := range exprs {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies entry %q: %v", expr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// unmarshalTrustedProxies reads the arguments of a trusted_proxies subdirective.
+// The special value private_ranges expands to all private IPv4 and IPv6 ranges.
+func unmarshalTrustedProxies(d *caddyfile.Dispenser) ([]string, error) {
+	var ranges []string
+	for d.NextArg() {
+		if d.Val() == "private_ranges" {
+			ranges = append(ranges, caddyhttp.PrivateRangesCIDR()...)
+			continue
+		}
+		ranges = append(ranges, d.Val())
+	}
+	if len(ranges) == 0 {
+		return nil, d.ArgErr()
+	}
+	return ranges, nil
+}
+
+// getClientIP determines the client IP address for the request, in the
+// canonical form produced by normalizeIP. It returns an empty string if no
+// valid address can be determined.
+//
+// When trustedProxies is empty, the client IP resolved by Caddy's server is
+// used. That value honours the server-level trusted_proxies option, so headers
+// are only considered when the direct peer is a trusted proxy.
+//
+// When trustedProxies is set, the X-Forwarded-For chain is only consulted if
+// the direct peer is one of those proxies. It is then walked right-to-left and
+// the first hop that is not a trusted proxy is returned. If the walk reaches a
+// hop that is not an IP address, the peer's address is returned instead, as
+// the hops beyond it cannot be trusted. X-Real-IP is used only when a trusted
+// peer sends no X-Forwarded-For header.
+func getClientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	peer := remoteIP(r)
+
+	if len(trustedProxies) == 0 {
+		if clientIP, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok {
+			if ip, ok := normalizeIP(clientIP); ok {
+				return ip
+			}
+		}
+		ip, _ := normalizeIP(peer)
+		return ip
+	}
+
+	peerAddr, ok := parseHeaderIP(peer)
+	if !ok {
+		return ""
+	}
+	if !isTrustedProxy(peerAddr, trustedProxies) {
+		// Untrusted peers cannot vouch for anyone else, so ignore their headers
+		return peerAddr.String()
+	}
+
+	if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+		clientIP := peerAddr
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseHeaderIP(hops[i])
+			if !ok {
+				// No trusted proxy appends junk, so the hops from here on
+				// may be forged by the client
+				return peerAddr.String()
+			}
+			clientIP = hop
+			if !isTrustedProxy(hop, trustedProxies) {
+				break
+			}
+		}
+		return clientIP.String()
+	}
+
+	if realIP, ok := parseHeaderIP(r.Header.Get("X-Real-IP")); ok {
+		return realIP.String()
+	}
+
+	return peerAddr.String()
+}
+
+// normalizeIP returns the canonical form of an IP address: IPv4-mapped IPv6
+// addresses are unmapped, IPv6 is lower-cased and compressed, and ports and
+// zone identifiers are stripped. It returns false for anything that is not an
+// IP address, such as "unknown".
+func normalizeIP(value string) (string, bool) {
+	addr, ok := parseHeaderIP(value)
+	if !ok {
+		return "", false
+	}
+	return addr.String(), true
+}
+
+// remoteIP returns the host portion of the request's RemoteAddr.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// If there's an error, just return the RemoteAddr as is
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// parseHeaderIP parses a single address taken from a forwarding header.
+// Ports and IPv6 zone identifiers added by some proxies are stripped.
+func parseHeaderIP(value string) (netip.Addr, bool) {
+	host := strings.TrimSpace(value)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	host, _, _ = strings.Cut(host, "%")
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// isTrustedProxy reports whether addr falls within one of the trusted ranges.
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	return slices.ContainsFunc(trustedProxies, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
@@ -1,11 +1,136 @@
 // package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
 package caddy_user_ip
 
+import (
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// defaultPersistInterval is how often the background loop saves the store when
+// no persist_interval is configured.
+const defaultPersistInterval = 5 * time.Minute
+
+// defaultFlushDelay bounds how long a timestamp-only change may stay unwritten
+// when no flush_delay is configured.
+const defaultFlushDelay = time.Minute
+
+// Names of the backends a store can persist its data to.
+const (
+	backendFile    = "file"
+	backendStorage = "storage"
+	backendBolt    = "bolt"
+)
+
+// defaultStorageSyncInterval is how often a store kept in Caddy's storage
+// merges in the changes of other instances when no sync_interval is configured.
+const defaultStorageSyncInterval = time.Minute
+
+// fileWatchInterval is how often a file backend that other instances write to
+// too, as set up with sync_interval, is checked for their changes, so that
+// they are merged in without waiting for the next sync.
+const fileWatchInterval = time.Second
+
+// defaultSweepInterval is how often a store with a TTL removes expired entries
+// when no sweep_interval is configured.
+const defaultSweepInterval = time.Minute
+
+// defaultRemovalRetention is how long a removal made through the admin API is
+// remembered when no removal_retention is configured.
+const defaultRemovalRetention = 30 * 24 * time.Hour
+
+// defaultJournalMaxSize and defaultJournalMaxAge are the size and age at which
+// the journal is compacted when no journal_max_size or journal_max_age is
+// configured.
+const (
+	defaultJournalMaxSize = 4 << 20
+	defaultJournalMaxAge  = time.Hour
+)
+
+// defaultBackups is how many previous versions of the file the file backend
+// keeps when no backups count is configured.
+const defaultBackups = 3
+
+// defaultIdentity is the identity expression used when none is configured.
+const defaultIdentity = "{http.request.header.X-Token-User-Email}"
+
 // Config holds the configuration for the UserIpTracking middleware.
 type Config struct {
+	// Store is the name of the store the tracked IPs are kept in. Handlers that
+	// name the same store share its data, and user_ip matchers refer to it by
+	// this name. Defaults to "default".
+	Store string `json:"store,omitempty"`
+
+	// Identity is an ordered list of Caddy placeholder expressions identifying the user,
+	// e.g. {http.request.header.Remote-User} or {http.auth.user.id}.
+	// The first expression that resolves to a non-empty value wins.
+	// Defaults to the X-Token-User-Email request header.
+	Identity []string `json:"identity,omitempty"`
+
+	// Backend is where the user->IP mapping is persisted: "file" (the default)
+	// keeps it in the JSON file at PersistPath, "storage" keeps it in Caddy's
+	// configured storage, so that instances sharing the storage share the data,
+	// and "bolt" keeps each user as a separate record in a bolt database at
+	// PersistPath, along with an index of the users of each IP, so that a
+	// write only rewrites the records it touches. The data is also kept in
+	// memory, where lookups are served, unless Cache is turned off.
+	Backend string `json:"backend,omitempty"`
+
 	// PersistPath is the file path where the user->IP mapping will be stored
+	// by the file and bolt backends
 	PersistPath string `json:"persist_path,omitempty"`
 
+	// Backups is how many previous versions of the file the file backend keeps,
+	// as PersistPath + ".1" (the newest) to PersistPath + ".<n>". Loading falls
+	// back to them if the file is corrupt. 0 keeps none. Defaults to 3.
+	Backups *int `json:"backups,omitempty"`
+
+	// StrictLoad makes corrupt data fail provisioning, instead of being moved
+	// aside (as PersistPath + ".corrupt-<timestamp>") in favor of its newest
+	// readable backup. The same goes for a corrupt journal, which is otherwise
+	// moved aside (as PersistPath + ".journal.corrupt-<timestamp>") once the
+	// entries before the corrupt one are replayed. Defaults to true for the
+	// storage backend, which keeps no backups, so that the shared data is not
+	// replaced by an empty state, and to false otherwise.
+	StrictLoad *bool `json:"strict_load,omitempty"`
+
+	// Cache keeps every record of the bolt backend in memory too, where
+	// lookups are served. Turned off, only the users with changes not written
+	// yet are kept in memory, and lookups read the database's IP index, so
+	// memory no longer grows with the number of users. It cannot be turned off
+	// with other backends, nor combined with SyncInterval. Defaults to true.
+	Cache *bool `json:"cache,omitempty"`
+
+	// EncryptionKeys are the keys the saved data is encrypted with, using
+	// AES-256-GCM, by the file and storage backends. The first key encrypts,
+	// while the others can only decrypt, so that keys can be rotated: data
+	// encrypted with a previous key is read, and encrypted with the new key
+	// when it is written back. Data saved in plaintext is read too, and
+	// encrypted when written back. It cannot be combined with Journal.
+	EncryptionKeys []EncryptionKey `json:"encryption_keys,omitempty"`
+
+	// ImportJSON is the path of a JSON file saved by the file backend, whose
+	// data is imported into the bolt database once. Later starts skip it.
+	ImportJSON string `json:"import_json,omitempty"`
+
+	// StorageKey is the key the storage backend keeps the data under.
+	// Defaults to "user_ip/<store>.json".
+	StorageKey string `json:"storage_key,omitempty"`
+
+	// Journal makes the file backend append each change to a journal next to
+	// PersistPath (PersistPath + ".journal") instead of rewriting the whole
+	// file, which is only rewritten when the journal is compacted. The journal
+	// is replayed on startup. It cannot be combined with SyncInterval.
+	Journal bool `json:"journal,omitempty"`
+
+	// JournalMaxSize is the size in bytes past which the journal is compacted.
+	// Defaults to 4 MiB.
+	JournalMaxSize int64 `json:"journal_max_size,omitempty"`
+
+	// JournalMaxAge is how old the oldest change in the journal may get before
+	// the journal is compacted. Defaults to 1 hour.
+	JournalMaxAge caddy.Duration `json:"journal_max_age,omitempty"`
+
 	// MaxIpsPerUser is the maximum number of recent distinct IPs to store for each user
 	MaxIpsPerUser uint64 `json:"max_ips_per_user,omitempty"`
 
@@ -13,4 +138,64 @@ type Config struct {
 	// After this period of inactivity, a user's data will be removed
 	// A value of 0 means no expiration
 	UserDataTTL uint64 `json:"user_data_ttl,omitempty"`
+
+	// IPTTL is the time-to-live for each of a user's IPs in seconds
+	// An IP not seen for this long is removed, even if the user is still
+	// active from other IPs
+	// A value of 0 means no expiration
+	IPTTL uint64 `json:"ip_ttl,omitempty"`
+
+	// PersistInterval is how often the background loop saves the full state to disk,
+	// including the latest last_seen timestamps. Defaults to 5 minutes.
+	PersistInterval caddy.Duration `json:"persist_interval,omitempty"`
+
+	// FlushDelay is the longest a timestamp-only change (a known IP seen again)
+	// may wait before it is written to disk. Changes arriving within this window
+	// are coalesced into a single write, so it is also the worst-case window of
+	// last_seen updates lost on a crash. Defaults to 1 minute.
+	FlushDelay caddy.Duration `json:"flush_delay,omitempty"`
+
+	// NewIPFlushDelay is the longest a new IP (or a removal) may wait before it
+	// is written to disk. Defaults to 0, meaning the writer flushes as soon as it can.
+	// The bolt backend writes them before AddUserIP or RemoveUser returns, so it
+	// only delays the retry of a write that failed.
+	NewIPFlushDelay caddy.Duration `json:"new_ip_flush_delay,omitempty"`
+
+	// SyncInterval is how often the data saved in the backend by other instances
+	// sharing it is merged into this one's, so a user seen by one instance is
+	// recognized by the others within this delay. 0 disables it. With the file
+	// backend, the file is also checked for changes every second, which are
+	// merged in at once. Defaults to 1 minute for the storage backend, and to
+	// 0 for the file backend.
+	SyncInterval caddy.Duration `json:"sync_interval,omitempty"`
+
+	// SweepInterval is how often users and IPs that outlived user_data_ttl or
+	// ip_ttl are removed, whether or not new IPs are seen. Expired entries
+	// never match, even before they are swept. Only used if a TTL is set.
+	// Defaults to 1 minute.
+	SweepInterval caddy.Duration `json:"sweep_interval,omitempty"`
+
+	// RemovalRetention is how long a removal made through the admin API is
+	// remembered, so that merging the data of an instance that has not seen it
+	// yet does not bring the removed IPs back. A user_data_ttl or ip_ttl that
+	// is shorter forgets it sooner, as the IPs it hides have expired by then.
+	// Defaults to 30 days.
+	RemovalRetention caddy.Duration `json:"removal_retention,omitempty"`
+
+	// TrustedProxies is a list of CIDR ranges whose forwarding headers are believed.
+	// If empty, the client IP determined by Caddy's server (and its own
+	// trusted_proxies option) is used.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+}
+
+// EncryptionKey is a key the saved data is encrypted with.
+type EncryptionKey struct {
+	// ID is recorded next to the data encrypted with the key, so that the key
+	// that decrypts it is known after keys are rotated.
+	ID string `json:"id"`
+
+	// Key is the base64 encoding of 32 random bytes. It may be a global
+	// placeholder such as {env.USER_IP_KEY} or {file./etc/caddy/user_ip.key},
+	// so that the key itself is not part of the config.
+	Key string `json:"key"`
 }
@@ -0,0 +1,285 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// cipherAES256GCM is the name of the cipher the saved data is encrypted with,
+// as recorded next to it.
+const cipherAES256GCM = "AES-256-GCM"
+
+// encryptionKeySize is the size in bytes of an AES-256 key.
+const encryptionKeySize = 32
+
+// errUndecryptable is wrapped by the errors returned for saved data that is
+// encrypted, but cannot be decrypted with the configured keys, if any. Unlike
+// corrupt data, it is never set aside or overwritten, as it is likely intact
+// and only read with the wrong keys.
+var errUndecryptable = errors.New("persisted data cannot be decrypted")
+
+// encryptionKey is a key the saved data is encrypted with, along with the ID
+// recorded next to the data, so that the key can be told apart from others
+// after keys are rotated.
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// newEncryptionKeys returns the configured keys, in order. The key values may
+// be global placeholders such as {env.*} or {file.*}, which are replaced here.
+func newEncryptionKeys(configured []EncryptionKey) ([]encryptionKey, error) {
+	repl := caddy.NewReplacer()
+	keys := make([]encryptionKey, 0, len(configured))
+	seen := make(map[string]bool, len(configured))
+	for _, k := range configured {
+		if k.ID == "" {
+			return nil, fmt.Errorf("encryption key without an id")
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("duplicate encryption key id %q", k.ID)
+		}
+		seen[k.ID] = true
+
+		encoded, err := repl.ReplaceOrErr(k.Key, true, true)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %v", k.ID, err)
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q is not valid base64: %v", k.ID, err)
+		}
+		if len(raw) != encryptionKeySize {
+			return nil, fmt.Errorf("encryption key %q is %d bytes long, but must be %d", k.ID, len(raw), encryptionKeySize)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %v", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %v", k.ID, err)
+		}
+		keys = append(keys, encryptionKey{id: k.ID, aead: aead})
+	}
+	return keys, nil
+}
+
+// sealedData is the saved form of encrypted data, whose plaintext is the JSON
+// document that would otherwise be saved.
+type sealedData struct {
+	// How the data was encrypted. Its presence tells encrypted data apart
+	// from plaintext.
+	Encryption *sealedHeader `json:"encryption"`
+
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// sealedHeader records how sealedData was encrypted. It is authenticated
+// along with the ciphertext, so it cannot be changed unnoticed.
+type sealedHeader struct {
+	Cipher string `json:"cipher"`
+	KeyID  string `json:"key_id"`
+}
+
+// additionalData returns the data authenticated along with the ciphertext.
+func (h sealedHeader) additionalData() []byte {
+	return []byte(h.Cipher + "\x00" + h.KeyID)
+}
+
+// encryptedBackend encrypts the state kept by another backend. The state is
+// encrypted with the first key, while the others can only decrypt, so that
+// state encrypted with a previous key can be read after keys are rotated.
+// State saved in plaintext, e.g. before encryption was configured, is read as
+// is.
+type encryptedBackend struct {
+	Backend
+
+	keys []encryptionKey
+}
+
+// Load implements Backend.
+func (b *encryptedBackend) Load(ctx context.Context) ([]byte, error) {
+	data, _, err := b.open(ctx)
+	return data, err
+}
+
+// open loads and decrypts the state. Returns true if it should be written back
+// to be encrypted with the current key, because it is in plaintext or was
+// encrypted with a previous key.
+func (b *encryptedBackend) open(ctx context.Context) ([]byte, bool, error) {
+	data, err := b.Backend.Load(ctx)
+	if err != nil || data == nil {
+		return data, false, err
+	}
+	var sealed sealedData
+	if err := json.Unmarshal(data, &sealed); err != nil || sealed.Encryption == nil {
+		// Not encrypted (or not even JSON, which decoding it later reports)
+		return data, true, nil
+	}
+	data, err = b.decrypt(sealed)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s: %v", errUndecryptable, b, err)
+	}
+	return data, sealed.Encryption.KeyID != b.keys[0].id, nil
+}
+
+// decrypt returns the plaintext of sealed. Data that does not decrypt is not
+// reported as corrupt, as the likelier cause is a wrong key, and setting the
+// data aside in favor of a backup encrypted with the same key would not help.
+func (b *encryptedBackend) decrypt(sealed sealedData) ([]byte, error) {
+	header := *sealed.Encryption
+	if header.Cipher != cipherAES256GCM {
+		return nil, fmt.Errorf("data is encrypted with unsupported cipher %q", header.Cipher)
+	}
+	for _, key := range b.keys {
+		if key.id != header.KeyID {
+			continue
+		}
+		if len(sealed.Nonce) != key.aead.NonceSize() {
+			return nil, fmt.Errorf("data encrypted with key %q has a nonce of %d bytes, but needs %d", key.id, len(sealed.Nonce), key.aead.NonceSize())
+		}
+		plaintext, err := key.aead.Open(nil, sealed.Nonce, sealed.Ciphertext, header.additionalData())
+		if err != nil {
+			return nil, fmt.Errorf("decrypting data with key %q failed, so the key is wrong or the data was altered: %v", key.id, err)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("data is encrypted with key %q, which is not configured", header.KeyID)
+}
+
+// seal returns data encrypted with the current key.
+func (b *encryptedBackend) seal(data []byte) ([]byte, error) {
+	key := b.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := sealedHeader{Cipher: cipherAES256GCM, KeyID: key.id}
+	return json.Marshal(sealedData{
+		Encryption: &header,
+		Nonce:      nonce,
+		Ciphertext: key.aead.Seal(nil, nonce, data, header.additionalData()),
+	})
+}
+
+// Save implements Backend.
+func (b *encryptedBackend) Save(ctx context.Context, data []byte) error {
+	sealed, err := b.seal(data)
+	if err != nil {
+		return fmt.Errorf("encrypting data for %s: %v", b, err)
+	}
+	return b.Backend.Save(ctx, sealed)
+}
+
+// Backup implements backupBackend. The copy is encrypted too.
+func (b *encryptedBackend) Backup(ctx context.Context, suffix string, data []byte) (bool, error) {
+	backupper, ok := b.Backend.(backupBackend)
+	if !ok {
+		return false, fmt.Errorf("%s does not keep backups", b)
+	}
+	sealed, err := b.seal(data)
+	if err != nil {
+		return false, fmt.Errorf("encrypting backup for %s: %v", b, err)
+	}
+	return backupper.Backup(ctx, suffix, sealed)
+}
+
+// Quarantine implements quarantineBackend. The state is moved aside as it is.
+func (b *encryptedBackend) Quarantine(ctx context.Context, suffix string) (string, error) {
+	quarantiner, ok := b.Backend.(quarantineBackend)
+	if !ok {
+		return "", fmt.Errorf("%s cannot move data aside", b)
+	}
+	return quarantiner.Quarantine(ctx, suffix)
+}
+
+// Backups implements quarantineBackend. The backups are decrypted with the
+// same keys.
+func (b *encryptedBackend) Backups(ctx context.Context) []Backend {
+	quarantiner, ok := b.Backend.(quarantineBackend)
+	if !ok {
+		return nil
+	}
+	var backups []Backend
+	for _, backup := range quarantiner.Backups(ctx) {
+		backups = append(backups, &encryptedBackend{Backend: backup, keys: b.keys})
+	}
+	return backups
+}
+
+// Watch implements Watcher, if the backend it encrypts does.
+func (b *encryptedBackend) Watch(ctx context.Context, changed func()) error {
+	watcher, ok := b.Backend.(Watcher)
+	if !ok {
+		return nil
+	}
+	return watcher.Watch(ctx, changed)
+}
+
+// Lock implements lockingBackend, if the backend it encrypts does.
+func (b *encryptedBackend) Lock(ctx context.Context) error {
+	if locker, ok := b.Backend.(lockingBackend); ok {
+		return locker.Lock(ctx)
+	}
+	return nil
+}
+
+// Unlock implements lockingBackend, if the backend it encrypts does.
+func (b *encryptedBackend) Unlock(ctx context.Context) error {
+	if locker, ok := b.Backend.(lockingBackend); ok {
+		return locker.Unlock(ctx)
+	}
+	return nil
+}
+
+// sealCopies encrypts the copies kept next to the state, such as its backups,
+// that are in plaintext or encrypted with a previous key, so that none of the
+// data stays readable without the current key once the state is encrypted
+// with it. Copies the keys cannot decrypt are left as they are.
+func (b *encryptedBackend) sealCopies(ctx context.Context) error {
+	copier, ok := b.Backend.(copyBackend)
+	if !ok {
+		return nil
+	}
+	copies, err := copier.Copies(ctx)
+	if err != nil {
+		return fmt.Errorf("listing copies of %s: %v", b, err)
+	}
+	for _, c := range copies {
+		sealed := &encryptedBackend{Backend: c, keys: b.keys}
+		data, reseal, err := sealed.open(ctx)
+		if errors.Is(err, errUndecryptable) || (err == nil && !reseal) {
+			continue
+		}
+		if err == nil {
+			// A copy that is not even JSON, e.g. set aside as corrupt, is
+			// encrypted as it is
+			err = sealed.Save(ctx, data)
+		}
+		if err != nil {
+			return fmt.Errorf("encrypting copy %s: %v", c, err)
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ Backend           = (*encryptedBackend)(nil)
+	_ backupBackend     = (*encryptedBackend)(nil)
+	_ quarantineBackend = (*encryptedBackend)(nil)
+	_ Watcher           = (*encryptedBackend)(nil)
+	_ lockingBackend    = (*encryptedBackend)(nil)
+)
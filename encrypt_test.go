@@ -0,0 +1,257 @@
+package caddy_user_ip
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEncryptionKey returns a base64 encoded key made of the byte b.
+func testEncryptionKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, encryptionKeySize))
+}
+
+// readSealedKeyID returns the ID of the key the file at path is encrypted
+// with, failing the test if it is not encrypted.
+func readSealedKeyID(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read persisted data: %v", err)
+	}
+	var sealed sealedData
+	if err := json.Unmarshal(data, &sealed); err != nil || sealed.Encryption == nil {
+		t.Fatalf("Expected encrypted data, but got %s", data)
+	}
+	if strings.Contains(string(data), "@test.com") {
+		t.Errorf("Expected no plaintext users in encrypted data, but got %s", data)
+	}
+	return sealed.Encryption.KeyID
+}
+
+// TestEncryption verifies that a plaintext file is encrypted when it is
+// written back, that it is only readable by its owner, and that after a key
+// is rotated the data is read with the previous key and encrypted again with
+// the new one.
+func TestEncryption(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	keyPath := filepath.Join(filepath.Dir(persistPath), "user_ip.key")
+	setupFakeClock(t)
+	t.Setenv("USER_IP_TEST_KEY", testEncryptionKey(1))
+	if err := os.WriteFile(keyPath, []byte(testEncryptionKey(2)+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	// Setup: A plaintext file, saved before encryption was configured
+	plaintext := `{"version": 1, "user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "last_seen": 1}]}}}`
+	if err := os.WriteFile(persistPath, []byte(plaintext), 0644); err != nil {
+		t.Fatalf("Failed to write plaintext data: %v", err)
+	}
+
+	// Action: Start with a key from the environment
+	createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                encryption_key k1 {env.USER_IP_TEST_KEY}
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `)
+	storage := getLiveStorage(t, defaultStoreName)
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: The plaintext was loaded, and written back encrypted for the owner only
+	if got := storage.GetIPsForUser("user1@test.com"); !slices.Equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("Expected user1@test.com to have IPs ['1.1.1.1'], but got %v", got)
+	}
+	if keyID := readSealedKeyID(t, persistPath); keyID != "k1" {
+		t.Errorf("Expected the data to be encrypted with key k1, but got %q", keyID)
+	}
+	info, err := os.Stat(persistPath)
+	if err != nil {
+		t.Fatalf("Failed to stat persisted data: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected file mode 0600, but got %v", info.Mode().Perm())
+	}
+
+	// Action: Start over with a new key from a file, keeping the previous one
+	createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                encryption_key k2 {file.`+keyPath+`}
+                encryption_key k1 {env.USER_IP_TEST_KEY}
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `)
+	storage = getLiveStorage(t, defaultStoreName)
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: The data was read with the previous key and encrypted with the new one
+	if got := storage.GetIPsForUser("user1@test.com"); !slices.Equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("Expected user1@test.com to have IPs ['1.1.1.1'], but got %v", got)
+	}
+	if keyID := readSealedKeyID(t, persistPath); keyID != "k2" {
+		t.Errorf("Expected the data to be encrypted with key k2, but got %q", keyID)
+	}
+}
+
+// TestEncryptionWrongKey verifies that encrypted data that the configured keys
+// cannot decrypt fails the load, rather than being set aside as corrupt.
+func TestEncryptionWrongKey(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	newBackend := func(key string) Backend {
+		t.Helper()
+		keys, err := newEncryptionKeys([]EncryptionKey{{ID: "k1", Key: key}})
+		if err != nil {
+			t.Fatalf("Failed to set up encryption key: %v", err)
+		}
+		return &encryptedBackend{Backend: &fileBackend{path: persistPath, backups: defaultBackups}, keys: keys}
+	}
+
+	// Setup: Data encrypted with one key
+	data := []byte(`{"version": 1, "user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "last_seen": 1}]}}}`)
+	if err := newBackend(testEncryptionKey(1)).Save(context.Background(), data); err != nil {
+		t.Fatalf("Failed to save encrypted data: %v", err)
+	}
+	sealed, err := os.ReadFile(persistPath)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted data: %v", err)
+	}
+
+	for name, backend := range map[string]Backend{
+		"wrong key": newBackend(testEncryptionKey(2)),
+		"no key":    &fileBackend{path: persistPath, backups: defaultBackups},
+	} {
+		storage := newUserIPStorage("wrong_key")
+		storage.storageConfig = storageConfig{backend: backend, maxIPsPerUser: 5}
+
+		// Action: Load the data
+		err := storage.Load()
+
+		// Assert: Loading fails, and the data is left alone
+		if !errors.Is(err, errUndecryptable) || errors.Is(err, errCorrupt) {
+			t.Errorf("%s: Expected loading to fail with errUndecryptable, but got: %v", name, err)
+		}
+		if data, _ := os.ReadFile(persistPath); !bytes.Equal(data, sealed) {
+			t.Errorf("%s: Expected the encrypted data to be left alone, but got %s", name, data)
+		}
+		if quarantined, _ := filepath.Glob(persistPath + ".corrupt-*"); len(quarantined) != 0 {
+			t.Errorf("%s: Expected nothing to be set aside, but got %v", name, quarantined)
+		}
+
+		// Action: Save changes over the data, as a store already running when
+		// the data was encrypted with another key would
+		storage.AddUserIP("user2@test.com", "2.2.2.2")
+		err = storage.Persist(true)
+
+		// Assert: Saving fails too, and the data is still left alone
+		if !errors.Is(err, errUndecryptable) {
+			t.Errorf("%s: Expected saving to fail with errUndecryptable, but got: %v", name, err)
+		}
+		if data, _ := os.ReadFile(persistPath); !bytes.Equal(data, sealed) {
+			t.Errorf("%s: Expected the encrypted data not to be overwritten, but got %s", name, data)
+		}
+	}
+}
+
+// TestEncryptionSealsCopies verifies that once plaintext data is written back
+// encrypted, its backups and other copies left in plaintext or encrypted with
+// a previous key are encrypted with the current key too, and that files that
+// are not copies, or that the keys cannot decrypt, are left alone.
+func TestEncryptionSealsCopies(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	ctx := context.Background()
+	keys, err := newEncryptionKeys([]EncryptionKey{{ID: "k2", Key: testEncryptionKey(2)}, {ID: "k1", Key: testEncryptionKey(1)}})
+	if err != nil {
+		t.Fatalf("Failed to set up encryption keys: %v", err)
+	}
+	otherKeys, err := newEncryptionKeys([]EncryptionKey{{ID: "k3", Key: testEncryptionKey(3)}})
+	if err != nil {
+		t.Fatalf("Failed to set up encryption key: %v", err)
+	}
+
+	// Setup: Plaintext data and copies of it, one encrypted with a previous key
+	// and one with a key that is not configured
+	plaintext := `{"version": 1, "user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "last_seen": 1}]}}}`
+	copies := map[string]string{
+		persistPath:                     plaintext,
+		persistPath + ".1":              plaintext,
+		persistPath + ".5":              plaintext,
+		persistPath + ".corrupt-1":      `{"user_data": {"user1@test.com": {"ips"`,
+		persistPath + ".v0.bak":         `{"user_data": {"user1@test.com": {"ips": ["1.1.1.1"]}}}`,
+		persistPath + ".journal":        `{"op": "add", "user": "user1@test.com", "ip": "1.1.1.1"}`,
+		persistPath + ".other@test.com": plaintext,
+	}
+	for path, content := range copies {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	previous := &encryptedBackend{Backend: &fileBackend{path: persistPath + ".2"}, keys: keys[1:]}
+	if err := previous.Save(ctx, []byte(plaintext)); err != nil {
+		t.Fatalf("Failed to save copy encrypted with previous key: %v", err)
+	}
+	unknown := &encryptedBackend{Backend: &fileBackend{path: persistPath + ".3"}, keys: otherKeys}
+	if err := unknown.Save(ctx, []byte(plaintext)); err != nil {
+		t.Fatalf("Failed to save copy encrypted with unknown key: %v", err)
+	}
+	unknownSealed, _ := os.ReadFile(persistPath + ".3")
+
+	backend := &encryptedBackend{Backend: &fileBackend{path: persistPath, backups: 1}, keys: keys}
+	storage := newUserIPStorage("seal_copies")
+	storage.storageConfig = storageConfig{backend: backend, maxIPsPerUser: 5}
+
+	// Action: Load the data and write it back encrypted
+	if err := storage.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := storage.Persist(true); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: Every copy is encrypted with the current key, and holds what it
+	// did before
+	copies[persistPath+".2"] = plaintext
+	for _, suffix := range []string{"", ".1", ".2", ".5", ".corrupt-1", ".v0.bak"} {
+		path := persistPath + suffix
+		if keyID := readSealedKeyID(t, path); keyID != "k2" {
+			t.Errorf("Expected %s to be encrypted with key k2, but got %q", path, keyID)
+		}
+		if suffix == "" || suffix == ".1" {
+			// Rewritten and rotated by the save
+			continue
+		}
+		data, err := (&encryptedBackend{Backend: &fileBackend{path: path}, keys: keys}).Load(ctx)
+		if err != nil || string(data) != copies[path] {
+			t.Errorf("Expected %s to decrypt to what it held, but got %q and %v", path, data, err)
+		}
+	}
+
+	// Assert: The rest is left alone
+	for _, suffix := range []string{".journal", ".other@test.com"} {
+		if data, _ := os.ReadFile(persistPath + suffix); string(data) != copies[persistPath+suffix] {
+			t.Errorf("Expected %s to be left alone, but got %s", persistPath+suffix, data)
+		}
+	}
+	if data, _ := os.ReadFile(persistPath + ".3"); !bytes.Equal(data, unknownSealed) {
+		t.Errorf("Expected the copy encrypted with an unknown key to be left alone, but got %s", data)
+	}
+}
@@ -0,0 +1,91 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import "container/heap"
+
+// expiryHeap is a min-heap of users keyed by the time their next entry
+// expires, used to find the expired users without scanning every user. Each
+// user is in the heap at most once; its deadline is updated in place.
+type expiryHeap struct {
+	items expiryItems
+
+	// Items by user, for updating and removing them
+	byUser map[string]*expiryItem
+}
+
+// expiryItem is a user's entry in an expiryHeap.
+type expiryItem struct {
+	user string
+
+	// Unix timestamp (seconds) after which one of the user's entries expires
+	at int64
+
+	// Position of the item in expiryHeap.items
+	index int
+}
+
+// Len returns the number of users in the heap.
+func (h *expiryHeap) Len() int {
+	return len(h.items)
+}
+
+// Set sets the deadline of user, adding the user if it is not in the heap yet.
+func (h *expiryHeap) Set(user string, at int64) {
+	if item, exists := h.byUser[user]; exists {
+		item.at = at
+		heap.Fix(&h.items, item.index)
+		return
+	}
+	if h.byUser == nil {
+		h.byUser = make(map[string]*expiryItem)
+	}
+	item := &expiryItem{user: user, at: at}
+	h.byUser[user] = item
+	heap.Push(&h.items, item)
+}
+
+// Remove removes user from the heap. It is a no-op if user is not in it.
+func (h *expiryHeap) Remove(user string) {
+	item, exists := h.byUser[user]
+	if !exists {
+		return
+	}
+	heap.Remove(&h.items, item.index)
+	delete(h.byUser, user)
+}
+
+// Peek returns the user with the earliest deadline, and the deadline. ok is
+// false if the heap is empty.
+func (h *expiryHeap) Peek() (user string, at int64, ok bool) {
+	if len(h.items) == 0 {
+		return "", 0, false
+	}
+	return h.items[0].user, h.items[0].at, true
+}
+
+// expiryItems implements heap.Interface for expiryHeap.
+type expiryItems []*expiryItem
+
+func (items expiryItems) Len() int { return len(items) }
+
+func (items expiryItems) Less(i, j int) bool { return items[i].at < items[j].at }
+
+func (items expiryItems) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+	items[i].index = i
+	items[j].index = j
+}
+
+func (items *expiryItems) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*items)
+	*items = append(*items, item)
+}
+
+func (items *expiryItems) Pop() any {
+	old := *items
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*items = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,389 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"hash/maphash"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jonboulle/clockwork"
+	"go.uber.org/zap"
+)
+
+// viewShards is the number of shards the records of an ipView are split into,
+// by IP and by user.
+const viewShards = 64
+
+// viewSeed seeds the hash that picks the shard of an IP or user.
+var viewSeed = maphash.MakeSeed()
+
+// ipView is the read side of a store: every tracked IP with each user's record
+// of it, and a prefix index over them, or with the store's cache turned off
+// those of the users in memory, on top of the records in the bolt database.
+// Writers keep it in step with userData while holding the store's lock, so lookups never wait for a writer that
+// holds the store's lock for longer, e.g. while it saves the data. The records
+// are split into shards, each with a lock of its own that is only held for a
+// single update, so that a lookup only waits for an update to the same shard,
+// and lookups on many cores do not contend for one lock. The zero value is
+// ready to use.
+type ipView struct {
+	// Each user's record of a tracked IP, sharded by IP
+	ips [viewShards]ipShard
+
+	// Most recent last_seen of each user, for user_data_ttl, sharded by user.
+	// The users in it are those in the view.
+	lastSeen [viewShards]lastSeenShard
+
+	// Taken to add users to the view or drop them from it, and held by
+	// lookups that read the database too, so that the users whose records
+	// the view holds stay the same while they read both
+	membersMu sync.RWMutex
+
+	// Guards index
+	indexMu sync.RWMutex
+
+	// Radix trie of the addresses in ips, for matching by network
+	index prefixTrie
+
+	// The store's clock, TTLs and database, for leaving out expired records
+	// and reading those not in memory
+	settings atomic.Pointer[viewSettings]
+}
+
+// ipShard holds the records of the IPs whose hash falls into it.
+type ipShard struct {
+	mu sync.RWMutex
+
+	// Each user's record of a tracked IP, by IP and user
+	ips map[string]map[string]IPData
+}
+
+// lastSeenShard holds the last_seen of the users whose hash falls into it.
+type lastSeenShard struct {
+	mu sync.RWMutex
+
+	// Most recent last_seen, by user
+	lastSeen map[string]int64
+}
+
+// viewSettings are the clock and TTLs in seconds used to leave out expired
+// records, and where to read the records not in memory.
+type viewSettings struct {
+	clock       clockwork.Clock
+	userDataTTL uint64
+	ipTTL       uint64
+
+	// Bolt database holding the records of the users not in the view, if the
+	// store's cache is turned off
+	database *boltBackend
+
+	// Logger for failures to read database
+	logger *zap.Logger
+}
+
+// shardOf returns the shard of key, an IP or a user.
+func shardOf(key string) int {
+	return int(maphash.String(viewSeed, key) % viewShards)
+}
+
+// configure sets the clock and TTLs used to leave out expired records, and
+// the database holding the records of the users not in the view, if any.
+func (v *ipView) configure(clock clockwork.Clock, userDataTTL, ipTTL uint64, database *boltBackend, logger *zap.Logger) {
+	v.settings.Store(&viewSettings{
+		clock:       clock,
+		userDataTTL: userDataTTL,
+		ipTTL:       ipTTL,
+		database:    database,
+		logger:      logger,
+	})
+}
+
+// put records ipData as user's record of its IP, replacing any previous one.
+func (v *ipView) put(user string, ipData IPData) {
+	shard := &v.ips[shardOf(ipData.IP)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	users, exists := shard.ips[ipData.IP]
+	if !exists {
+		if shard.ips == nil {
+			shard.ips = make(map[string]map[string]IPData)
+		}
+		users = make(map[string]IPData)
+		shard.ips[ipData.IP] = users
+		if addr, err := netip.ParseAddr(ipData.IP); err == nil {
+			v.indexMu.Lock()
+			v.index.Insert(addr)
+			v.indexMu.Unlock()
+		}
+	}
+	users[user] = ipData
+}
+
+// remove drops user's record of ip, and ip itself once no user has a record of
+// it. Returns true if ip was dropped.
+func (v *ipView) remove(ip, user string) bool {
+	shard := &v.ips[shardOf(ip)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	users, exists := shard.ips[ip]
+	if !exists {
+		return false
+	}
+	delete(users, user)
+	if len(users) > 0 {
+		return false
+	}
+	delete(shard.ips, ip)
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		v.indexMu.Lock()
+		v.index.Remove(addr)
+		v.indexMu.Unlock()
+	}
+	return true
+}
+
+// setLastSeen records the most recent last_seen of user, adding user to the
+// view if need be. A user whose records are all dropped stays in the view
+// with a last_seen of 0, hiding those in the database, until forgotten.
+func (v *ipView) setLastSeen(user string, lastSeen int64) {
+	shard := &v.lastSeen[shardOf(user)]
+	shard.mu.Lock()
+	if _, exists := shard.lastSeen[user]; exists {
+		shard.lastSeen[user] = lastSeen
+		shard.mu.Unlock()
+		return
+	}
+	shard.mu.Unlock()
+
+	v.membersMu.Lock()
+	defer v.membersMu.Unlock()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.lastSeen == nil {
+		shard.lastSeen = make(map[string]int64)
+	}
+	shard.lastSeen[user] = lastSeen
+}
+
+// forget drops user from the view, once they are no longer tracked or their
+// records in the database are up to date.
+func (v *ipView) forget(user string) {
+	v.membersMu.Lock()
+	defer v.membersMu.Unlock()
+	shard := &v.lastSeen[shardOf(user)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	delete(shard.lastSeen, user)
+}
+
+// replace replaces the records and index with those of other, which must not
+// be used afterwards. Each shard is replaced in turn, so a lookup meanwhile
+// may see a mix of both.
+func (v *ipView) replace(other *ipView) {
+	v.membersMu.Lock()
+	defer v.membersMu.Unlock()
+	for i := range v.ips {
+		v.ips[i].mu.Lock()
+		v.ips[i].ips = other.ips[i].ips
+		v.ips[i].mu.Unlock()
+	}
+	for i := range v.lastSeen {
+		v.lastSeen[i].mu.Lock()
+		v.lastSeen[i].lastSeen = other.lastSeen[i].lastSeen
+		v.lastSeen[i].mu.Unlock()
+	}
+	v.indexMu.Lock()
+	v.index = other.index
+	v.indexMu.Unlock()
+}
+
+// len returns the number of tracked IPs.
+func (v *ipView) len() int {
+	n := 0
+	for i := range v.ips {
+		v.ips[i].mu.RLock()
+		n += len(v.ips[i].ips)
+		v.ips[i].mu.RUnlock()
+	}
+	return n
+}
+
+// has reports whether any user has an unexpired record of ip.
+func (v *ipView) has(ip string) bool {
+	found := false
+	find := func(string, IPData) bool {
+		found = true
+		return false
+	}
+	defer v.holdMembers()()
+	now := v.now()
+	v.visit(ip, now, find)
+	if !found {
+		v.visitDatabase(addressPrefix(ip), now, find)
+	}
+	return found
+}
+
+// users returns the users with an unexpired record of ip.
+func (v *ipView) users(ip string) []string {
+	users := make([]string, 0)
+	collect := func(user string, _ IPData) bool {
+		users = append(users, user)
+		return true
+	}
+	defer v.holdMembers()()
+	now := v.now()
+	v.visit(ip, now, collect)
+	v.visitDatabase(addressPrefix(ip), now, collect)
+	return users
+}
+
+// entriesInNetwork returns the unexpired records of the tracked IPs within the
+// network of addr masked to prefixBits, or of addr itself if prefixBits is 0.
+func (v *ipView) entriesInNetwork(addr netip.Addr, prefixBits int) []UserIPEntry {
+	defer v.holdMembers()()
+	var entries []UserIPEntry
+	now := v.now()
+	add := func(user string, ipData IPData) bool {
+		entries = append(entries, UserIPEntry{User: user, IPData: ipData})
+		return true
+	}
+
+	if prefixBits <= 0 {
+		v.visit(addr.String(), now, add)
+		v.visitDatabase(netip.PrefixFrom(addr, addr.BitLen()), now, add)
+		return entries
+	}
+	network, err := addr.Prefix(prefixBits)
+	if err != nil {
+		return nil
+	}
+	// The records are looked up once the index is released, so that updates
+	// to it do not wait for them
+	var tracked []netip.Addr
+	v.indexMu.RLock()
+	v.index.WalkWithin(network, func(addr netip.Addr) bool {
+		tracked = append(tracked, addr)
+		return true
+	})
+	v.indexMu.RUnlock()
+	for _, addr := range tracked {
+		v.visit(addr.String(), now, add)
+	}
+	v.visitDatabase(network, now, add)
+	return entries
+}
+
+// visit calls fn with each unexpired record of ip at now, as returned by
+// v.now, until fn returns false.
+func (v *ipView) visit(ip string, now int64, fn func(user string, ipData IPData) bool) {
+	shard := &v.ips[shardOf(ip)]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	for user, ipData := range shard.ips[ip] {
+		if !v.expired(user, ipData, now) && !fn(user, ipData) {
+			return
+		}
+	}
+}
+
+// visitDatabase calls fn with each unexpired record of the IPs within network
+// in the database, if the store's cache is turned off, at now, as returned by
+// v.now, until fn returns false. The records of the users in the view are left
+// out, as the view holds changes to them not written to the database yet.
+func (v *ipView) visitDatabase(network netip.Prefix, now int64, fn func(user string, ipData IPData) bool) {
+	settings := v.settings.Load()
+	if settings == nil || settings.database == nil || !network.IsValid() {
+		return
+	}
+	err := settings.database.lookup(network, now != 0 && settings.userDataTTL > 0, func(user string, ipData IPData, userData *UserData) bool {
+		if v.knows(user) {
+			return true
+		}
+		if now != 0 && (settings.ipExpired(ipData, now) ||
+			(settings.userDataTTL > 0 && (userData == nil || settings.userExpired(userData.lastSeen(), now)))) {
+			return true
+		}
+		return fn(user, ipData)
+	})
+	if err != nil {
+		settings.logger.Error("Failed to look up IPs in the database",
+			zap.Stringer("backend", settings.database),
+			zap.Stringer("network", network),
+			zap.Error(err))
+	}
+}
+
+// holdMembers keeps the users in the view the same, if the store's cache is
+// turned off and lookups read the database too, and returns the function that
+// releases them.
+func (v *ipView) holdMembers() func() {
+	if settings := v.settings.Load(); settings == nil || settings.database == nil {
+		return func() {}
+	}
+	v.membersMu.RLock()
+	return v.membersMu.RUnlock
+}
+
+// knows reports whether user is in the view.
+func (v *ipView) knows(user string) bool {
+	shard := &v.lastSeen[shardOf(user)]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	_, exists := shard.lastSeen[user]
+	return exists
+}
+
+// addressPrefix returns the prefix holding just ip, which is invalid if ip is
+// not an address.
+func addressPrefix(ip string) netip.Prefix {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// now returns the current Unix time if a TTL is set, and 0 otherwise.
+func (v *ipView) now() int64 {
+	settings := v.settings.Load()
+	if settings == nil || settings.clock == nil || (settings.userDataTTL == 0 && settings.ipTTL == 0) {
+		return 0
+	}
+	return settings.clock.Now().Unix()
+}
+
+// expired reports whether user's record ipData has expired at now, as
+// returned by v.now.
+func (v *ipView) expired(user string, ipData IPData, now int64) bool {
+	if now == 0 {
+		return false
+	}
+	settings := v.settings.Load()
+	if settings.ipExpired(ipData, now) {
+		return true
+	}
+	if settings.userDataTTL == 0 {
+		return false
+	}
+	shard := &v.lastSeen[shardOf(user)]
+	shard.mu.RLock()
+	lastSeen := shard.lastSeen[user]
+	shard.mu.RUnlock()
+	return settings.userExpired(lastSeen, now)
+}
+
+// ipExpired reports whether ipData has outlived ipTTL at now.
+func (s *viewSettings) ipExpired(ipData IPData, now int64) bool {
+	return s.ipTTL > 0 && ipData.LastSeen < now-int64(s.ipTTL)
+}
+
+// userExpired reports whether a user last seen at lastSeen has outlived
+// userDataTTL at now.
+func (s *viewSettings) userExpired(lastSeen, now int64) bool {
+	return s.userDataTTL > 0 && lastSeen < now-int64(s.userDataTTL)
+}
@@ -0,0 +1,250 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Operations recorded in a journal. Each applies to the IP named in the
+// entry, or to all of the user's IPs if it names none.
+const (
+	// An IP was added to the user
+	journalAdd = "add"
+
+	// A known IP of the user was seen again
+	journalBump = "bump"
+
+	// An IP was dropped to stay within max_ips_per_user
+	journalEvict = "evict"
+
+	// An IP, or the whole user, outlived its TTL
+	journalExpire = "expire"
+
+	// An IP, or the whole user, was removed through the admin API
+	journalRemove = "remove"
+
+	// A removal outlived removal_retention and was forgotten. The entry's
+	// last_seen is the time the removal was made.
+	journalForget = "forget"
+)
+
+// journalEntry is one change recorded in a journal.
+type journalEntry struct {
+	// One of the journal operations
+	Op string `json:"op"`
+
+	// The user the change applies to
+	User string `json:"user"`
+
+	// The IP the change applies to, and for additions and bumps its record
+	IPData
+
+	// Unix timestamp when the change was made (seconds)
+	At int64 `json:"at"`
+}
+
+// journal is an append-only log of the changes made to a store since its last
+// full save (the snapshot), so that a change costs a single appended line
+// rather than rewriting the whole snapshot. It is kept next to the snapshot
+// and replayed on top of it on startup; once it grows past a size or age
+// threshold, the store is saved in full and the journal is started afresh.
+//
+// Replaying an entry never undoes a newer change, so a journal that survives
+// the save it was compacted into, e.g. after a crash, is harmless.
+type journal struct {
+	// Path of the journal file
+	path string
+
+	// Size of the journal file in bytes
+	size int64
+
+	// Unix timestamp of the oldest entry in the journal, 0 if it is empty
+	oldest int64
+}
+
+// String returns the path of the journal.
+func (j *journal) String() string {
+	return j.path
+}
+
+// journalPath returns the path of j, or "" if j is nil.
+func journalPath(j *journal) string {
+	if j == nil {
+		return ""
+	}
+	return j.path
+}
+
+// Append appends entries to the journal and syncs it to disk.
+func (j *journal) Append(entries []journalEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if j.size == 0 {
+		// The file may have just been created
+		if err := syncDir(filepath.Dir(j.path)); err != nil {
+			return err
+		}
+		j.oldest = entries[0].At
+	}
+	j.size += int64(buf.Len())
+	return nil
+}
+
+// Replay calls apply for every entry of the journal, in order, and returns how
+// many there were. A torn final entry, left by a crash in the middle of an
+// append, is cut off the file and reported by returning true. Only the part
+// after the last newline can be torn, as every append ends with one; an entry
+// before it that cannot be decoded means the journal is corrupt, and an error
+// wrapping errCorrupt is returned, leaving the file as it is.
+func (j *journal) Replay(apply func(journalEntry)) (int, bool, error) {
+	j.size, j.oldest = 0, 0
+	data, err := os.ReadFile(j.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	count, valid := 0, 0
+	for valid < len(data) {
+		end := bytes.IndexByte(data[valid:], '\n')
+		if end == -1 {
+			break
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(data[valid:valid+end], &entry); err != nil {
+			return count, false, fmt.Errorf("%w: %s entry %d: %v", errCorrupt, j.path, count+1, err)
+		}
+		apply(entry)
+		if count == 0 {
+			j.oldest = entry.At
+		}
+		count++
+		valid += end + 1
+	}
+
+	j.size = int64(valid)
+	if valid == len(data) {
+		return count, false, nil
+	}
+	// Drop the torn entry, so that new entries are not appended to it
+	if err := os.Truncate(j.path, int64(valid)); err != nil {
+		return count, true, err
+	}
+	return count, true, nil
+}
+
+// Quarantine moves the journal aside, to its path with suffix, and returns
+// that path. The journal starts afresh.
+func (j *journal) Quarantine(suffix string) (string, error) {
+	quarantined := j.path + suffix
+	if err := os.Rename(j.path, quarantined); err != nil {
+		return "", err
+	}
+	j.size, j.oldest = 0, 0
+	return quarantined, syncDir(filepath.Dir(j.path))
+}
+
+// Reset empties the journal, once everything in it has been saved in full.
+func (j *journal) Reset() error {
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	j.size, j.oldest = 0, 0
+	return nil
+}
+
+// Due returns true if the journal has grown to maxSize bytes, or holds an
+// entry made more than maxAge seconds before now, so it should be compacted.
+func (j *journal) Due(now, maxSize, maxAge int64) bool {
+	if j.size == 0 {
+		return false
+	}
+	return (maxSize > 0 && j.size >= maxSize) || (maxAge > 0 && now-j.oldest >= maxAge)
+}
+
+// apply applies a journal entry to the data it was recorded on top of.
+func (pd *persistData) apply(entry journalEntry) {
+	switch entry.Op {
+	case journalAdd, journalBump:
+		if pd.UserData == nil {
+			pd.UserData = make(map[string]*UserData)
+		}
+		userData, exists := pd.UserData[entry.User]
+		if !exists {
+			userData = &UserData{}
+			pd.UserData[entry.User] = userData
+		}
+		// Merged rather than replaced, so that a stale entry cannot move a
+		// last_seen back
+		userData.IPs = mergeIPLists([]IPData{entry.IPData}, userData.IPs)
+
+	case journalEvict, journalExpire, journalRemove:
+		if userData, exists := pd.UserData[entry.User]; exists {
+			// IPs seen again after the change are kept
+			userData.IPs = slices.DeleteFunc(userData.IPs, func(ipData IPData) bool {
+				return (entry.IP == "" || ipData.IP == entry.IP) && ipData.LastSeen <= entry.At
+			})
+			if len(userData.IPs) == 0 {
+				delete(pd.UserData, entry.User)
+			}
+		}
+		if entry.Op == journalRemove {
+			ip := entry.IP
+			if ip == "" {
+				ip = removedAll
+			}
+			if pd.Removed == nil {
+				pd.Removed = make(map[string]map[string]int64)
+			}
+			if pd.Removed[entry.User] == nil {
+				pd.Removed[entry.User] = make(map[string]int64)
+			}
+			pd.Removed[entry.User][ip] = max(pd.Removed[entry.User][ip], entry.At)
+		}
+
+	case journalForget:
+		ip := entry.IP
+		if ip == "" {
+			ip = removedAll
+		}
+		// A removal made again since is kept
+		if at, exists := pd.Removed[entry.User][ip]; exists && at <= entry.LastSeen {
+			delete(pd.Removed[entry.User], ip)
+			if len(pd.Removed[entry.User]) == 0 {
+				delete(pd.Removed, entry.User)
+			}
+		}
+	}
+}
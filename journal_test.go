@@ -0,0 +1,396 @@
+package caddy_user_ip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// readJournal reads and decodes every entry of the journal at path.
+func readJournal(t *testing.T, path string) []journalEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Failed to read journal %s: %v", path, err)
+	}
+	var entries []journalEntry
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("Failed to decode journal entry %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// journalOps returns the operation and user of each entry, e.g. "add user1@test.com".
+func journalOps(entries []journalEntry) []string {
+	ops := make([]string, len(entries))
+	for i, entry := range entries {
+		ops[i] = entry.Op + " " + entry.User
+	}
+	return ops
+}
+
+// TestJournal verifies that with journal enabled, changes are appended to the
+// journal rather than rewriting the persisted file, and are replayed on startup.
+func TestJournal(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	journalPath := persistPath + ".journal"
+	fakeClock := setupFakeClock(t)
+
+	caddyfile := `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path ` + persistPath + `
+                max_ips_per_user 5
+                journal
+            }
+            respond "OK"
+        }
+    }
+  `
+	tester := createTester(t, caddyfile)
+	track := func(email, ip string) {
+		t.Helper()
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", email, ip, "")
+		_ = resp.Body.Close()
+	}
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Action: user1 is seen, then seen again, then user2 shows up
+	track("user1@test.com", "1.1.1.1")
+	waitForPersist(t, storage, 2*time.Second)
+	fakeClock.Advance(10 * time.Second)
+	track("user1@test.com", "1.1.1.1")
+	fakeClock.Advance(time.Minute)
+	waitForPersist(t, storage, 2*time.Second)
+	track("user2@test.com", "2.2.2.2")
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: Each change is one journal entry, and the full file is not written
+	want := []string{"add user1@test.com", "bump user1@test.com", "add user2@test.com"}
+	if got := journalOps(readJournal(t, journalPath)); !slices.Equal(got, want) {
+		t.Errorf("Expected journal entries %v, but got %v", want, got)
+	}
+	if _, err := os.Stat(persistPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected %s not to be written while the journal is small, but got: %v", persistPath, err)
+	}
+
+	// Action: Start over
+	createTester(t, caddyfile)
+	storage = getLiveStorage(t, defaultStoreName)
+
+	// Assert: Replaying the journal restored both users, with the bumped last_seen
+	userData, exists := storage.GetUser("user1@test.com")
+	if !exists || len(userData.IPs) != 1 || userData.IPs[0].LastSeen != 10 {
+		t.Errorf("Expected user1@test.com with IP 1.1.1.1 last seen at 10, but got %+v", userData)
+	}
+	if got := storage.GetIPsForUser("user2@test.com"); !slices.Equal(got, []string{"2.2.2.2"}) {
+		t.Errorf("Expected user2@test.com to have IPs ['2.2.2.2'], but got %v", got)
+	}
+}
+
+// TestJournalCompaction verifies that once the journal passes journal_max_size,
+// the next change saves the data in full and empties the journal.
+func TestJournalCompaction(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	journalPath := persistPath + ".journal"
+	setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                journal
+                journal_max_size 1
+            }
+            respond "OK"
+        }
+    }
+  `)
+	track := func(email, ip string) {
+		t.Helper()
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", email, ip, "")
+		_ = resp.Body.Close()
+	}
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Setup: The first change already makes the journal exceed its limit
+	track("user1@test.com", "1.1.1.1")
+	waitForPersist(t, storage, 2*time.Second)
+	if got := journalOps(readJournal(t, journalPath)); !slices.Equal(got, []string{"add user1@test.com"}) {
+		t.Fatalf("Expected the first change in the journal, but got %v", got)
+	}
+
+	// Action: Another change
+	track("user2@test.com", "2.2.2.2")
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: The data was saved in full and the journal emptied
+	persistedData := readPersistedData(t, persistPath)
+	if len(persistedData) != 2 || persistedData["user1@test.com"] == nil || persistedData["user2@test.com"] == nil {
+		t.Errorf("Expected both users to be persisted by the compaction, but got %v", persistedData)
+	}
+	if entries := readJournal(t, journalPath); len(entries) != 0 {
+		t.Errorf("Expected the journal to be empty after compaction, but got %v", journalOps(entries))
+	}
+
+	// Action: A change after the compaction
+	track("user3@test.com", "3.3.3.3")
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: It starts a new journal
+	if got := journalOps(readJournal(t, journalPath)); !slices.Equal(got, []string{"add user3@test.com"}) {
+		t.Errorf("Expected the new change in the journal, but got %v", got)
+	}
+}
+
+// TestJournalTornRecord verifies that a journal whose last entry was cut short
+// by a crash is replayed up to that entry, and that the torn entry is dropped
+// so later entries are appended after the intact ones.
+func TestJournalTornRecord(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	journalPath := persistPath + ".journal"
+	fakeClock := setupFakeClock(t)
+
+	// Setup: A snapshot with user1, and a journal that adds user2, removes
+	// user1, and was interrupted while adding user3
+	snapshot := `{"user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "first_seen": 1, "last_seen": 1}]}}}`
+	if err := os.WriteFile(persistPath, []byte(snapshot), 0644); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	intact := `{"op":"add","user":"user2@test.com","ip":"2.2.2.2","first_seen":2,"last_seen":2,"at":2}
+{"op":"remove","user":"user1@test.com","ip":"","last_seen":0,"at":3}
+`
+	torn := `{"op":"add","user":"user3@test.com","ip":"3.3`
+	if err := os.WriteFile(journalPath, []byte(intact+torn), 0644); err != nil {
+		t.Fatalf("Failed to write journal: %v", err)
+	}
+	fakeClock.Advance(5 * time.Second)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                journal
+            }
+            respond "OK"
+        }
+    }
+  `)
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Assert: The intact entries were applied, and the torn one dropped
+	users := storage.GetUsers()
+	if len(users) != 1 || users["user2@test.com"] == nil {
+		t.Errorf("Expected only user2@test.com after replaying the journal, but got %v", users)
+	}
+	if info, err := os.Stat(journalPath); err != nil || info.Size() != int64(len(intact)) {
+		t.Errorf("Expected the journal to be cut to its %d intact bytes, but got %v (%v)", len(intact), info, err)
+	}
+
+	// Action: A new change
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user4@test.com", "4.4.4.4", "")
+	_ = resp.Body.Close()
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: It follows the intact entries
+	want := []string{"add user2@test.com", "remove user1@test.com", "add user4@test.com"}
+	if got := journalOps(readJournal(t, journalPath)); !slices.Equal(got, want) {
+		t.Errorf("Expected journal entries %v, but got %v", want, got)
+	}
+}
+
+// TestJournalCorruptEntry verifies that an entry that cannot be decoded in
+// the middle of the journal is not taken for a torn one: loading fails if
+// strict, and otherwise the journal is moved aside whole, after replaying the
+// entries before it.
+func TestJournalCorruptEntry(t *testing.T) {
+	// Setup: A journal that adds user1, holds a corrupt entry, and adds user2
+	journalData := `{"op":"add","user":"user1@test.com","ip":"1.1.1.1","first_seen":1,"last_seen":1,"at":1}
+{"op":"add","user":
+{"op":"add","user":"user2@test.com","ip":"2.2.2.2","first_seen":2,"last_seen":2,"at":2}
+`
+	for _, strict := range []bool{true, false} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			persistPath := createTempPersistFile(t)
+			journalPath := persistPath + ".journal"
+			if err := os.WriteFile(journalPath, []byte(journalData), 0644); err != nil {
+				t.Fatalf("Failed to write journal: %v", err)
+			}
+			storage, _ := newJournalStorage(t, "corrupt_journal", persistPath)
+			storage.strictLoad = strict
+
+			// Action: Load the store
+			err := storage.Load()
+
+			if strict {
+				// Assert: Loading failed, and the journal was left as it is
+				if !errors.Is(err, errCorrupt) {
+					t.Errorf("Expected loading to fail with errCorrupt, but got: %v", err)
+				}
+				if data, err := os.ReadFile(journalPath); err != nil || string(data) != journalData {
+					t.Errorf("Expected the journal to be left as it is, but got %q (%v)", data, err)
+				}
+				return
+			}
+
+			// Assert: The entry before the corrupt one was replayed, and the
+			// journal moved aside whole
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if users := storage.GetUsers(); len(users) != 1 || users["user1@test.com"] == nil {
+				t.Errorf("Expected only user1@test.com after replaying the journal, but got %v", users)
+			}
+			if _, err := os.Stat(journalPath); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected the journal to be moved aside, but got: %v", err)
+			}
+			quarantined, _ := filepath.Glob(journalPath + ".corrupt-*")
+			if len(quarantined) != 1 {
+				t.Fatalf("Expected the journal to be moved to one .corrupt-* file, but got %v", quarantined)
+			}
+			if data, err := os.ReadFile(quarantined[0]); err != nil || string(data) != journalData {
+				t.Errorf("Expected the moved journal to be complete, but got %q (%v)", data, err)
+			}
+		})
+	}
+}
+
+// newJournalStorage returns a store that journals its changes next to
+// persistPath, with a fake clock, without a running writer.
+func newJournalStorage(t *testing.T, name, persistPath string) (*UserIPStorage, *clockwork.FakeClock) {
+	t.Helper()
+	fakeClock := clockwork.NewFakeClockAt(time.Unix(1000, 0))
+	storage := newUserIPStorage(name)
+	storage.clock = fakeClock
+	storage.storageConfig = storageConfig{
+		backend:        &fileBackend{path: persistPath},
+		maxIPsPerUser:  5,
+		journal:        &journal{path: persistPath + ".journal"},
+		journalMaxSize: defaultJournalMaxSize,
+		journalMaxAge:  defaultJournalMaxAge,
+	}
+	return storage, fakeClock
+}
+
+// TestJournalCoalescesBumps verifies that repeated bumps of an IP only leave
+// the latest one pending, unless another change to the user came in between.
+func TestJournalCoalescesBumps(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	storage, fakeClock := newJournalStorage(t, "coalesce_bumps", persistPath)
+
+	// Action: An IP is seen many times, then another IP, then the first again
+	storage.AddUserIP("user1@test.com", "1.1.1.1")
+	for range 100 {
+		fakeClock.Advance(time.Second)
+		storage.AddUserIP("user1@test.com", "1.1.1.1")
+	}
+	storage.AddUserIP("user1@test.com", "2.2.2.2")
+	fakeClock.Advance(time.Second)
+	storage.AddUserIP("user1@test.com", "1.1.1.1")
+	if err := storage.Persist(false); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: One bump stands for the first 100, keeping the latest last_seen
+	entries := readJournal(t, persistPath+".journal")
+	want := []string{"add user1@test.com", "bump user1@test.com", "add user1@test.com", "bump user1@test.com"}
+	if got := journalOps(entries); !slices.Equal(got, want) {
+		t.Fatalf("Expected journal entries %v, but got %v", want, got)
+	}
+	if entries[1].LastSeen != 1100 || entries[3].LastSeen != 1101 {
+		t.Errorf("Expected the bumps to be last seen at 1100 and 1101, but got %d and %d", entries[1].LastSeen, entries[3].LastSeen)
+	}
+}
+
+// TestJournalPendingIsBounded verifies that once too many changes are
+// pending, they are dropped in favor of saving the data in full.
+func TestJournalPendingIsBounded(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	storage, _ := newJournalStorage(t, "bounded_pending", persistPath)
+
+	// Action: More distinct changes than can be pending
+	for i := range maxPending + 1 {
+		storage.AddUserIP(fmt.Sprintf("user%d@test.com", i), "1.1.1.1")
+	}
+
+	// Assert: None are pending
+	storage.mu.RLock()
+	pending, fullSave := len(storage.pending), storage.fullSave
+	storage.mu.RUnlock()
+	if pending != 0 || !fullSave {
+		t.Fatalf("Expected no pending changes and a full save, but got %d pending and fullSave=%v", pending, fullSave)
+	}
+
+	// Action: Write
+	if err := storage.Persist(false); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: Every user is saved in full, and the journal is empty
+	if users := readPersistedData(t, persistPath); len(users) != maxPending+1 {
+		t.Errorf("Expected %d users to be saved, but got %d", maxPending+1, len(users))
+	}
+	if entries := readJournal(t, persistPath+".journal"); len(entries) != 0 {
+		t.Errorf("Expected an empty journal, but got %d entries", len(entries))
+	}
+}
+
+// TestJournalRewriteAfterLoad verifies that data migrated on load is saved in
+// full, even if a change is journaled before the next write.
+func TestJournalRewriteAfterLoad(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	legacyData := `{"user_data": {"user1@test.com": {"ips": ["1.1.1.1"], "last_seen": 100}}}`
+	if err := os.WriteFile(persistPath, []byte(legacyData), 0644); err != nil {
+		t.Fatalf("Failed to write legacy data: %v", err)
+	}
+	storage, _ := newJournalStorage(t, "rewrite_after_load", persistPath)
+	if err := storage.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	// Action: A change comes in before the migrated data is written back
+	storage.AddUserIP("user2@test.com", "2.2.2.2")
+	if err := storage.Persist(false); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: The file was rewritten in the current format, holding both users
+	data, err := os.ReadFile(persistPath)
+	if err != nil {
+		t.Fatalf("Failed to read persisted data: %v", err)
+	}
+	var pd persistData
+	if err := json.Unmarshal(data, &pd); err != nil || pd.Version != persistVersion {
+		t.Fatalf("Expected the data to be rewritten with version %d, but got %s", persistVersion, data)
+	}
+	if len(pd.UserData) != 2 {
+		t.Errorf("Expected both users to be saved, but got %v", pd.UserData)
+	}
+	if entries := readJournal(t, persistPath+".journal"); len(entries) != 0 {
+		t.Errorf("Expected an empty journal, but got %d entries", len(entries))
+	}
+}
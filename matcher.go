@@ -2,7 +2,14 @@
 package caddy_user_ip
 
 import (
+	"fmt"
 	"net/http"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -16,10 +23,41 @@ import (
 // UserIPMatcher is a request matcher that matches requests based on whether
 // the client IP address is in the list of tracked user IPs.
 type UserIPMatcher struct {
+	// Name labels this matcher's hits and misses in metrics. Defaults to "user_ip".
+	Name string `json:"name,omitempty"`
+
+	// Users restricts the match to IPs of these users. Each entry is an exact
+	// identity (compared case-insensitively), a glob where * matches any run of
+	// characters (e.g. *@corp.example.com), or a regular expression prefixed
+	// with ~ that must match the whole identity. If empty, any tracked user's
+	// IP matches.
+	Users []string `json:"users,omitempty"`
+
+	// Store is the name of the store to match against, as configured on the
+	// user_ip_tracking handler. Defaults to "default".
+	Store string `json:"store,omitempty"`
+
+	// PrefixV4 is the length of the network an IPv4 client must share with a
+	// tracked address to match, e.g. 24. 0 (the default) requires an exact match.
+	PrefixV4 int `json:"prefix_v4,omitempty"`
+
+	// PrefixV6 is the length of the network an IPv6 client must share with a
+	// tracked address to match, e.g. 64. 0 (the default) requires an exact match.
+	PrefixV6 int `json:"prefix_v6,omitempty"`
+
+	// TrustedProxies is a list of CIDR ranges whose forwarding headers are believed.
+	// It should normally mirror the trusted_proxies of the user_ip_tracking handler.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
 	// Logger for the matcher
 	logger *zap.Logger
-}
 
+	// Parsed form of TrustedProxies
+	trustedProxies []netip.Prefix
+
+	// Compiled form of Users
+	userPatterns []*regexp.Regexp
+}
 
 // CaddyModule returns the Caddy module information.
 func (UserIPMatcher) CaddyModule() caddy.ModuleInfo {
@@ -32,25 +70,113 @@ func (UserIPMatcher) CaddyModule() caddy.ModuleInfo {
 // Provision sets up the matcher.
 func (m *UserIPMatcher) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger(m)
+
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
+	}
+	if m.Name == "" {
+		m.Name = "user_ip"
+	}
+
+	trustedProxies, err := parseTrustedProxies(m.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	m.trustedProxies = trustedProxies
+
+	if m.PrefixV4 < 0 || m.PrefixV4 > 32 {
+		return fmt.Errorf("prefix_v4 must be between 0 and 32, got %d", m.PrefixV4)
+	}
+	if m.PrefixV6 < 0 || m.PrefixV6 > 128 {
+		return fmt.Errorf("prefix_v6 must be between 0 and 128, got %d", m.PrefixV6)
+	}
+
+	userPatterns, err := compileUserPatterns(m.Users)
+	if err != nil {
+		return err
+	}
+	m.userPatterns = userPatterns
 	return nil
 }
 
-// The CEL matcher is expression is user_ip('anything not used'), because I
-// believe that you need to accept some kind of argument. Maybe I should look
-// into CEL variables?
+// compileUserPatterns compiles the entries of Users into anchored regular
+// expressions.
+func compileUserPatterns(users []string) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(users))
+	for _, user := range users {
+		var expr string
+		if re, ok := strings.CutPrefix(user, "~"); ok {
+			expr = "^(?:" + re + ")$"
+		} else {
+			expr = "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(user), `\*`, ".*") + "$"
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user pattern %q: %v", user, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// matchesUser reports whether user matches any of the configured patterns.
+func (m UserIPMatcher) matchesUser(user string) bool {
+	for _, pattern := range m.userPatterns {
+		if pattern.MatchString(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyAnyUser is the user_ip() CEL argument that, like an empty one, matches
+// any tracked user. The argument was once ignored, and configs passed it.
+const legacyAnyUser = "any"
+
+// CELLibrary produces the user_ip() CEL function. Its first argument is a user
+// pattern with the same syntax as the entries of Users, e.g.
+// user_ip('alice@example.com') or user_ip('*@corp.example.com'); use
+// user_ip('*') to match any tracked user. An optional second argument names
+// the store to match against, e.g. user_ip('*', 'admins').
 func (m UserIPMatcher) CELLibrary(ctx caddy.Context) (cel.Library, error) {
 	return caddyhttp.CELMatcherImpl(
 		// name of the macro, this is the function name that users see when writing expressions.
 		"user_ip",
 		// name of the function that the macro will be rewritten to call.
 		"request_has_user_ip",
-		// internal data type of the MatchPath value.
-		[]*cel.Type{cel.StringType},
-		// function to convert a constant list of strings to a MatchPath instance.
+		// internal data type of the arguments: the user pattern and the store.
+		[]*cel.Type{cel.ListType(cel.StringType)},
+		// function to convert the arguments to a UserIPMatcher instance.
 		func(data ref.Val) (caddyhttp.RequestMatcherWithError, error) {
+			native, err := data.ConvertToNative(reflect.TypeOf([]string{}))
+			if err != nil {
+				return nil, fmt.Errorf("user_ip arguments must be strings: %v", err)
+			}
+			args := native.([]string)
+			if len(args) > 2 {
+				return nil, fmt.Errorf("user_ip takes a user pattern and optionally a store, got %d arguments", len(args))
+			}
+
 			m := UserIPMatcher{}
-			err := m.Provision(ctx)
-			return m, err
+			if len(args) > 1 {
+				m.Store = args[1]
+			}
+			pattern := ""
+			if len(args) > 0 {
+				pattern = args[0]
+			}
+			legacy := pattern == "" || pattern == legacyAnyUser
+			if !legacy {
+				m.Users = []string{pattern}
+			}
+			if err := m.Provision(ctx); err != nil {
+				return nil, err
+			}
+			if legacy {
+				m.logger.Warn("user_ip() with an empty or 'any' argument matches any tracked user; this is deprecated, use user_ip('*') instead",
+					zap.String("argument", pattern))
+			}
+			return m, nil
 		},
 	)
 }
@@ -61,49 +187,136 @@ func (m UserIPMatcher) Match(r *http.Request) bool {
 	return match
 }
 
-// MatchWithError returns true if the request's client IP address is in the list of tracked user IPs.
+// MatchWithError returns true if the request's client IP address is in the list of tracked user IPs,
+// and, if Users is set, belongs to one of those users.
 func (m UserIPMatcher) MatchWithError(r *http.Request) (bool, error) {
 	// Extract the client IP address
-	clientIP := getClientIP(r)
-
-	// Get the singleton storage instance
-	storage := getStorage()
-
-	// Check if the IP is in the storage
-	hasIP := storage.HasIP(clientIP)
+	clientIP := getClientIP(r, m.trustedProxies)
+	if clientIP == "" {
+		m.logger.Debug("No valid client IP found, not matching", zap.String("remote_addr", r.RemoteAddr))
+		return false, nil
+	}
 
-	// Dump the contents of the storage for debugging
-	storage.mu.RLock()
-	var users []string
-	for user := range storage.userData {
-		users = append(users, user)
+	// Get the named storage instance. The matcher does not keep the store
+	// alive; if no loaded config tracks into it, nothing can match.
+	storage := lookupStorage(m.storeName())
+	if storage == nil {
+		m.logger.Debug("No live store to match against",
+			zap.String("store", m.storeName()),
+			zap.String("ip", clientIP))
+		setPlaceholders(r, nil)
+		m.recordMatch(false)
+		return false, nil
 	}
-	var ips []string
-	for ip := range storage.ipToUsers {
-		ips = append(ips, ip)
+
+	// Look up the IP (or, with prefix_v4/prefix_v6, its network) in the
+	// storage, keeping only the requested users if any
+	entries := storage.GetEntriesInNetwork(clientIP, m.PrefixV4, m.PrefixV6)
+	if len(m.userPatterns) > 0 {
+		entries = slices.DeleteFunc(entries, func(entry UserIPEntry) bool {
+			return !m.matchesUser(entry.User)
+		})
 	}
-	storage.mu.RUnlock()
+	hasIP := len(entries) > 0
+	setPlaceholders(r, entries)
+	m.recordMatch(hasIP)
 
-	m.logger.Debug("Matching client IP against known user IPs",
-		zap.String("ip", clientIP),
-		zap.Bool("match", hasIP),
-		zap.Strings("known_users", users),
-		zap.Strings("known_ips", ips))
+	if m.logger.Core().Enabled(zap.DebugLevel) {
+		users := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			users = append(users, entry.User)
+		}
+		m.logger.Debug("Matching client IP against known user IPs",
+			zap.String("ip", clientIP),
+			zap.Bool("match", hasIP),
+			zap.Strings("matched_users", users),
+			zap.Strings("user_patterns", m.Users),
+			zap.Int("prefix_v4", m.PrefixV4),
+			zap.Int("prefix_v6", m.PrefixV6))
+	}
 
 	return hasIP, nil
 }
 
+// recordMatch counts a hit or miss of this matcher.
+func (m UserIPMatcher) recordMatch(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	metrics.matches.WithLabelValues(m.storeName(), m.Name, result).Inc()
+}
+
+// storeName returns the name of the store this matcher checks.
+func (m UserIPMatcher) storeName() string {
+	if m.Store == "" {
+		return defaultStoreName
+	}
+	return m.Store
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 func (m *UserIPMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
-		// No arguments needed for this matcher
-		if d.NextArg() {
-			return d.ArgErr()
+		for d.NextArg() {
+			switch d.Val() {
+			case "store":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Store = d.Val()
+
+			default:
+				m.Users = append(m.Users, d.Val())
+			}
 		}
 
-		// No block support
-		if d.NextBlock(0) {
-			return d.Err("user_ip matcher does not support blocks")
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "store":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Store = d.Val()
+
+			case "name":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Name = d.Val()
+
+			case "users":
+				users := d.RemainingArgs()
+				if len(users) == 0 {
+					return d.ArgErr()
+				}
+				m.Users = append(m.Users, users...)
+
+			case "prefix_v4", "prefix_v6":
+				subdirective := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				prefixBits, err := strconv.Atoi(strings.TrimPrefix(d.Val(), "/"))
+				if err != nil {
+					return d.Errf("invalid %s %q: %v", subdirective, d.Val(), err)
+				}
+				if subdirective == "prefix_v4" {
+					m.PrefixV4 = prefixBits
+				} else {
+					m.PrefixV6 = prefixBits
+				}
+
+			case "trusted_proxies":
+				ranges, err := unmarshalTrustedProxies(d)
+				if err != nil {
+					return err
+				}
+				m.TrustedProxies = append(m.TrustedProxies, ranges...)
+
+			default:
+				return d.Errf("unknown subdirective %q", d.Val())
+			}
 		}
 	}
 	return nil
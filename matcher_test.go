@@ -1,10 +1,19 @@
 package caddy_user_ip
 
 import (
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"os" // Import the os package
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 )
 
 // TestMatchKnownIP configures Caddy with both user_ip_tracking and http.matchers.user_ip.
@@ -132,7 +141,7 @@ func TestNoMatchUnknownIP(t *testing.T) {
 
 // TestNoMatchWithoutTracker configures Caddy with only the http.matchers.user_ip matcher
 // (no user_ip_tracking). It sends a request and asserts that the matcher does not match
-// because globalStorage will be nil.
+// because no store is live.
 func TestNoMatchWithoutTracker(t *testing.T) {
 	// No need to create a persist file or fake clock as the tracker is not used.
 
@@ -147,7 +156,7 @@ func TestNoMatchWithoutTracker(t *testing.T) {
 	`)
 
 	// Action: Send a request with a user email and IP, targeting the /matched route.
-	// The user_ip_tracking module is NOT present, so globalStorage will be nil,
+	// The user_ip_tracking module is NOT present, so there is no live store,
 	// and the user_ip matcher should not match.
 	req, err := http.NewRequest("GET", "http://localhost:9080/", nil)
 	if err != nil {
@@ -200,6 +209,14 @@ func TestMatchDifferentIPSources(t *testing.T) {
 				respond @user_ip "Matched" 200
 				respond "Unmatched" 404
 			}
+
+			route /untrusted {
+				@user_ip user_ip {
+					trusted_proxies 192.0.2.0/24
+				}
+				respond @user_ip "Matched" 200
+				respond "Unmatched" 404
+			}
 		}
 	`)
 
@@ -273,6 +290,28 @@ func TestMatchDifferentIPSources(t *testing.T) {
 	// We don't need to check the response for req3 directly as sendTestRequest does it.
 	// The assertion is implicitly done by sendTestRequest expecting a 200 status code
 	// if the matcher works correctly with RemoteAddr.
+
+	// Scenario 4: Spoofed X-Forwarded-For prefix
+	// The client claims to be the known IP, but the trusted proxy saw it as 9.9.9.9.
+	resp4 := sendTestRequest(t, tester, "GET", "http://localhost:9080/matched", userEmail, knownIP+", 9.9.9.9", "")
+	defer func() {
+		// Ignoring error in test cleanup
+		_ = resp4.Body.Close()
+	}()
+	if resp4.StatusCode != 404 {
+		t.Errorf("Scenario 4 (spoofed X-Forwarded-For): Expected status code 404, but got %d", resp4.StatusCode)
+	}
+
+	// Scenario 5: Headers from an untrusted peer
+	// The matcher does not trust the loopback peer, so the known IP in the headers is ignored.
+	resp5 := sendTestRequest(t, tester, "GET", "http://localhost:9080/untrusted", userEmail, knownIP, knownIP)
+	defer func() {
+		// Ignoring error in test cleanup
+		_ = resp5.Body.Close()
+	}()
+	if resp5.StatusCode != 404 {
+		t.Errorf("Scenario 5 (untrusted peer): Expected status code 404, but got %d", resp5.StatusCode)
+	}
 }
 
 // TestCELMatchKnownIP configures Caddy with both user_ip_tracking and a route that uses
@@ -401,3 +440,304 @@ localhost:9080 {
 		t.Errorf("Expected status code 404 for an unknown IP with CEL matcher, but got %d", resp.StatusCode)
 	}
 }
+
+// TestMatchPrefix configures the matcher with prefix_v4 and prefix_v6 and asserts that
+// clients in the same network as a tracked address match, while clients outside it,
+// or on a route without the prefix options, do not.
+func TestMatchPrefix(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t) // Inject fake clock
+
+	tester := createTester(t, `
+		localhost:9080 {
+			route / {
+				user_ip_tracking {
+					persist_path `+persistPath+`
+					max_ips_per_user 5
+				}
+				respond "Tracked"
+			}
+
+			route /network {
+				@user_net user_ip {
+					prefix_v4 24
+					prefix_v6 /64
+				}
+				respond @user_net "Matched" 200
+				respond "Unmatched" 404
+			}
+
+			route /exact {
+				@user_ip user_ip
+				respond @user_ip "Matched" 200
+				respond "Unmatched" 404
+			}
+		}
+	`)
+
+	// Action: Track one IPv4 and one IPv6 address for the user
+	for _, ip := range []string{"203.0.113.10", "2001:db8:1:2::10"} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "test@example.com", ip, "")
+		_ = resp.Body.Close()
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		ip    string
+		match bool
+	}{
+		{"same IPv4 network", "/network", "203.0.113.77", true},
+		{"other IPv4 network", "/network", "203.0.114.10", false},
+		{"same IPv6 network", "/network", "2001:db8:1:2:abcd::1", true},
+		{"other IPv6 network", "/network", "2001:db8:1:3::10", false},
+		{"tracked address", "/network", "203.0.113.10", true},
+		{"same IPv4 network without prefix_v4", "/exact", "203.0.113.77", false},
+		{"same IPv6 network without prefix_v6", "/exact", "2001:db8:1:2:abcd::1", false},
+	}
+	for _, tt := range tests {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080"+tt.path, "", tt.ip, "")
+		_ = resp.Body.Close()
+
+		want := http.StatusNotFound
+		if tt.match {
+			want = http.StatusOK
+		}
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected status code %d for IP %s on %s, but got %d", tt.name, want, tt.ip, tt.path, resp.StatusCode)
+		}
+	}
+}
+
+// TestMatchSpecificUsers configures matchers restricted to a user, a list of users, a
+// glob, a regular expression and a CEL pattern, and asserts that each only matches IPs
+// belonging to the users it names.
+func TestMatchSpecificUsers(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t) // Inject fake clock
+
+	tester := createTester(t, `
+		localhost:9080 {
+			route / {
+				user_ip_tracking {
+					persist_path `+persistPath+`
+					max_ips_per_user 5
+				}
+				respond "Tracked"
+			}
+
+			route /alice {
+				@user user_ip alice@example.com
+				respond @user "Matched" 200
+				respond "Unmatched" 404
+			}
+
+			route /list {
+				@user user_ip alice@example.com carol@example.com
+				respond @user "Matched" 200
+				respond "Unmatched" 404
+			}
+
+			route /corp {
+				@user user_ip *@corp.example.com
+				respond @user "Matched" 200
+				respond "Unmatched" 404
+			}
+
+			route /regex {
+				@user user_ip {
+					users ~(alice|bob)@.*
+				}
+				respond @user "Matched" 200
+				respond "Unmatched" 404
+			}
+
+			route /cel {
+				@user `+"`user_ip('ALICE@example.com')`"+`
+				respond @user "Matched" 200
+				respond "Unmatched" 404
+			}
+
+			route /cel_any {
+				@user `+"`user_ip('*')`"+`
+				respond @user "Matched" 200
+				respond "Unmatched" 404
+			}
+		}
+	`)
+
+	// Action: Track one IP per user
+	users := map[string]string{
+		"alice@example.com":    "1.1.1.1",
+		"bob@corp.example.com": "2.2.2.2",
+		"carol@example.com":    "3.3.3.3",
+	}
+	for email, ip := range users {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", email, ip, "")
+		_ = resp.Body.Close()
+	}
+
+	tests := []struct {
+		path    string
+		matched []string // IPs expected to match; the others must not
+	}{
+		{"/alice", []string{"1.1.1.1"}},
+		{"/list", []string{"1.1.1.1", "3.3.3.3"}},
+		{"/corp", []string{"2.2.2.2"}},
+		{"/regex", []string{"1.1.1.1", "2.2.2.2"}},
+		{"/cel", []string{"1.1.1.1"}},
+		{"/cel_any", []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}},
+	}
+	for _, tt := range tests {
+		for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "9.9.9.9"} {
+			want := http.StatusNotFound
+			if slices.Contains(tt.matched, ip) {
+				want = http.StatusOK
+			}
+
+			resp := sendTestRequest(t, tester, "GET", "http://localhost:9080"+tt.path, "", ip, "")
+			_ = resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("Expected status code %d for IP %s on %s, but got %d", want, ip, tt.path, resp.StatusCode)
+			}
+		}
+	}
+}
+
+// TestPlaceholders asserts that the matcher and the tracker publish the users and
+// timestamps of the client IP as {user_ip.*} placeholders.
+func TestPlaceholders(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t) // Inject fake clock
+
+	tester := createTester(t, `
+		localhost:9080 {
+			route / {
+				user_ip_tracking {
+					persist_path `+persistPath+`
+					max_ips_per_user 5
+				}
+				respond "{user_ip.users}"
+			}
+
+			route /check {
+				@user_ip user_ip
+				respond @user_ip "{user_ip.known} {user_ip.users} {user_ip.user_count} {user_ip.first_seen} {user_ip.last_seen}" 200
+				respond "{user_ip.known} {user_ip.user_count}" 404
+			}
+		}
+	`)
+
+	readBody := func(resp *http.Response) string {
+		t.Helper()
+		defer func() {
+			// Ignoring error in test cleanup
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response body: %v", err)
+		}
+		return string(body)
+	}
+
+	// Action: Two users share an IP; alice is seen again later. The clock starts
+	// at 0, which would read as an unknown time.
+	fakeClock.Advance(10 * time.Second)
+	readBody(sendTestRequest(t, tester, "GET", "http://localhost:9080/", "alice@example.com", "1.1.1.1", ""))
+	fakeClock.Advance(100 * time.Second)
+	body := readBody(sendTestRequest(t, tester, "GET", "http://localhost:9080/", "bob@example.com", "1.1.1.1", ""))
+	if body != "alice@example.com,bob@example.com" {
+		t.Errorf("Expected the tracker to publish both users, but got %q", body)
+	}
+	fakeClock.Advance(50 * time.Second)
+	readBody(sendTestRequest(t, tester, "GET", "http://localhost:9080/", "alice@example.com", "1.1.1.1", ""))
+
+	// Assertion 1: A known IP publishes its users and timestamps
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", "1.1.1.1", "")
+	want := "true alice@example.com,bob@example.com 2 1970-01-01T00:00:10Z 1970-01-01T00:02:40Z"
+	if body := readBody(resp); resp.StatusCode != http.StatusOK || body != want {
+		t.Errorf("Expected status code 200 with body %q for a known IP, but got %d with %q", want, resp.StatusCode, body)
+	}
+
+	// Assertion 2: An unknown IP publishes that it is unknown
+	resp = sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", "9.9.9.9", "")
+	want = "false 0"
+	if body := readBody(resp); resp.StatusCode != http.StatusNotFound || body != want {
+		t.Errorf("Expected status code 404 with body %q for an unknown IP, but got %d with %q", want, resp.StatusCode, body)
+	}
+}
+
+// BenchmarkMatch measures matching a known IP against a large store from many
+// goroutines, once while the store is idle and once while other goroutines
+// keep adding IPs and saving the whole store, so that the two can be compared
+// side by side. Matching does not wait for the saves, and only briefly for
+// updates to the same shard of the store's IPs, so its cost should stay close
+// to the idle one.
+func BenchmarkMatch(b *testing.B) {
+	const users, ipsPerUser = 50000, 5
+	const store = "bench_match"
+	storage, err := loadStorage(store)
+	if err != nil {
+		b.Fatalf("Failed to load store: %v", err)
+	}
+	b.Cleanup(func() { _ = releaseStorage(store) })
+	populateBenchmarkStorage(storage, users, ipsPerUser)
+	storage.backend = &fileBackend{path: filepath.Join(b.TempDir(), "user_ips.json")}
+	matcher := UserIPMatcher{Store: store, logger: zap.NewNop()}
+
+	match := func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			req := httptest.NewRequest("GET", "http://localhost/", nil)
+			req.RemoteAddr = benchmarkIP(users/2*ipsPerUser) + ":12345"
+			caddyhttp.NewTestReplacer(req)
+			for pb.Next() {
+				if !matcher.Match(req) {
+					b.Errorf("Expected the known IP to match")
+					return
+				}
+			}
+		})
+	}
+
+	b.Run("idle", match)
+
+	b.Run("during_writes", func(b *testing.B) {
+		stop := make(chan struct{})
+		var writers sync.WaitGroup
+		writers.Add(2)
+		go func() {
+			defer writers.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Users of their own, so that the matched IP is never evicted
+				storage.AddUserIP(fmt.Sprintf("writer%d@bench.test", n%1000), benchmarkIP(users*ipsPerUser+n%5000))
+			}
+		}()
+		go func() {
+			defer writers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := storage.Persist(true); err != nil {
+					b.Errorf("Failed to persist: %v", err)
+					return
+				}
+			}
+		}()
+		defer func() {
+			close(stop)
+			writers.Wait()
+		}()
+
+		b.ResetTimer()
+		match(b)
+	})
+}
@@ -0,0 +1,153 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "caddy"
+const metricsSubsystem = "user_ip"
+
+// metrics holds the collectors of the module. Stores outlive config reloads,
+// so the collectors are process-wide and registered with the metrics registry
+// of every config that uses the module.
+var metrics = struct {
+	additions       *prometheus.CounterVec
+	bumps           *prometheus.CounterVec
+	evictions       *prometheus.CounterVec
+	expirations     *prometheus.CounterVec
+	ipExpirations   *prometheus.CounterVec
+	matches         *prometheus.CounterVec
+	persistDuration *prometheus.HistogramVec
+	persistSize     *prometheus.GaugeVec
+	persistFailures *prometheus.CounterVec
+	lastPersist     *prometheus.GaugeVec
+	stores          prometheus.Collector
+}{
+	additions: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "ip_additions_total",
+		Help:      "Number of IPs newly added to a user.",
+	}, []string{"store"}),
+	bumps: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "ip_bumps_total",
+		Help:      "Number of times a known IP was seen again and moved to the front of its user's list.",
+	}, []string{"store"}),
+	evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "ip_evictions_total",
+		Help:      "Number of IPs evicted because a user exceeded max_ips_per_user.",
+	}, []string{"store"}),
+	expirations: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "user_expirations_total",
+		Help:      "Number of users removed because their data outlived user_data_ttl.",
+	}, []string{"store"}),
+	ipExpirations: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "ip_expirations_total",
+		Help:      "Number of IPs removed because they were not seen within ip_ttl.",
+	}, []string{"store"}),
+	matches: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "matches_total",
+		Help:      "Number of requests evaluated by the user_ip matcher, by result (hit or miss).",
+	}, []string{"store", "matcher", "result"}),
+	persistDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "persist_duration_seconds",
+		Help:      "Time taken to write a store to its backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"store"}),
+	persistSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "persisted_bytes",
+		Help:      "Size of the last successful write of a store.",
+	}, []string{"store"}),
+	persistFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "persist_failures_total",
+		Help:      "Number of failed writes of a store.",
+	}, []string{"store"}),
+	lastPersist: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "last_persist_timestamp_seconds",
+		Help:      "Unix time of the last successful write of a store.",
+	}, []string{"store"}),
+	stores: storesCollector{},
+}
+
+// registerMetrics registers the module's collectors with registry. It may be
+// called by every handler and matcher of a config; registering twice is not
+// an error.
+func registerMetrics(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	for _, collector := range []prometheus.Collector{
+		metrics.additions,
+		metrics.bumps,
+		metrics.evictions,
+		metrics.expirations,
+		metrics.ipExpirations,
+		metrics.matches,
+		metrics.persistDuration,
+		metrics.persistSize,
+		metrics.persistFailures,
+		metrics.lastPersist,
+		metrics.stores,
+	} {
+		if err := registry.Register(collector); err != nil {
+			var already prometheus.AlreadyRegisteredError
+			if !errors.As(err, &already) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	trackedUsersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "tracked_users"),
+		"Number of users in a store.",
+		[]string{"store"}, nil)
+	trackedIPsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "tracked_ips"),
+		"Number of distinct IPs in a store.",
+		[]string{"store"}, nil)
+)
+
+// storesCollector reports the size of every live store when scraped.
+type storesCollector struct{}
+
+// Describe implements prometheus.Collector.
+func (storesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- trackedUsersDesc
+	ch <- trackedIPsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (storesCollector) Collect(ch chan<- prometheus.Metric) {
+	stores.Range(func(key, value any) bool {
+		storage := value.(*UserIPStorage)
+		users, ips := storage.size()
+
+		ch <- prometheus.MustNewConstMetric(trackedUsersDesc, prometheus.GaugeValue, float64(users), storage.name)
+		ch <- prometheus.MustNewConstMetric(trackedIPsDesc, prometheus.GaugeValue, float64(ips), storage.name)
+		return true
+	})
+}
@@ -0,0 +1,116 @@
+package caddy_user_ip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricValue returns the value of the counter or gauge with the given name and
+// labels in registry, or 0 if there is none.
+func metricValue(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	nextMetric:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if want, ok := labels[label.GetName()]; ok && label.GetValue() != want {
+					continue nextMetric
+				}
+			}
+			if counter := metric.GetCounter(); counter != nil {
+				return counter.GetValue()
+			}
+			return metric.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+// TestMetrics drives the tracker and matcher and asserts that the additions, bumps,
+// evictions, matcher results, store sizes and persistence are reported.
+func TestMetrics(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	registry := prometheus.NewRegistry()
+	if err := registerMetrics(registry); err != nil {
+		t.Fatalf("Failed to register metrics: %v", err)
+	}
+	// Every handler and matcher registers the metrics again
+	if err := registerMetrics(registry); err != nil {
+		t.Fatalf("Expected registering metrics twice to succeed, but got: %v", err)
+	}
+
+	// The counters are process-wide, so use a store no other test uses
+	const store = "metrics_test"
+	tester := createTester(t, `
+    localhost:9080 {
+        route / {
+            user_ip_tracking {
+                store `+store+`
+                persist_path `+persistPath+`
+                max_ips_per_user 1
+            }
+            respond "OK"
+        }
+        route /check {
+            @user_ip user_ip {
+                store `+store+`
+                name known_ip
+            }
+            respond @user_ip "Matched" 200
+            respond "Unmatched" 404
+        }
+    }
+  `)
+
+	// Action: A new IP, the same IP again, then a second IP evicting the first
+	for _, ip := range []string{"1.1.1.1", "1.1.1.1", "2.2.2.2"} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", ip, "")
+		_ = resp.Body.Close()
+	}
+	// Action: One matcher hit and two misses
+	for _, ip := range []string{"2.2.2.2", "1.1.1.1", "9.9.9.9"} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", ip, "")
+		_ = resp.Body.Close()
+	}
+	fakeClock.Advance(time.Minute)
+	waitForPersist(t, getLiveStorage(t, store), 2*time.Second)
+
+	storeLabel := map[string]string{"store": store}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"caddy_user_ip_ip_additions_total", storeLabel, 2},
+		{"caddy_user_ip_ip_bumps_total", storeLabel, 1},
+		{"caddy_user_ip_ip_evictions_total", storeLabel, 1},
+		{"caddy_user_ip_tracked_users", storeLabel, 1},
+		{"caddy_user_ip_tracked_ips", storeLabel, 1},
+		{"caddy_user_ip_matches_total", map[string]string{"store": store, "matcher": "known_ip", "result": "hit"}, 1},
+		{"caddy_user_ip_matches_total", map[string]string{"store": store, "matcher": "known_ip", "result": "miss"}, 2},
+		{"caddy_user_ip_persist_failures_total", storeLabel, 0},
+	}
+	for _, tt := range tests {
+		if got := metricValue(t, registry, tt.name, tt.labels); got != tt.want {
+			t.Errorf("Expected %s%v to be %v, but got %v", tt.name, tt.labels, tt.want, got)
+		}
+	}
+
+	if got := metricValue(t, registry, "caddy_user_ip_persisted_bytes", storeLabel); got <= 0 {
+		t.Errorf("Expected caddy_user_ip_persisted_bytes to be positive after a write, but got %v", got)
+	}
+	if got := metricValue(t, registry, "caddy_user_ip_last_persist_timestamp_seconds", storeLabel); got <= 0 {
+		t.Errorf("Expected caddy_user_ip_last_persist_timestamp_seconds to be set after a write, but got %v", got)
+	}
+}
@@ -0,0 +1,165 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// migration upgrades persisted data, encoded as JSON, from one format version
+// to the next.
+type migration func(s *UserIPStorage, data []byte) ([]byte, error)
+
+// migrations are the upgrades between the format versions of the persisted
+// data, in order: migrations[n] turns version n into version n+1. A change to
+// the format adds a step here, which raises persistVersion.
+var migrations = [...]migration{
+	// 0 -> 1: plain string IPs become IPData records, and the version is set
+	(*UserIPStorage).migrateFromLegacyFormat,
+}
+
+// persistVersion is the format version of the data this module writes.
+const persistVersion = len(migrations)
+
+// errNewerVersion is wrapped by the error returned for data written in a
+// format version newer than persistVersion, which this module cannot read
+// without losing what the newer format records.
+var errNewerVersion = errors.New("data was written by a newer version of the module")
+
+// migrate brings data read from backend up to persistVersion, running the
+// migrations in order, and returns true if it ran any. Before the first one,
+// the original data is backed up in the backend (as <name>.v<version>.bak) if
+// the backend supports it, so that the migrated data written back later does
+// not destroy the only copy. The backup is only written once: reading the
+// same version again, e.g. before a save or on a sync, keeps the first one.
+// Data of a newer version is rejected.
+func (s *UserIPStorage) migrate(backend Backend, data []byte) ([]byte, bool, error) {
+	var header struct {
+		Version    int             `json:"version"`
+		Encryption json.RawMessage `json:"encryption"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		s.logger.Error("Error unmarshalling persistence data", zap.Stringer("backend", backend), zap.Error(err))
+		return nil, false, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	if header.Encryption != nil {
+		// Still encrypted, as no keys are configured to decrypt it
+		return nil, false, fmt.Errorf("%w: %s is encrypted, but no encryption key is configured", errUndecryptable, backend)
+	}
+	if header.Version > persistVersion {
+		err := fmt.Errorf("%s holds format version %d, but this version of the module only reads up to version %d; upgrade the module or restore older data: %w",
+			backend, header.Version, persistVersion, errNewerVersion)
+		s.logger.Error("Refusing to load persisted data", zap.Error(err))
+		return nil, false, err
+	}
+	if header.Version < 0 {
+		return nil, false, fmt.Errorf("%w: %s holds invalid format version %d", errCorrupt, backend, header.Version)
+	}
+	if header.Version == persistVersion {
+		return data, false, nil
+	}
+
+	if backupper, ok := backend.(backupBackend); ok {
+		suffix := fmt.Sprintf(".v%d.bak", header.Version)
+		written, err := backupper.Backup(context.Background(), suffix, data)
+		if err != nil {
+			return nil, false, fmt.Errorf("backing up %s before migrating it: %v", backend, err)
+		}
+		if written {
+			s.logger.Info("Backed up persisted data before migrating it",
+				zap.Stringer("backend", backend),
+				zap.String("suffix", suffix))
+		}
+	}
+
+	for version := header.Version; version < persistVersion; version++ {
+		s.logger.Info("Migrating persisted data",
+			zap.Stringer("backend", backend),
+			zap.Int("from_version", version),
+			zap.Int("to_version", version+1))
+		migrated, err := migrations[version](s, data)
+		if err != nil {
+			s.logger.Error("Migration failed", zap.Stringer("backend", backend), zap.Int("from_version", version), zap.Error(err))
+			return nil, false, fmt.Errorf("%w: migrating %s from format version %d: %v", errCorrupt, backend, version, err)
+		}
+		data = migrated
+	}
+	return data, true, nil
+}
+
+// legacyUserData is a user's data in format version 0, whose IPs are either
+// plain strings sharing the user's last_seen, as originally written, or the
+// IPData records that replaced them before the format was versioned.
+type legacyUserData struct {
+	IPs      []json.RawMessage `json:"ips"`
+	LastSeen int64             `json:"last_seen"`
+}
+
+// migrateFromLegacyFormat upgrades data from format version 0 to 1, turning
+// plain string IPs into IPData records last seen when their user last was.
+func (s *UserIPStorage) migrateFromLegacyFormat(data []byte) ([]byte, error) {
+	var legacyPD struct {
+		UserData map[string]*legacyUserData  `json:"user_data"`
+		Removed  map[string]map[string]int64 `json:"removed,omitempty"`
+	}
+	if err := json.Unmarshal(data, &legacyPD); err != nil {
+		s.logger.Error("Failed to parse legacy format", zap.Error(err))
+		return nil, err
+	}
+
+	pd := persistData{
+		Version:  1,
+		UserData: make(map[string]*UserData, len(legacyPD.UserData)),
+		Removed:  legacyPD.Removed,
+	}
+	migratedUsers := 0
+	for user, legacyData := range legacyPD.UserData {
+		if legacyData == nil {
+			continue
+		}
+		newIPs := make([]IPData, 0, len(legacyData.IPs))
+		converted := false
+		for _, raw := range legacyData.IPs {
+			var ip string
+			if err := json.Unmarshal(raw, &ip); err != nil {
+				// Already an IPData record
+				var ipData IPData
+				if err := json.Unmarshal(raw, &ipData); err != nil {
+					return nil, fmt.Errorf("decoding IPs of user %q: %v", user, err)
+				}
+				newIPs = append(newIPs, ipData)
+				continue
+			}
+
+			ipData := IPData{
+				IP:       ip,
+				LastSeen: legacyData.LastSeen, // Use the user's last seen for all IPs
+			}
+			if s.debugLogging {
+				ipData.LastSeenISO = time.Unix(legacyData.LastSeen, 0).Format("2006-01-02T15:04:05-07:00")
+			}
+			newIPs = append(newIPs, ipData)
+			converted = true
+		}
+		pd.UserData[user] = &UserData{IPs: newIPs}
+
+		if converted {
+			migratedUsers++
+			s.logger.Info("Migrated user data",
+				zap.String("user", user),
+				zap.Int("ip_count", len(newIPs)),
+				zap.Int64("legacy_last_seen", legacyData.LastSeen))
+		}
+	}
+
+	// The caller writes the new format back
+	s.logger.Info("Migration complete, will write new format to the backend",
+		zap.Int("migrated_users", migratedUsers))
+
+	return json.Marshal(pd)
+}
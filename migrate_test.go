@@ -0,0 +1,146 @@
+package caddy_user_ip
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMigrateLegacyFormat verifies that an unversioned file, with IPs written
+// as plain strings or as records, is backed up, migrated and written back in
+// the current format version.
+func TestMigrateLegacyFormat(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	// Setup: A file from before versioning, mixing both kinds of IPs
+	legacyData := `{
+  "user_data": {
+    "user1@test.com": {"ips": ["1.1.1.1", "2.2.2.2"], "last_seen": 100},
+    "user2@test.com": {"ips": [{"ip": "3.3.3.3", "first_seen": 50, "last_seen": 150}]}
+  }
+}`
+	if err := os.WriteFile(persistPath, []byte(legacyData), 0644); err != nil {
+		t.Fatalf("Failed to write legacy data: %v", err)
+	}
+
+	createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `)
+	storage := getLiveStorage(t, defaultStoreName)
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: The original file was backed up as it was
+	backup, err := os.ReadFile(persistPath + ".v0.bak")
+	if err != nil {
+		t.Fatalf("Expected a backup of the legacy data: %v", err)
+	}
+	if string(backup) != legacyData {
+		t.Errorf("Expected the backup to hold the legacy data, but got %s", backup)
+	}
+
+	// Assert: The data was written back in the current format
+	data, err := os.ReadFile(persistPath)
+	if err != nil {
+		t.Fatalf("Failed to read persisted data: %v", err)
+	}
+	var pd persistData
+	if err := json.Unmarshal(data, &pd); err != nil {
+		t.Fatalf("Failed to decode persisted data: %v", err)
+	}
+	if pd.Version != persistVersion {
+		t.Errorf("Expected format version %d, but got %d", persistVersion, pd.Version)
+	}
+	user1 := pd.UserData["user1@test.com"]
+	if user1 == nil || len(user1.IPs) != 2 || user1.IPs[0].IP != "1.1.1.1" || user1.IPs[0].LastSeen != 100 {
+		t.Errorf("Expected user1@test.com's IPs to be records last seen at 100, but got %+v", user1)
+	}
+	user2 := pd.UserData["user2@test.com"]
+	if user2 == nil || len(user2.IPs) != 1 || user2.IPs[0].FirstSeen != 50 || user2.IPs[0].LastSeen != 150 {
+		t.Errorf("Expected user2@test.com's record to be kept, but got %+v", user2)
+	}
+}
+
+// TestMigrateBacksUpOnce verifies that the backup of data in an older format
+// is only written the first time it is migrated, and not overwritten when the
+// data is read again before it is written back.
+func TestMigrateBacksUpOnce(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	legacyData := `{"user_data": {"user1@test.com": {"ips": ["1.1.1.1"], "last_seen": 100}}}`
+	if err := os.WriteFile(persistPath, []byte(legacyData), 0644); err != nil {
+		t.Fatalf("Failed to write legacy data: %v", err)
+	}
+	storage := newUserIPStorage("migrate_backs_up_once")
+	storage.storageConfig = storageConfig{backend: &fileBackend{path: persistPath}, maxIPsPerUser: 5}
+
+	// Action: Load the data
+	if err := storage.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	// Setup: Another writer saves other data in the old format meanwhile
+	otherData := `{"user_data": {"user2@test.com": {"ips": ["2.2.2.2"], "last_seen": 200}}}`
+	if err := os.WriteFile(persistPath, []byte(otherData), 0644); err != nil {
+		t.Fatalf("Failed to write legacy data: %v", err)
+	}
+
+	// Action: Save, which reads and migrates the file again
+	if err := storage.Persist(true); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	// Assert: The backup still holds the data first migrated
+	backup, err := os.ReadFile(persistPath + ".v0.bak")
+	if err != nil {
+		t.Fatalf("Expected a backup of the legacy data: %v", err)
+	}
+	if string(backup) != legacyData {
+		t.Errorf("Expected the backup to hold the data first migrated, but got %s", backup)
+	}
+}
+
+// TestLoadNewerVersion verifies that data written in a newer format version
+// is neither loaded nor overwritten.
+func TestLoadNewerVersion(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	newerData := `{"version": 99, "user_data": {"user1@test.com": {"ips": [{"ip": "1.1.1.1", "last_seen": 100}]}}}`
+	if err := os.WriteFile(persistPath, []byte(newerData), 0644); err != nil {
+		t.Fatalf("Failed to write newer data: %v", err)
+	}
+	storage := newUserIPStorage("newer_version")
+	storage.storageConfig = storageConfig{backend: &fileBackend{path: persistPath}, maxIPsPerUser: 5}
+
+	// Action: Load the data
+	err := storage.Load()
+
+	// Assert: Loading fails, naming the problem
+	if !errors.Is(err, errNewerVersion) {
+		t.Errorf("Expected loading to fail with errNewerVersion, but got: %v", err)
+	}
+
+	// Action: Save new data on top
+	storage.AddUserIP("user2@test.com", "2.2.2.2")
+	err = storage.Persist(true)
+
+	// Assert: Saving fails too, and leaves the file alone
+	if !errors.Is(err, errNewerVersion) {
+		t.Errorf("Expected saving to fail with errNewerVersion, but got: %v", err)
+	}
+	if data, _ := os.ReadFile(persistPath); string(data) != newerData {
+		t.Errorf("Expected the newer data to be left alone, but got %s", data)
+	}
+	if _, err := os.Stat(persistPath + ".v99.bak"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected no backup of the newer data, but got: %v", err)
+	}
+}
@@ -2,32 +2,64 @@
 package caddy_user_ip
 
 import (
-	"sync"
-
 	"github.com/caddyserver/caddy/v2"
+	"github.com/jonboulle/clockwork"
+	"go.uber.org/zap"
 )
 
-var (
-	storageOnce   sync.Once
-	globalStorage *UserIPStorage
-)
+// defaultStoreName is the name of the store used when none is configured.
+const defaultStoreName = "default"
 
-// getStorage returns the singleton UserIPStorage instance, creating it if necessary.
-func getStorage() *UserIPStorage {
-	storageOnce.Do(func() {
-		globalStorage = &UserIPStorage{
-			userData:  make(map[string]*UserData),
-			ipToUsers: make(map[string]map[string]struct{}),
-			mu:        sync.RWMutex{},
-		}
+// stores holds the live UserIPStorage instances, keyed by store name. Each
+// user_ip_tracking handler holds a reference on its store, so a store (and its
+// in-memory data) survives config reloads and is destroyed once no loaded
+// config refers to it anymore.
+var stores = caddy.NewUsagePool()
+
+// newUserIPStorage creates an empty, unconfigured store.
+func newUserIPStorage(name string) *UserIPStorage {
+	return &UserIPStorage{
+		name:     name,
+		userData: make(map[string]*UserData),
+		flushCh:  make(chan struct{}, 1),
+		syncCh:   make(chan struct{}, 1),
+		removed:  make(map[string]map[string]int64),
+		clock:    clockwork.NewRealClock(),
+		logger:   zap.NewNop(),
+	}
+}
+
+// loadStorage returns the store with the given name, creating it if necessary,
+// and adds a reference to it. Every call must be paired with releaseStorage.
+func loadStorage(name string) (*UserIPStorage, error) {
+	val, _, err := stores.LoadOrNew(name, func() (caddy.Destructor, error) {
+		return newUserIPStorage(name), nil
 	})
-	return globalStorage
+	if err != nil {
+		return nil, err
+	}
+	return val.(*UserIPStorage), nil
 }
 
-// resetStorage resets the singleton instance for testing purposes.
-func resetStorage() {
-	globalStorage = nil
-	storageOnce = sync.Once{}
+// releaseStorage drops a reference taken by loadStorage. The store is
+// destroyed when its last reference is released.
+func releaseStorage(name string) error {
+	_, err := stores.Delete(name)
+	return err
+}
+
+// lookupStorage returns the live store with the given name without taking a
+// reference, or nil if no loaded config uses it.
+func lookupStorage(name string) *UserIPStorage {
+	var found *UserIPStorage
+	stores.Range(func(key, value any) bool {
+		if key == name {
+			found = value.(*UserIPStorage)
+			return false
+		}
+		return true
+	})
+	return found
 }
 
 func init() {
@@ -36,5 +68,10 @@ func init() {
 
 	// Register the matcher module
 	caddy.RegisterModule(UserIPMatcher{})
-}
 
+	// Register the admin API module
+	caddy.RegisterModule(adminAPI{})
+
+	// Register the app that hands stores over on config reloads
+	caddy.RegisterModule(&trackingApp{})
+}
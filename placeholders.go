@@ -0,0 +1,59 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// setPlaceholders publishes what is known about the client IP on the request's
+// replacer, so it can be used in logs, headers and responses:
+//
+//   - {user_ip.known}: "true" if any user is known for the IP, else "false"
+//   - {user_ip.users}: comma-separated, sorted list of those users
+//   - {user_ip.user_count}: number of those users
+//   - {user_ip.last_seen}: when any of them was last seen from the IP (RFC 3339)
+//   - {user_ip.first_seen}: when any of them was first seen from the IP (RFC 3339)
+//
+// The timestamps are empty when unknown.
+func setPlaceholders(r *http.Request, entries []UserIPEntry) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+
+	var users []string
+	var lastSeen, firstSeen int64
+	for _, entry := range entries {
+		if !slices.Contains(users, entry.User) {
+			users = append(users, entry.User)
+		}
+		if entry.LastSeen > lastSeen {
+			lastSeen = entry.LastSeen
+		}
+		if entry.FirstSeen != 0 && (firstSeen == 0 || entry.FirstSeen < firstSeen) {
+			firstSeen = entry.FirstSeen
+		}
+	}
+	slices.Sort(users)
+
+	repl.Set("user_ip.known", strconv.FormatBool(len(users) > 0))
+	repl.Set("user_ip.users", strings.Join(users, ","))
+	repl.Set("user_ip.user_count", strconv.Itoa(len(users)))
+	repl.Set("user_ip.last_seen", formatPlaceholderTime(lastSeen))
+	repl.Set("user_ip.first_seen", formatPlaceholderTime(firstSeen))
+}
+
+// formatPlaceholderTime formats a Unix timestamp for a placeholder, or returns
+// an empty string for 0.
+func formatPlaceholderTime(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
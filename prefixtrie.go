@@ -0,0 +1,149 @@
+// package caddy_user_ip provides Caddy middleware for tracking and matching user IPs.
+package caddy_user_ip
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// prefixTrie is a path-compressed binary radix trie of IP addresses, used to
+// answer "is any tracked address inside this network?" without scanning every
+// address. IPv4 and IPv6 addresses are kept in separate trees.
+type prefixTrie struct {
+	root4 *trieNode
+	root6 *trieNode
+}
+
+// trieNode is a node of a prefixTrie. Every node either holds an address
+// (terminal) or branches into two children; chains of single-child nodes are
+// collapsed into the prefix of the node below them.
+type trieNode struct {
+	// All addresses in this subtree share this prefix
+	prefix netip.Prefix
+
+	// Children by the value of the bit following prefix
+	children [2]*trieNode
+
+	// Whether prefix is a full-length address that is in the trie
+	terminal bool
+}
+
+// root returns the tree holding addresses of addr's family.
+func (t *prefixTrie) root(addr netip.Addr) **trieNode {
+	if addr.Is4() {
+		return &t.root4
+	}
+	return &t.root6
+}
+
+// Insert adds addr to the trie. It is a no-op if addr is already present.
+func (t *prefixTrie) Insert(addr netip.Addr) {
+	addr = addr.Unmap().WithZone("")
+	insertPrefix(t.root(addr), netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// Remove deletes addr from the trie. It is a no-op if addr is not present.
+func (t *prefixTrie) Remove(addr netip.Addr) {
+	addr = addr.Unmap().WithZone("")
+	removePrefix(t.root(addr), netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// WalkWithin calls fn for every address in the trie that lies within p, until
+// fn returns false.
+func (t *prefixTrie) WalkWithin(p netip.Prefix, fn func(netip.Addr) bool) {
+	p = p.Masked()
+	node := *t.root(p.Addr())
+	for node != nil && p.Bits() > node.prefix.Bits() {
+		if !node.prefix.Contains(p.Addr()) {
+			return
+		}
+		node = node.children[bitAt(p.Addr(), node.prefix.Bits())]
+	}
+	if node != nil && p.Contains(node.prefix.Addr()) {
+		walkNode(node, fn)
+	}
+}
+
+// walkNode calls fn for every address in the subtree rooted at node, until fn
+// returns false. Returns false if fn did.
+func walkNode(node *trieNode, fn func(netip.Addr) bool) bool {
+	if node == nil {
+		return true
+	}
+	if node.terminal && !fn(node.prefix.Addr()) {
+		return false
+	}
+	return walkNode(node.children[0], fn) && walkNode(node.children[1], fn)
+}
+
+// insertPrefix inserts the full-length prefix p into the tree rooted at *n.
+func insertPrefix(n **trieNode, p netip.Prefix) {
+	node := *n
+	if node == nil {
+		*n = &trieNode{prefix: p, terminal: true}
+		return
+	}
+
+	common := commonBits(node.prefix, p)
+	switch {
+	case common == node.prefix.Bits() && common == p.Bits():
+		node.terminal = true
+	case common == node.prefix.Bits():
+		// p lies below node
+		insertPrefix(&node.children[bitAt(p.Addr(), common)], p)
+	default:
+		// p diverges from node part-way through node's prefix, so branch there
+		branch := &trieNode{prefix: netip.PrefixFrom(p.Addr(), common).Masked()}
+		branch.children[bitAt(node.prefix.Addr(), common)] = node
+		branch.children[bitAt(p.Addr(), common)] = &trieNode{prefix: p, terminal: true}
+		*n = branch
+	}
+}
+
+// removePrefix removes the full-length prefix p from the tree rooted at *n,
+// collapsing nodes that are left with a single child.
+func removePrefix(n **trieNode, p netip.Prefix) {
+	node := *n
+	if node == nil || node.prefix.Bits() > p.Bits() || !node.prefix.Contains(p.Addr()) {
+		return
+	}
+
+	if node.prefix.Bits() == p.Bits() {
+		node.terminal = false
+	} else {
+		removePrefix(&node.children[bitAt(p.Addr(), node.prefix.Bits())], p)
+	}
+
+	if node.terminal {
+		return
+	}
+	switch {
+	case node.children[0] == nil && node.children[1] == nil:
+		*n = nil
+	case node.children[0] == nil:
+		*n = node.children[1]
+	case node.children[1] == nil:
+		*n = node.children[0]
+	}
+}
+
+// bitAt returns bit i of addr, counting from the most significant bit.
+func bitAt(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits returns the length of the longest prefix shared by a and b.
+func commonBits(a, b netip.Prefix) int {
+	limit := min(a.Bits(), b.Bits())
+	ab, bb := a.Addr().AsSlice(), b.Addr().AsSlice()
+	n := 0
+	for i := range ab {
+		if x := ab[i] ^ bb[i]; x != 0 {
+			n += bits.LeadingZeros8(x)
+			break
+		}
+		n += 8
+	}
+	return min(n, limit)
+}
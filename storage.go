@@ -2,8 +2,15 @@
 package caddy_user_ip
 
 import (
+	"cmp"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
@@ -16,6 +23,10 @@ type IPData struct {
 	// The IP address
 	IP string `json:"ip"`
 
+	// Unix timestamp when this IP was first seen for the user (seconds); 0 if
+	// it was recorded before first-seen times were tracked
+	FirstSeen int64 `json:"first_seen,omitempty"`
+
 	// Unix timestamp when this IP was last seen (seconds)
 	LastSeen int64 `json:"last_seen"`
 
@@ -32,36 +43,160 @@ type UserData struct {
 	LastSeen int64 `json:"last_seen,omitempty"`
 }
 
-// legacyUserData represents the old format for migration purposes
-type legacyUserData struct {
-	IPs      []string `json:"ips"`
-	LastSeen int64    `json:"last_seen"`
+// storageConfig holds the settings a user_ip_tracking handler applies to its store.
+type storageConfig struct {
+	// Where the data is persisted
+	backend Backend
+
+	// Maximum number of IPs to store per user
+	maxIPsPerUser uint64
+
+	// Time-to-live for user data in seconds (0 means no expiration)
+	userDataTTL uint64
+
+	// Time-to-live for each of a user's IPs in seconds (0 means no expiration)
+	ipTTL uint64
+
+	// How often the background loop saves the full state
+	persistInterval time.Duration
+
+	// Maximum delay before a timestamp-only change is written to the backend
+	flushDelay time.Duration
+
+	// Maximum delay before a new IP (or a removal) is written to the backend
+	newIPFlushDelay time.Duration
+
+	// How often the data saved by other instances is merged in (0 means never)
+	syncInterval time.Duration
+
+	// How often expired users and IPs are removed, if a TTL is set
+	sweepInterval time.Duration
+
+	// How long removals are remembered, unless a TTL forgets them sooner
+	removalRetention time.Duration
+
+	// Journal the changes are appended to between full saves (nil for none)
+	journal *journal
+
+	// Size in bytes and age at which the journal is compacted into a full save
+	journalMaxSize int64
+	journalMaxAge  time.Duration
+
+	// Whether data that cannot be read fails the load, rather than being set
+	// aside in favor of a backup
+	strictLoad bool
+
+	// JSON file saved by the file backend to import into the bolt backend, if
+	// any
+	importJSON string
+
+	// Whether the records of the bolt backend are left in the database, which
+	// lookups then read, rather than all kept in memory too
+	uncached bool
+}
+
+// database returns the bolt backend if its records are left in it, in which
+// case memory only holds the users with changes not written to it yet.
+func (c storageConfig) database() *boltBackend {
+	if !c.uncached {
+		return nil
+	}
+	database, _ := c.backend.(*boltBackend)
+	return database
 }
 
 // UserIPStorage manages the storage of user IP addresses.
 type UserIPStorage struct {
-	// Maps user emails to their data
+	// Current settings, replaced when a reloaded config is applied
+	storageConfig
+
+	// Name of the store
+	name string
+
+	// Maps user emails to their data. With the cache turned off, it only
+	// holds the users with changes not written to the database yet.
 	userData map[string]*UserData
 
-	// Maps IP addresses to a set of users who have used that IP
-	// This allows for efficient lookups when matching IPs
-	ipToUsers map[string]map[string]struct{}
+	// Maps IP addresses to the users who have used them, for lookups that do
+	// not wait on mu
+	view ipView
 
-	// Maximum number of IPs to store per user
-	maxIPsPerUser uint64
+	// Users by the time their next IP or their data expires, if a TTL is set
+	expiry expiryHeap
 
-	// Time-to-live for user data in seconds (0 means no expiration)
-	userDataTTL uint64
+	// Signals the writer that a flush is due; buffered so that requests coalesce
+	flushCh chan struct{}
+
+	// Signals the writer that the backend may have been changed by another
+	// instance; buffered so that requests coalesce
+	syncCh chan struct{}
+
+	// Timer that requests the next periodic sync, if any
+	syncTimer clockwork.Timer
+
+	// Timer that runs the next expiry sweep, if any
+	sweepTimer clockwork.Timer
 
-	// Path to persist the data
-	persistPath string
+	// Removals made through RemoveUser and RemoveUserIP, here or by another
+	// instance, by user and IP (removedAll for the whole user), with the time
+	// they were made, so that merging does not bring the removed IPs back
+	removed map[string]map[string]int64
+
+	// Stops watching the backend, if it is being watched
+	stopWatch context.CancelFunc
+
+	// Timer that requests the next scheduled flush, if any
+	flushTimer clockwork.Timer
+
+	// When flushTimer is due to fire
+	flushDeadline time.Time
+
+	// Ticker driving the periodic full save
+	persistTicker clockwork.Ticker
+
+	// Closed to stop the writer
+	stopPersist chan struct{}
+
+	// Closed by the writer once it has exited
+	persistDone chan struct{}
 
 	// Mutex for thread-safe access
 	mu sync.RWMutex
 
+	// Serializes writes to the backend, which are made without holding mu.
+	// Taken before mu when both are needed.
+	persistMu sync.Mutex
+
 	// Flag to track if data has changed since last persist
 	dirty bool
 
+	// Whether a snapshot is being written to the backend
+	saving bool
+
+	// Number of consecutive failed writes, to back off their retries
+	failedWrites int
+
+	// Changes not yet appended to the journal or applied to the backend, if
+	// either saves changes one by one
+	pending []journalEntry
+
+	// Index in pending of the bump of each IP, by user and IP, so that a
+	// later bump replaces it rather than adding to pending
+	pendingBumps map[string]map[string]int
+
+	// Whether the data changed in a way pending does not record, e.g. it was
+	// migrated on load or pending grew past maxPending, so that the next
+	// write must save it in full
+	fullSave bool
+
+	// The data last written to the backend, so that a save can tell whether
+	// another instance changed it since. Guarded by persistMu.
+	lastSave savedVersion
+
+	// The encrypted backend whose copies were last encrypted with its
+	// current key, after it was first written. Guarded by persistMu.
+	sealedCopies *encryptedBackend
+
 	// clock provides access to time functions via the clockwork interface
 	clock clockwork.Clock
 
@@ -73,431 +208,2218 @@ type UserIPStorage struct {
 
 	// Flag to indicate if storage has been configured
 	configured bool
+
+	// App of the config the current settings belong to
+	owner *trackingApp
+
+	// Settings of a config being loaded, applied once it is running
+	staged *stagedConfig
 }
 
-// Configure sets up the storage instance. It only allows configuration once.
-// Returns true if the configuration was applied, false if it was already configured.
-func (s *UserIPStorage) Configure(persistPath string, maxIPsPerUser uint64, userDataTTL uint64,
-	clock clockwork.Clock, logger *zap.Logger) bool {
+// Configure applies the given settings to the storage and starts its background
+// writer if it is not running yet. It is called by every handler that uses the
+// store, along with the app of the config the handler belongs to.
+//
+// The first config to configure the store has its settings applied at once.
+// A config reloaded over a live store only has its settings staged, as loading
+// it may still fail; they are applied by applyStaged once the previous config
+// is stopped, and dropped by dropStaged if loading fails. Further handlers of
+// the same config must use the same settings.
+// Returns true if this was the store's first configuration, in which case the
+// caller should load the persisted data.
+func (s *UserIPStorage) Configure(cfg storageConfig, clock clockwork.Clock, logger *zap.Logger, owner *trackingApp) (bool, error) {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.configured {
-		return false
+	if !s.configured {
+		// The writer reads these without holding the lock, so they are only
+		// set once
+		s.clock = clock
+		s.logger = logger
+		s.debugLogging = logger.Level() == zap.DebugLevel
+		s.storageConfig = cfg
+		s.owner = owner
+		s.view.configure(clock, cfg.userDataTTL, cfg.ipTTL, cfg.database(), logger)
+		s.configured = true
+		s.dirty = false // Initialize dirty flag
+		s.logger.Debug("UserIPStorage configured and initialized with dirty=false", zap.String("store", s.name))
+		s.startWriter()
+		return true, nil
 	}
 
-	s.persistPath = persistPath
-	s.maxIPsPerUser = maxIPsPerUser
-	s.userDataTTL = userDataTTL
-	s.clock = clock
-	s.logger = logger
-	s.debugLogging = logger.Level() == zap.DebugLevel
-	s.configured = true
-	s.dirty = false // Initialize dirty flag
-	s.logger.Debug("UserIPStorage configured and initialized with dirty=false")
+	// Another handler of the same config must agree on the settings, or it
+	// would silently share data meant to be kept elsewhere
+	if s.staged != nil && s.staged.owner == owner {
+		return false, s.checkSameSettings(s.staged.storageConfig, cfg)
+	}
+	if s.owner == owner {
+		return false, s.checkSameSettings(s.storageConfig, cfg)
+	}
 
-	return true
+	s.staged = &stagedConfig{storageConfig: cfg, owner: owner}
+	s.logger.Debug("UserIPStorage reconfiguration staged", zap.String("store", s.name))
+	return false, nil
 }
 
+// checkSameSettings returns an error if cfg, the settings of a further handler
+// of a config, differ from current, those of its first handler.
+func (s *UserIPStorage) checkSameSettings(current, cfg storageConfig) error {
+	if !current.equal(cfg) {
+		return fmt.Errorf("store %q is already set up with different settings by another handler; give the handlers different store names, or the same settings", s.name)
+	}
+	return nil
+}
 
-// AddUserIP adds an IP address for a user, maintaining the FIFO limit.
-// Returns true if the IP was newly added (not already in the user's list).
-func (s *UserIPStorage) AddUserIP(email, ip string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// equal reports whether c and other are the same settings, keeping the data in
+// the same place in the same way.
+func (c storageConfig) equal(other storageConfig) bool {
+	if !sameBackend(c.backend, other.backend) || journalPath(c.journal) != journalPath(other.journal) {
+		return false
+	}
+	c.backend, other.backend = nil, nil
+	c.journal, other.journal = nil, nil
+	return c == other
+}
 
-	now := s.clock.Now().Unix()
-	nowISO := ""
-	if s.debugLogging {
-		nowISO = s.clock.Now().Format("2006-01-02T15:04:05-07:00")
+// sameBackend reports whether a and b keep the data in the same place in the
+// same way.
+func sameBackend(a, b Backend) bool {
+	switch a := a.(type) {
+	case *encryptedBackend:
+		b, ok := b.(*encryptedBackend)
+		return ok && slices.EqualFunc(a.keys, b.keys, func(x, y encryptionKey) bool {
+			return x.id == y.id
+		}) && sameBackend(a.Backend, b.Backend)
+	case *fileBackend:
+		b, ok := b.(*fileBackend)
+		return ok && a.path == b.path && a.backups == b.backups && a.watchInterval == b.watchInterval
+	default:
+		_, encrypted := b.(*encryptedBackend)
+		return !encrypted && a.String() == b.String()
 	}
+}
 
-	// Get or create user data
-	userData, exists := s.userData[email]
-	if !exists {
-		// Create new user data
-		userData = &UserData{
-			IPs: []IPData{},
-		}
-		s.userData[email] = userData
-		s.logger.Info("Created new user entry", zap.String("user", email), zap.String("ip", ip))
-	} else {
-		// Check if this user already has this IP in their list
-		foundIndex := -1
-		for i, ipData := range userData.IPs {
-			if ipData.IP == ip {
-				foundIndex = i
-				break
-			}
-		}
+// stagedConfig holds the settings of a config being loaded, until it runs.
+type stagedConfig struct {
+	storageConfig
 
-		if foundIndex != -1 {
-			// IP already exists for this user, update timestamp and move to front if needed
-			ipData := userData.IPs[foundIndex]
-			ipData.LastSeen = now
-			if s.debugLogging {
-				ipData.LastSeenISO = nowISO
-			}
+	// App of the config the settings belong to
+	owner *trackingApp
+}
 
-			if foundIndex > 0 {
-				// IP is not the most recent, move it to the front (MRU)
-				// Remove the IP from its current position
-				userData.IPs = append(userData.IPs[:foundIndex], userData.IPs[foundIndex+1:]...)
-				// Prepend the IP to the front
-				userData.IPs = append([]IPData{ipData}, userData.IPs...)
+// applyStaged applies the settings staged by the config that replaces stopped,
+// the app of the config being stopped. Does nothing if no other config staged
+// any.
+func (s *UserIPStorage) applyStaged(stopped *trackingApp) error {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-				s.logger.Debug("Moved existing IP to front (MRU)", zap.String("user", email), zap.String("ip", ip))
-				// Mark as dirty and trigger immediate write
-				s.dirty = true
-				go s.writeImmediately()
-			} else {
-				// Update the first entry in place (timestamp changed)
-				userData.IPs[0] = ipData
-				// Mark as dirty and trigger immediate write since timestamp updates are important
-				s.dirty = true
-				go s.writeImmediately()
-			}
-			return false // No new IP was added
-		}
+	staged := s.staged
+	if staged == nil || staged.owner == stopped {
+		return nil
 	}
+	s.staged = nil
 
-	// Create new IP data entry
-	newIPData := IPData{
-		IP:       ip,
-		LastSeen: now,
+	// The new config is running, whether or not its settings can be applied
+	s.owner = staged.owner
+	if err := s.reconfigure(staged.storageConfig); err != nil {
+		return err
 	}
-	if s.debugLogging {
-		newIPData.LastSeenISO = nowISO
+	if staged.importJSON != "" {
+		if _, err := s.importFile(staged.importJSON); err != nil {
+			return fmt.Errorf("importing user IP data: %v", err)
+		}
 	}
+	return nil
+}
 
-	// Add IP to user's list (prepend to maintain newest-first order)
-	userData.IPs = append([]IPData{newIPData}, userData.IPs...)
-
-	// Trim list if it exceeds the maximum and log evicted IP
-	if uint64(len(userData.IPs)) > s.maxIPsPerUser {
-		// Get the IP that's being removed (last in the list)
-		removedIPData := userData.IPs[s.maxIPsPerUser]
-		removedIP := removedIPData.IP
-
-		// Log the eviction
-		s.logger.Info("Evicting oldest IP for user",
-			zap.String("user", email),
-			zap.String("evicted_ip", removedIP),
-			zap.Int64("evicted_ip_last_seen", removedIPData.LastSeen),
-			zap.String("new_ip", ip))
+// dropStaged drops the settings staged by owner, whose config failed to load.
+func (s *UserIPStorage) dropStaged(owner *trackingApp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		// Trim the list
-		userData.IPs = userData.IPs[:s.maxIPsPerUser]
+	if s.staged != nil && s.staged.owner == owner {
+		s.staged = nil
+	}
+}
 
-		// Update the reverse mapping
-		if users, exists := s.ipToUsers[removedIP]; exists {
-			delete(users, email)
-			if len(users) == 0 {
-				delete(s.ipToUsers, removedIP)
-				s.logger.Debug("Removed IP from global tracking (no remaining users)", zap.String("ip", removedIP))
-			}
+// reconfigure replaces the current settings with cfg and applies them to the
+// data already in memory: lists are trimmed to a lower max_ips_per_user, a new
+// TTL expires users immediately, and a new backend receives the current data
+// before the old one is cleared. Changes that need every user, and turning
+// the cache back on, read the users left in the database into memory; with
+// the cache turned off, they are dropped from it again once written.
+// Callers must hold s.persistMu and s.mu.
+func (s *UserIPStorage) reconfigure(cfg storageConfig) error {
+	old := s.storageConfig
+
+	if old.database() != nil && (cfg.database() == nil || cfg.backend.String() != old.backend.String() || cfg.maxIPsPerUser < old.maxIPsPerUser) {
+		if err := s.fillCache(); err != nil {
+			return fmt.Errorf("reading user IP data from %s: %v", old.backend, err)
 		}
 	}
 
-	// Update the reverse mapping for the new IP
-	if _, exists := s.ipToUsers[ip]; !exists {
-		s.ipToUsers[ip] = make(map[string]struct{})
+	// Move the data first, so that a failure leaves the store as it was
+	if cfg.backend.String() != old.backend.String() {
+		if err := s.moveTo(cfg.backend); err != nil {
+			return err
+		}
+	}
+	if journalPath(cfg.journal) == journalPath(old.journal) {
+		// Keep what is known about the journal file
+		cfg.journal = old.journal
+	} else if err := s.switchJournal(old.journal, cfg); err != nil {
+		return err
 	}
-	s.ipToUsers[ip][email] = struct{}{}
 
-	// Mark as dirty and trigger immediate write
-	s.dirty = true
-	s.logger.Info("Added new IP for user", zap.String("user", email), zap.String("ip", ip))
-	go s.writeImmediately()
+	// The backend belongs to the config, so switch to the new config's even if
+	// it keeps the data in the same place
+	s.storageConfig = cfg
+	s.view.configure(s.clock, cfg.userDataTTL, cfg.ipTTL, cfg.database(), s.logger)
+	if s.stopPersist != nil {
+		s.startWatch()
+	}
+	s.logger.Debug("UserIPStorage reconfigured", zap.String("store", s.name))
 
-	// Clean up expired users if TTL is set
-	if s.userDataTTL > 0 {
+	if cfg.maxIPsPerUser < old.maxIPsPerUser {
+		s.trimToMaxIPs()
+	}
+	if cfg.userDataTTL != old.userDataTTL || cfg.ipTTL != old.ipTTL {
+		s.rebuildExpiry()
 		s.cleanupExpiredUsers()
 	}
+	if cfg.persistInterval != old.persistInterval {
+		if s.persistTicker != nil {
+			s.persistTicker.Reset(s.persistInterval)
+		}
+	}
+	if cfg.syncInterval != old.syncInterval && s.stopPersist != nil {
+		s.scheduleSync()
+	}
+	if (cfg.sweepInterval != old.sweepInterval || cfg.userDataTTL != old.userDataTTL || cfg.ipTTL != old.ipTTL) && s.stopPersist != nil {
+		s.scheduleSweep()
+	}
+	if s.stopPersist == nil {
+		s.startWriter()
+	}
 
-	return true
+	if cfg.database() != nil {
+		if s.fullSave {
+			// The data in memory holds every user, but the database may not
+			if err := s.write(cfg.backend, s.snapshot()); err != nil {
+				return fmt.Errorf("saving user IP data to %s: %v", cfg.backend, err)
+			}
+			s.markSaved()
+		}
+		s.evictCache(nil)
+	}
+	return nil
 }
 
-// HasIP checks if the given IP address belongs to any user.
-func (s *UserIPStorage) HasIP(ip string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// moveTo saves the current data to newBackend and then deletes it from the
+// current backend, so at any time at least one complete copy of the data is
+// saved. Callers must hold s.persistMu and s.mu.
+func (s *UserIPStorage) moveTo(newBackend Backend) error {
+	unlock, err := s.lockBackend(newBackend)
+	if err != nil {
+		return fmt.Errorf("moving user IP data to %s: %v", newBackend, err)
+	}
+	defer unlock()
 
-	_, exists := s.ipToUsers[ip]
-	return exists
+	saved, _, err := s.readBackend(newBackend)
+	if err != nil {
+		return fmt.Errorf("moving user IP data to %s: %v", newBackend, err)
+	}
+	s.mergeData(saved)
+	if err := s.write(newBackend, s.snapshot()); err != nil {
+		return fmt.Errorf("moving user IP data to %s: %v", newBackend, err)
+	}
+	s.markSaved()
+
+	if err := s.backend.Delete(context.Background()); err != nil {
+		// The data is safe in the new backend, so a stale copy is not fatal
+		s.logger.Warn("Failed to delete data from previous backend",
+			zap.String("store", s.name),
+			zap.Stringer("backend", s.backend),
+			zap.Error(err))
+	}
+	s.logger.Info("Moved user IP data to new backend",
+		zap.String("store", s.name),
+		zap.Stringer("old_backend", s.backend),
+		zap.Stringer("new_backend", newBackend))
+	return nil
 }
 
-// GetUsersForIP returns all users associated with a given IP.
-func (s *UserIPStorage) GetUsersForIP(ip string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// switchJournal saves the data in full to the backend of cfg, which then
+// holds every change in the current journal, and empties both the current
+// journal and the one of cfg, which may hold changes from an earlier run.
+// Callers must hold s.persistMu and s.mu.
+func (s *UserIPStorage) switchJournal(current *journal, cfg storageConfig) error {
+	if err := s.write(cfg.backend, s.snapshot()); err != nil {
+		return fmt.Errorf("saving user IP data to %s before switching journals: %v", cfg.backend, err)
+	}
+	s.markSaved()
 
-	users := make([]string, 0)
-	if userSet, exists := s.ipToUsers[ip]; exists {
-		for user := range userSet {
-			users = append(users, user)
+	for _, j := range []*journal{current, cfg.journal} {
+		if j == nil {
+			continue
+		}
+		if err := j.Reset(); err != nil {
+			s.logger.Warn("Failed to empty journal",
+				zap.String("store", s.name),
+				zap.Stringer("journal", j),
+				zap.Error(err))
 		}
 	}
-	return users
+	s.logger.Info("Switched journal",
+		zap.String("store", s.name),
+		zap.String("old_journal", journalPath(current)),
+		zap.String("new_journal", journalPath(cfg.journal)))
+	return nil
 }
 
-// GetIPsForUser returns all IPs associated with a given user.
-func (s *UserIPStorage) GetIPsForUser(email string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// maxPending is the number of pending changes past which they are dropped in
+// favor of saving the data in full, so that writes that keep failing do not
+// let them grow without bound.
+const maxPending = 10000
+
+// logChange records a change to be appended to the journal or applied to the
+// backend, if the store saves changes one by one. A bump replaces the pending
+// bump of the same IP, unless another change to the user came in between.
+// Callers must hold s.mu.
+func (s *UserIPStorage) logChange(op, user string, ipData IPData) {
+	if _, ok := s.backend.(recordBackend); !ok && s.journal == nil {
+		return
+	}
+	if s.fullSave {
+		// The full save holds this change too
+		return
+	}
+	entry := journalEntry{Op: op, User: user, IPData: ipData, At: s.clock.Now().Unix()}
+
+	if op != journalBump {
+		// A bump made before this change must stay before it
+		delete(s.pendingBumps, user)
+	} else if index, exists := s.pendingBumps[user][ipData.IP]; exists {
+		s.pending[index] = entry
+		return
+	}
 
-	if userData, exists := s.userData[email]; exists {
-		// Extract IP strings from IPData structs
-		result := make([]string, len(userData.IPs))
-		for i, ipData := range userData.IPs {
-			result[i] = ipData.IP
+	if len(s.pending) >= maxPending && s.database() == nil {
+		// With the cache turned off, the pending changes are the only copy of
+		// those not written yet, so they are kept however many there are
+		s.dropPending()
+		return
+	}
+	s.pending = append(s.pending, entry)
+	if op == journalBump {
+		if s.pendingBumps == nil {
+			s.pendingBumps = make(map[string]map[string]int)
 		}
-		return result
+		if s.pendingBumps[user] == nil {
+			s.pendingBumps[user] = make(map[string]int)
+		}
+		s.pendingBumps[user][ipData.IP] = len(s.pending) - 1
 	}
-	return []string{}
 }
 
-// writeImmediately writes data to disk immediately in a goroutine-safe manner
-func (s *UserIPStorage) writeImmediately() {
-	if err := s.PersistToDisk(false); err != nil {
-		s.logger.Error("Failed to write data immediately", zap.Error(err))
-	} else {
-		s.logger.Debug("Successfully wrote data immediately")
-	}
+// takePending returns the pending changes and clears them. Callers must hold
+// s.mu.
+func (s *UserIPStorage) takePending() []journalEntry {
+	entries := s.pending
+	s.pending = nil
+	s.pendingBumps = nil
+	return entries
 }
 
-// persistData represents the structure of the data to be persisted.
-type persistData struct {
-	UserData map[string]*UserData `json:"user_data"`
-	// We don't need to persist ipToUsers as it can be reconstructed
+// dropPending drops the pending changes, and has the next write save the
+// data in full instead. Callers must hold s.mu.
+func (s *UserIPStorage) dropPending() {
+	s.logger.Warn("Too many changes pending, will save the data in full instead",
+		zap.String("store", s.name),
+		zap.Int("pending", len(s.pending)))
+	s.takePending()
+	s.fullSave = true
 }
 
-// LoadFromDisk loads the user IP data from disk.
-func (s *UserIPStorage) LoadFromDisk() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.logger.Debug("Attempting to load data from disk", zap.String("path", s.persistPath))
-	// Check if the file exists
-	fileInfo, err := os.Stat(s.persistPath)
-	if os.IsNotExist(err) {
-		s.logger.Debug("Persistence file does not exist", zap.String("path", s.persistPath))
-		// File doesn't exist, nothing to load
-		return nil
-	} else if err != nil {
-		s.logger.Error("Error stating persistence file", zap.String("path", s.persistPath), zap.Error(err))
-		return err
-	}
-	s.logger.Debug("Persistence file exists", zap.String("path", s.persistPath), zap.Int64("size", fileInfo.Size()))
-
-	// Read the file
-	data, err := os.ReadFile(s.persistPath)
-	if err != nil {
-		s.logger.Error("Error reading persistence file", zap.String("path", s.persistPath), zap.Error(err))
-		return err
-	}
-	s.logger.Debug("Successfully read persistence file", zap.String("path", s.persistPath), zap.Int("bytes_read", len(data)))
-
-	// Try to parse the JSON as new format first
-	var pd persistData
-	if err := json.Unmarshal(data, &pd); err != nil {
-		s.logger.Error("Error unmarshalling persistence data", zap.String("path", s.persistPath), zap.Error(err))
-		return err
-	}
+// markSaved records that the data was just saved in full. Callers must hold
+// s.mu.
+func (s *UserIPStorage) markSaved() {
+	s.dirty = false
+	s.takePending()
+	s.fullSave = false
+	s.stopFlushTimer()
+}
 
-	// Check if migration is needed by detecting if this is legacy format
-	// Try to parse a small sample to see if it's old format
-	needsMigration := false
-	if len(pd.UserData) > 0 {
-		// Try parsing as legacy format to detect if migration is needed
-		var testLegacy struct {
-			UserData map[string]*legacyUserData `json:"user_data"`
-		}
-		if err := json.Unmarshal(data, &testLegacy); err == nil {
-			// If legacy parsing succeeds, check if it actually has legacy structure
-			for _, legacyData := range testLegacy.UserData {
-				if len(legacyData.IPs) > 0 {
-					// This is legacy format - IPs are strings not objects
-					needsMigration = true
-					break
-				}
-			}
+// trimToMaxIPs drops the oldest IPs of every user holding more than
+// maxIPsPerUser, and rebuilds the reverse mapping. Callers must hold s.mu.
+func (s *UserIPStorage) trimToMaxIPs() {
+	trimmed := 0
+	for email, userData := range s.userData {
+		if uint64(len(userData.IPs)) <= s.maxIPsPerUser {
+			continue
 		}
-	}
-
-	if needsMigration {
-		s.logger.Info("Detected old data format, performing migration", zap.String("path", s.persistPath))
-		if err := s.migrateFromLegacyFormat(data); err != nil {
-			s.logger.Error("Migration failed", zap.Error(err))
-			return err
+		for _, removedIPData := range userData.IPs[s.maxIPsPerUser:] {
+			s.logger.Info("Evicting IP for user after max_ips_per_user was lowered",
+				zap.String("user", email),
+				zap.String("evicted_ip", removedIPData.IP),
+				zap.Int64("evicted_ip_last_seen", removedIPData.LastSeen))
+			s.logChange(journalEvict, email, IPData{IP: removedIPData.IP})
 		}
-		s.logger.Info("Migration completed successfully")
-	} else {
-		// Update our data structures with new format
-		s.userData = pd.UserData
-		s.logger.Info("Loaded data from disk (new format)", zap.Int("user_count", len(pd.UserData)), zap.String("path", s.persistPath))
+		metrics.evictions.WithLabelValues(s.name).Add(float64(uint64(len(userData.IPs)) - s.maxIPsPerUser))
+		userData.IPs = userData.IPs[:s.maxIPsPerUser]
+		s.refreshUser(email)
+		trimmed++
 	}
+	if trimmed == 0 {
+		return
+	}
+
+	s.rebuildIPIndex()
+	s.markDirty(s.newIPFlushDelay)
+	s.logger.Info("Trimmed IP lists to the new max_ips_per_user",
+		zap.String("store", s.name),
+		zap.Uint64("max_ips_per_user", s.maxIPsPerUser),
+		zap.Int("trimmed_users", trimmed))
+}
 
-	// Rebuild the reverse mapping
-	s.ipToUsers = make(map[string]map[string]struct{})
+// rebuildIPIndex rebuilds the reverse mapping from userData. Callers must hold s.mu.
+func (s *UserIPStorage) rebuildIPIndex() {
+	var view ipView
 	for user, userData := range s.userData {
 		for _, ipData := range userData.IPs {
-			if _, exists := s.ipToUsers[ipData.IP]; !exists {
-				s.ipToUsers[ipData.IP] = make(map[string]struct{})
+			view.put(user, ipData)
+		}
+		view.setLastSeen(user, userData.lastSeen())
+	}
+	if s.database() != nil {
+		// Users removed since the last write still hide their records in the
+		// database
+		for _, entry := range s.pending {
+			if _, exists := s.userData[entry.User]; !exists {
+				view.setLastSeen(entry.User, 0)
 			}
-			s.ipToUsers[ipData.IP][user] = struct{}{}
 		}
 	}
+	s.view.replace(&view)
+}
 
-	s.dirty = false
-	s.logger.Debug("Dirty flag set to false after loading from disk") // Debug log
-	return nil
+// linkIP records ipData as user's record of its IP in the reverse mapping and
+// the prefix index, replacing any previous one. Callers must hold s.mu.
+func (s *UserIPStorage) linkIP(user string, ipData IPData) {
+	s.view.put(user, ipData)
 }
 
-// migrateFromLegacyFormat converts old format data to new format
-func (s *UserIPStorage) migrateFromLegacyFormat(data []byte) error {
-	// Parse as legacy format
-	var legacyPD struct {
-		UserData map[string]*legacyUserData `json:"user_data"`
+// unlinkIP removes user from the users of ip, dropping ip from the reverse
+// mapping and the prefix index once no user is left. Callers must hold s.mu.
+func (s *UserIPStorage) unlinkIP(ip, user string) {
+	if s.view.remove(ip, user) {
+		s.logger.Debug("Removed IP from global tracking (no remaining users)", zap.String("ip", ip))
 	}
+}
 
-	if err := json.Unmarshal(data, &legacyPD); err != nil {
-		s.logger.Error("Failed to parse legacy format", zap.Error(err))
-		return err
+// startWriter starts the background writer. Callers must hold s.mu.
+func (s *UserIPStorage) startWriter() {
+	// Create the ticker before returning so that clock advances made by the
+	// caller are always observed by the writer
+	s.persistTicker = nil
+	if s.persistInterval > 0 {
+		s.persistTicker = s.clock.NewTicker(s.persistInterval)
 	}
+	s.stopPersist = make(chan struct{})
+	s.persistDone = make(chan struct{})
+	go s.writeLoop(s.persistTicker, s.stopPersist, s.persistDone)
+	s.startWatch()
+	s.scheduleSync()
+	s.scheduleSweep()
+	s.logger.Debug("Started background writer",
+		zap.String("store", s.name),
+		zap.Duration("persist_interval", s.persistInterval),
+		zap.Duration("flush_delay", s.flushDelay),
+		zap.Duration("new_ip_flush_delay", s.newIPFlushDelay),
+		zap.Duration("sync_interval", s.syncInterval),
+		zap.Duration("sweep_interval", s.sweepInterval))
+}
 
-	// Convert to new format
-	s.userData = make(map[string]*UserData)
-	for user, legacyData := range legacyPD.UserData {
-		// Convert legacy IP strings to IPData structs
-		newIPs := make([]IPData, len(legacyData.IPs))
-		for i, ip := range legacyData.IPs {
-			newIPs[i] = IPData{
-				IP:       ip,
-				LastSeen: legacyData.LastSeen, // Use the user's last seen for all IPs
-			}
-			if s.debugLogging {
-				newIPs[i].LastSeenISO = time.Unix(legacyData.LastSeen, 0).Format("2006-01-02T15:04:05-07:00")
-			}
-		}
+// startWatch starts watching the backend for changes made by others, if the
+// backend supports it, replacing any previous watch. Callers must hold s.mu.
+func (s *UserIPStorage) startWatch() {
+	s.stopWatching()
 
-		s.userData[user] = &UserData{
-			IPs: newIPs,
-			// Don't set LastSeen in new format as it's per-IP now
+	watcher, ok := s.backend.(Watcher)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWatch = cancel
+	backend := s.backend
+	go func() {
+		if err := watcher.Watch(ctx, s.requestSync); err != nil && ctx.Err() == nil {
+			s.logger.Error("Stopped watching backend for changes",
+				zap.String("store", s.name),
+				zap.Stringer("backend", backend),
+				zap.Error(err))
 		}
+	}()
+}
 
-		s.logger.Info("Migrated user data",
-			zap.String("user", user),
-			zap.Int("ip_count", len(newIPs)),
-			zap.Int64("legacy_last_seen", legacyData.LastSeen))
+// stopWatching stops watching the backend, if it is being watched. Callers
+// must hold s.mu.
+func (s *UserIPStorage) stopWatching() {
+	if s.stopWatch != nil {
+		s.stopWatch()
+		s.stopWatch = nil
 	}
-
-	// Mark as dirty to ensure the new format gets written
-	s.dirty = true
-	s.logger.Info("Migration complete, will write new format to disk",
-		zap.Int("migrated_users", len(s.userData)))
-
-	return nil
 }
 
-// PersistToDisk saves the user IP data to disk. If force is false, it only persists if data has changed.
-func (s *UserIPStorage) PersistToDisk(force bool) error {
+// Destruct implements caddy.Destructor. It is called once no loaded config
+// refers to the store anymore: it stops the background writer, waits for it to
+// exit, and performs a final persistence.
+func (s *UserIPStorage) Destruct() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Only persist if data has changed AND we are not forcing a write
-	if !s.dirty && !force {
-		return nil
+	stop, done := s.stopPersist, s.persistDone
+	s.stopPersist, s.persistDone = nil, nil
+	s.stopFlushTimer()
+	s.stopSyncTimer()
+	s.stopSweepTimer()
+	s.stopWatching()
+	configured := s.configured
+	s.mu.Unlock()
+
+	// The writer takes the lock to persist, so wait for it without holding it
+	if stop != nil {
+		close(stop)
+		<-done
+		s.logger.Debug("Stopped background writer", zap.String("store", s.name))
 	}
 
-	// Prepare the data to persist
-	pd := persistData{
-		UserData: s.userData,
+	if !configured {
+		return nil
 	}
 
-	// Convert to JSON
-	data, err := json.MarshalIndent(pd, "", "  ")
-	if err != nil {
+	// Perform final persistence on shutdown
+	s.logger.Info("Performing final persistence on shutdown", zap.String("store", s.name))
+	if err := s.Persist(true); err != nil {
+		s.logger.Error("Failed to perform final persistence on shutdown",
+			zap.String("store", s.name),
+			zap.Stringer("backend", s.backend),
+			zap.Error(err))
 		return err
 	}
+	s.logger.Info("Final persistence on shutdown complete", zap.String("store", s.name))
+	return nil
+}
+
+// writeLoop is the single goroutine that writes the store to its backend. It
+// flushes pending changes when asked to via flushCh, merges in the data saved
+// by other instances when asked to via syncCh, and saves the full state every
+// persistInterval, until stop is closed.
+func (s *UserIPStorage) writeLoop(ticker clockwork.Ticker, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	var tick <-chan time.Time
+	if ticker != nil {
+		defer ticker.Stop()
+		tick = ticker.Chan()
+	}
+
+	for {
+		select {
+		case <-s.flushCh:
+			if err := s.Persist(false); err != nil {
+				s.logger.Error("Failed to flush pending changes", zap.Error(err))
+			} else {
+				s.logger.Debug("Flushed pending changes")
+			}
+		case <-s.syncCh:
+			if err := s.Sync(); err != nil {
+				s.logger.Error("Failed to sync with the backend", zap.Error(err))
+			} else {
+				s.logger.Debug("Synced with the backend")
+			}
+		case <-tick:
+			if err := s.Persist(true); err != nil {
+				s.logger.Error("Failed to persist data periodically", zap.Error(err))
+			} else {
+				s.logger.Debug("Periodic persistence complete")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// minRetryDelay and maxRetryDelay bound the delay before a failed write is
+// retried, which doubles with each consecutive failure.
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// retryDelay returns the delay before retrying after failures consecutive
+// failed writes.
+func retryDelay(failures int) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// markDirty flags the data as changed and makes sure the writer flushes it no
+// later than delay from now. A pending flush is only ever brought forward, so
+// a stream of changes cannot postpone it indefinitely. Callers must hold s.mu.
+func (s *UserIPStorage) markDirty(delay time.Duration) {
+	s.dirty = true
+
+	if delay <= 0 {
+		s.stopFlushTimer()
+		s.requestFlush()
+		return
+	}
+
+	deadline := s.clock.Now().Add(delay)
+	if s.flushTimer != nil && !deadline.Before(s.flushDeadline) {
+		// An earlier flush is already scheduled and will include this change
+		return
+	}
+
+	s.stopFlushTimer()
+	s.flushDeadline = deadline
+	s.flushTimer = s.clock.AfterFunc(delay, s.requestFlush)
+}
+
+// requestFlush asks the writer to flush. Requests made while one is already
+// pending are coalesced into it.
+func (s *UserIPStorage) requestFlush() {
+	select {
+	case s.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// requestSync asks the writer to merge in the data saved in the backend.
+// Requests made while one is already pending are coalesced into it.
+func (s *UserIPStorage) requestSync() {
+	select {
+	case s.syncCh <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleSync schedules the next periodic sync, if enabled, replacing any
+// scheduled one. Callers must hold s.mu.
+func (s *UserIPStorage) scheduleSync() {
+	s.stopSyncTimer()
+	if s.syncInterval > 0 {
+		s.syncTimer = s.clock.AfterFunc(s.syncInterval, s.requestSync)
+	}
+}
+
+// stopSyncTimer cancels any scheduled sync. Callers must hold s.mu.
+func (s *UserIPStorage) stopSyncTimer() {
+	if s.syncTimer != nil {
+		s.syncTimer.Stop()
+		s.syncTimer = nil
+	}
+}
+
+// scheduleSweep schedules the next expiry sweep, if a TTL is set, replacing
+// any scheduled one. Callers must hold s.mu.
+func (s *UserIPStorage) scheduleSweep() {
+	s.stopSweepTimer()
+	if s.sweepInterval > 0 && (s.userDataTTL > 0 || s.ipTTL > 0) {
+		s.sweepTimer = s.clock.AfterFunc(s.sweepInterval, s.sweep)
+	}
+}
+
+// stopSweepTimer cancels any scheduled sweep. Callers must hold s.mu.
+func (s *UserIPStorage) stopSweepTimer() {
+	if s.sweepTimer != nil {
+		s.sweepTimer.Stop()
+		s.sweepTimer = nil
+	}
+}
+
+// sweep removes the expired users and IPs and schedules the next sweep. It
+// runs on its own, so that entries expire even if no new IP is ever seen.
+func (s *UserIPStorage) sweep() {
+	// With the cache turned off, the users that expired are found in the
+	// database first, without holding s.mu
+	s.mu.RLock()
+	cfg := s.storageConfig
+	s.mu.RUnlock()
+	var expired []string
+	if database := cfg.database(); database != nil {
+		now := s.clock.Now().Unix()
+		err := database.forEachUser(func(user string, userData *UserData) bool {
+			if at, ok := cfg.expiresAt(userData); ok && at < now {
+				expired = append(expired, user)
+			}
+			return true
+		})
+		if err != nil {
+			s.logger.Error("Failed to read users from the database",
+				zap.String("store", s.name),
+				zap.Stringer("backend", database),
+				zap.Error(err))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopPersist == nil {
+		// The store was destroyed after the timer fired
+		return
+	}
+	s.scheduleSweep()
+	s.logger.Debug("Sweeping expired entries", zap.String("store", s.name))
+	for _, user := range expired {
+		// Puts the user in the expiry heap, to be removed below
+		if _, _, err := s.loadUser(user); err != nil {
+			s.logger.Error("Failed to read user from the database",
+				zap.String("store", s.name),
+				zap.String("user", user),
+				zap.Error(err))
+		}
+	}
+	s.cleanupExpiredUsers()
+}
+
+// stopFlushTimer cancels any scheduled flush. Callers must hold s.mu.
+func (s *UserIPStorage) stopFlushTimer() {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+}
+
+// AddUserIP adds an IP address for a user, maintaining the FIFO limit.
+// Returns true if the IP was newly added (not already in the user's list).
+// With the bolt backend, a new IP is written to the database before it
+// returns, while an IP seen again is written with the next flush.
+func (s *UserIPStorage) AddUserIP(email, ip string) bool {
+	added, backend := s.addUserIP(email, ip)
+	if added {
+		s.writeThrough(backend)
+	}
+	return added
+}
+
+// addUserIP implements AddUserIP, and also returns the backend to write the
+// change to.
+func (s *UserIPStorage) addUserIP(email, ip string) (bool, Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Store the canonical form, so that equivalent spellings share one entry
+	canonicalIP, ok := normalizeIP(ip)
+	if !ok {
+		s.logger.Warn("Ignoring invalid IP address", zap.String("user", email), zap.String("ip", ip))
+		return false, s.backend
+	}
+	ip = canonicalIP
+
+	now := s.clock.Now().Unix()
+	nowISO := ""
+	if s.debugLogging {
+		nowISO = s.clock.Now().Format("2006-01-02T15:04:05-07:00")
+	}
+
+	// Get or create user data
+	userData, exists, err := s.loadUser(email)
+	if err != nil {
+		s.logger.Error("Failed to read user from the database, not tracking IP",
+			zap.String("user", email),
+			zap.String("ip", ip),
+			zap.Error(err))
+		return false, s.backend
+	}
+	if !exists {
+		// Create new user data
+		userData = &UserData{
+			IPs: []IPData{},
+		}
+		s.userData[email] = userData
+		s.logger.Info("Created new user entry", zap.String("user", email), zap.String("ip", ip))
+	} else {
+		// Check if this user already has this IP in their list
+		foundIndex := -1
+		for i, ipData := range userData.IPs {
+			if ipData.IP == ip {
+				foundIndex = i
+				break
+			}
+		}
+
+		if foundIndex != -1 {
+			// IP already exists for this user, update timestamp and move to front if needed
+			ipData := userData.IPs[foundIndex]
+			ipData.LastSeen = now
+			if s.debugLogging {
+				ipData.LastSeenISO = nowISO
+			}
+
+			if foundIndex > 0 {
+				// IP is not the most recent, move it to the front (MRU)
+				// Remove the IP from its current position
+				userData.IPs = append(userData.IPs[:foundIndex], userData.IPs[foundIndex+1:]...)
+				// Prepend the IP to the front
+				userData.IPs = append([]IPData{ipData}, userData.IPs...)
+
+				s.logger.Debug("Moved existing IP to front (MRU)", zap.String("user", email), zap.String("ip", ip))
+			} else {
+				// Update the first entry in place (timestamp changed)
+				userData.IPs[0] = ipData
+			}
+			// Only the order or timestamps changed, so the write can wait
+			s.linkIP(email, ipData)
+			s.logChange(journalBump, email, ipData)
+			s.refreshUser(email)
+			s.markDirty(s.flushDelay)
+			metrics.bumps.WithLabelValues(s.name).Inc()
+			return false, s.backend // No new IP was added
+		}
+	}
+
+	// Create new IP data entry
+	newIPData := IPData{
+		IP:        ip,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	if s.debugLogging {
+		newIPData.LastSeenISO = nowISO
+	}
+
+	// Add IP to user's list (prepend to maintain newest-first order)
+	userData.IPs = append([]IPData{newIPData}, userData.IPs...)
+
+	// Trim list if it exceeds the maximum and log evicted IP
+	if uint64(len(userData.IPs)) > s.maxIPsPerUser {
+		// Get the IP that's being removed (last in the list)
+		removedIPData := userData.IPs[s.maxIPsPerUser]
+		removedIP := removedIPData.IP
+
+		// Log the eviction
+		s.logger.Info("Evicting oldest IP for user",
+			zap.String("user", email),
+			zap.String("evicted_ip", removedIP),
+			zap.Int64("evicted_ip_last_seen", removedIPData.LastSeen),
+			zap.String("new_ip", ip))
+
+		// Trim the list
+		userData.IPs = userData.IPs[:s.maxIPsPerUser]
+		metrics.evictions.WithLabelValues(s.name).Inc()
+
+		// Update the reverse mapping
+		s.unlinkIP(removedIP, email)
+		s.logChange(journalEvict, email, IPData{IP: removedIP})
+	}
+
+	// Update the reverse mapping for the new IP
+	s.linkIP(email, newIPData)
+	s.refreshUser(email)
+	s.logChange(journalAdd, email, newIPData)
+
+	// Mark as dirty and flush soon, since new IPs change what the matcher accepts
+	s.markDirty(s.newIPFlushDelay)
+	metrics.additions.WithLabelValues(s.name).Inc()
+	s.logger.Info("Added new IP for user", zap.String("user", email), zap.String("ip", ip))
+
+	// Clean up expired users and IPs if a TTL is set
+	if s.userDataTTL > 0 || s.ipTTL > 0 {
+		s.cleanupExpiredUsers()
+	}
+
+	return true, s.backend
+}
+
+// HasIP checks if the given IP address belongs to any user.
+func (s *UserIPStorage) HasIP(ip string) bool {
+	ip, ok := normalizeIP(ip)
+	if !ok {
+		return false
+	}
+	return s.view.has(ip)
+}
+
+// GetUsersForIP returns all users associated with a given IP.
+func (s *UserIPStorage) GetUsersForIP(ip string) []string {
+	ip, ok := normalizeIP(ip)
+	if !ok {
+		return make([]string, 0)
+	}
+	return s.view.users(ip)
+}
+
+// UserIPEntry is one user's record of a tracked IP.
+type UserIPEntry struct {
+	User string
+	IPData
+}
+
+// GetEntriesInNetwork returns every user's record of the tracked IPs in the
+// same network as ip, where the network is ip masked to v4Bits or v6Bits
+// depending on its family. A length of 0 for the family means only records of
+// ip itself are returned. Records that have expired are left out, whether or
+// not they were swept yet. It does not wait for writers, even while they save
+// the data.
+func (s *UserIPStorage) GetEntriesInNetwork(ip string, v4Bits, v6Bits int) []UserIPEntry {
+	addr, ok := parseHeaderIP(ip)
+	if !ok {
+		return nil
+	}
+	prefixBits := v6Bits
+	if addr.Is4() {
+		prefixBits = v4Bits
+	}
+	return s.view.entriesInNetwork(addr, prefixBits)
+}
+
+// GetIPsForUser returns all IPs associated with a given user.
+func (s *UserIPStorage) GetIPsForUser(email string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if userData, exists := s.user(email); exists {
+		// Extract IP strings from IPData structs
+		result := make([]string, len(userData.IPs))
+		for i, ipData := range userData.IPs {
+			result[i] = ipData.IP
+		}
+		return result
+	}
+	return []string{}
+}
+
+// GetUsers returns a copy of the data of all users. With the cache turned
+// off, they are read from the database.
+func (s *UserIPStorage) GetUsers() map[string]*UserData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make(map[string]*UserData, len(s.userData))
+	if database := s.database(); database != nil {
+		err := database.forEachUser(func(user string, userData *UserData) bool {
+			// The data in memory is newer, including that of users removed
+			// since
+			if !s.view.knows(user) {
+				users[user] = userData
+			}
+			return true
+		})
+		if err != nil {
+			s.logger.Error("Failed to read users from the database",
+				zap.String("store", s.name),
+				zap.Stringer("backend", database),
+				zap.Error(err))
+		}
+	}
+	for email, userData := range s.userData {
+		users[email] = userData.clone()
+	}
+	return users
+}
+
+// GetUser returns a copy of the data of a single user.
+func (s *UserIPStorage) GetUser(email string) (*UserData, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userData, exists := s.user(email)
+	if !exists {
+		return nil, false
+	}
+	return userData.clone(), true
+}
+
+// RemoveUser removes a user and all of their IPs.
+// Returns true if the user existed. With the bolt backend, the removal is
+// written to the database before it returns.
+func (s *UserIPStorage) RemoveUser(email string) bool {
+	removed, backend := s.removeUser(email)
+	if removed {
+		s.writeThrough(backend)
+	}
+	return removed
+}
+
+// removeUser implements RemoveUser, and also returns the backend to write the
+// change to.
+func (s *UserIPStorage) removeUser(email string) (bool, Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userData, exists, err := s.loadUser(email)
+	if err != nil {
+		s.logger.Error("Failed to read user from the database", zap.String("user", email), zap.Error(err))
+		return false, s.backend
+	}
+	if !exists {
+		return false, s.backend
+	}
+	for _, ipData := range userData.IPs {
+		s.unlinkIP(ipData.IP, email)
+	}
+	s.dropUser(email)
+	s.recordRemoval(email, removedAll, s.clock.Now().Unix())
+	s.logChange(journalRemove, email, IPData{})
+
+	s.markDirty(s.newIPFlushDelay)
+	s.logger.Info("Removed user", zap.String("user", email), zap.Int("ip_count", len(userData.IPs)))
+	return true, s.backend
+}
+
+// RemoveUserIP removes a single IP from a user, removing the user once they
+// have no IPs left. Returns true if the user had the IP. With the bolt
+// backend, the removal is written to the database before it returns.
+func (s *UserIPStorage) RemoveUserIP(email, ip string) bool {
+	removed, backend := s.removeUserIP(email, ip)
+	if removed {
+		s.writeThrough(backend)
+	}
+	return removed
+}
+
+// removeUserIP implements RemoveUserIP, and also returns the backend to write
+// the change to.
+func (s *UserIPStorage) removeUserIP(email, ip string) (bool, Backend) {
+	ip, ok := normalizeIP(ip)
+	if !ok {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userData, exists, err := s.loadUser(email)
+	if err != nil {
+		s.logger.Error("Failed to read user from the database", zap.String("user", email), zap.Error(err))
+		return false, s.backend
+	}
+	if !exists {
+		return false, s.backend
+	}
+	index := slices.IndexFunc(userData.IPs, func(ipData IPData) bool { return ipData.IP == ip })
+	if index == -1 {
+		return false, s.backend
+	}
+	userData.IPs = slices.Delete(userData.IPs, index, index+1)
+	s.unlinkIP(ip, email)
+	if len(userData.IPs) == 0 {
+		s.dropUser(email)
+	} else {
+		s.refreshUser(email)
+	}
+	s.recordRemoval(email, ip, s.clock.Now().Unix())
+	s.logChange(journalRemove, email, IPData{IP: ip})
+
+	s.markDirty(s.newIPFlushDelay)
+	s.logger.Info("Removed IP for user", zap.String("user", email), zap.String("ip", ip))
+	return true, s.backend
+}
+
+// writeThrough writes the changes just made to backend at once if it is a
+// database, where a change costs a transaction of its own rather than a
+// rewrite of the whole file, instead of leaving them to the writer. A write
+// that fails is retried by the writer. Callers must not hold s.mu.
+func (s *UserIPStorage) writeThrough(backend Backend) {
+	if _, ok := backend.(recordBackend); !ok {
+		return
+	}
+	if err := s.Persist(false); err != nil {
+		s.logger.Error("Failed to write change to the database",
+			zap.String("store", s.name),
+			zap.Stringer("backend", backend),
+			zap.Error(err))
+	}
+}
+
+// user returns the data of email, read from the database if the cache is
+// turned off and it is not in memory. The data must not be changed. Callers
+// must hold s.mu.
+func (s *UserIPStorage) user(email string) (*UserData, bool) {
+	if userData, exists := s.userData[email]; exists {
+		return userData, true
+	}
+	database := s.database()
+	if database == nil || s.view.knows(email) {
+		// Not tracked, or removed without the database knowing yet
+		return nil, false
+	}
+	userData, exists, err := database.user(email)
+	if err != nil {
+		s.logger.Error("Failed to read user from the database",
+			zap.String("store", s.name),
+			zap.String("user", email),
+			zap.Error(err))
+		return nil, false
+	}
+	return userData, exists
+}
+
+// loadUser returns the data of email to change it, reading it from the
+// database into memory if the cache is turned off and it is not there yet.
+// Callers must hold s.mu.
+func (s *UserIPStorage) loadUser(email string) (*UserData, bool, error) {
+	if userData, exists := s.userData[email]; exists {
+		return userData, true, nil
+	}
+	database := s.database()
+	if database == nil || s.view.knows(email) {
+		return nil, false, nil
+	}
+	userData, exists, err := database.user(email)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	s.cacheUser(email, userData)
+	return userData, true, nil
+}
+
+// cacheUser puts userData, read from the database, into memory as the data
+// of email. Callers must hold s.mu.
+func (s *UserIPStorage) cacheUser(email string, userData *UserData) {
+	s.userData[email] = userData
+	// The records are in the view before the user is, so that lookups find
+	// them in one or the other meanwhile
+	for _, ipData := range userData.IPs {
+		s.linkIP(email, ipData)
+	}
+	s.refreshUser(email)
+}
+
+// fillCache reads the users left in the database into memory, if the cache is
+// turned off, for changes that need every user. Callers must hold s.mu.
+func (s *UserIPStorage) fillCache() error {
+	database := s.database()
+	if database == nil {
+		return nil
+	}
+	return database.forEachUser(func(user string, userData *UserData) bool {
+		if _, cached := s.userData[user]; !cached && !s.view.knows(user) {
+			s.cacheUser(user, userData)
+		}
+		return true
+	})
+}
+
+// evictCache drops the users without pending changes from memory, if the
+// cache is turned off, as the database holds their data. written are the
+// changes just written to it, whose users are dropped even if they were
+// removed. Callers must hold s.mu.
+func (s *UserIPStorage) evictCache(written []journalEntry) {
+	if s.database() == nil {
+		return
+	}
+	pendingUsers := make(map[string]bool)
+	for _, entry := range s.pending {
+		pendingUsers[entry.User] = true
+	}
+	for user, userData := range s.userData {
+		if pendingUsers[user] {
+			continue
+		}
+		// The user leaves the view before their records do, so that lookups
+		// find them in one or the other meanwhile
+		s.view.forget(user)
+		for _, ipData := range userData.IPs {
+			s.unlinkIP(ipData.IP, user)
+		}
+		delete(s.userData, user)
+		s.refreshUser(user)
+	}
+	for _, entry := range written {
+		if !pendingUsers[entry.User] {
+			s.view.forget(entry.User)
+		}
+	}
+}
+
+// dropUser removes email, who has no IPs left, from memory. With the cache
+// turned off, the user stays in the view without records until the change
+// is written, hiding their records in the database. Callers must hold s.mu.
+func (s *UserIPStorage) dropUser(email string) {
+	delete(s.userData, email)
+	if s.database() == nil {
+		s.refreshUser(email)
+		return
+	}
+	s.expiry.Remove(email)
+	s.view.setLastSeen(email, 0)
+}
+
+// removedAll is the IP under which the removal of a whole user is recorded.
+const removedAll = "*"
+
+// recordRemoval records that the IPs of user last seen no later than at were
+// removed, either ip or, for removedAll, all of them. Returns true if this is
+// later than any removal recorded before. Callers must hold s.mu.
+func (s *UserIPStorage) recordRemoval(user, ip string, at int64) bool {
+	if s.removed[user] == nil {
+		s.removed[user] = make(map[string]int64)
+	}
+	if previous, exists := s.removed[user][ip]; !exists || at > previous {
+		s.removed[user][ip] = at
+		return true
+	}
+	return false
+}
+
+// isRemoved returns true if ipData of user was removed, rather than seen again
+// after the removal. A removal wins over a sighting in the same second.
+// Callers must hold s.mu.
+func (s *UserIPStorage) isRemoved(user string, ipData IPData) bool {
+	for _, ip := range []string{removedAll, ipData.IP} {
+		if at, exists := s.removed[user][ip]; exists && ipData.LastSeen <= at {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneRemovals forgets removals older than removalRetention, or than a TTL
+// that is shorter, since any IP they could hide has expired by then. Callers
+// must hold s.mu.
+func (s *UserIPStorage) pruneRemovals() {
+	retention := int64(s.removalRetention / time.Second)
+	for _, ttl := range []uint64{s.userDataTTL, s.ipTTL} {
+		if ttl > 0 && (retention <= 0 || int64(ttl) < retention) {
+			retention = int64(ttl)
+		}
+	}
+	if retention <= 0 {
+		return
+	}
+	expireTime := s.clock.Now().Unix() - retention
+	for user, ips := range s.removed {
+		for ip, at := range ips {
+			if at < expireTime {
+				delete(ips, ip)
+				journalIP := ip
+				if ip == removedAll {
+					journalIP = ""
+				}
+				s.logChange(journalForget, user, IPData{IP: journalIP, LastSeen: at})
+			}
+		}
+		if len(ips) == 0 {
+			delete(s.removed, user)
+		}
+	}
+}
+
+// clone returns a deep copy of the user data.
+func (u *UserData) clone() *UserData {
+	return &UserData{
+		IPs:      slices.Clone(u.IPs),
+		LastSeen: u.LastSeen,
+	}
+}
+
+// persistData represents the structure of the data to be persisted.
+type persistData struct {
+	// Format version of the data, persistVersion when written by this module
+	Version int `json:"version"`
+
+	UserData map[string]*UserData `json:"user_data"`
+	// We don't need to persist the reverse mapping as it can be reconstructed
+
+	// Removals, so that other instances sharing the backend apply them too
+	Removed map[string]map[string]int64 `json:"removed,omitempty"`
+}
+
+// Load loads the user IP data from the backend, and replays the journal on
+// top of it if there is one. Users and IPs that expired while the data was
+// saved are not loaded. Unless strictLoad is set, data that is corrupt is set
+// aside and replaced with its newest readable backup, and a corrupt journal is
+// set aside once the entries before the corrupt one are replayed. With the
+// cache turned off, the users are left in the database, and only the removals
+// are read.
+func (s *UserIPStorage) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pd persistData
+	var rewrite bool
+	var err error
+	if database := s.database(); database != nil {
+		// The users stay in the database, so only the removals are read
+		pd.Removed, err = database.removals()
+	} else {
+		pd, rewrite, err = s.readBackend(s.backend)
+		if errors.Is(err, errCorrupt) && !s.strictLoad {
+			pd, err = s.recoverCorrupt(err)
+			rewrite = true
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if s.journal != nil {
+		// Apply the changes made since the last full save
+		count, torn, err := s.journal.Replay(pd.apply)
+		if errors.Is(err, errCorrupt) && !s.strictLoad {
+			err = s.quarantineJournal(err)
+			rewrite = true
+		}
+		if err != nil {
+			s.logger.Error("Error replaying journal", zap.Stringer("journal", s.journal), zap.Error(err))
+			return err
+		}
+		if torn {
+			s.logger.Warn("Dropped the torn last entry of the journal, left by an interrupted write",
+				zap.Stringer("journal", s.journal))
+		}
+		s.logger.Debug("Replayed journal", zap.Stringer("journal", s.journal), zap.Int("entries", count))
+	}
+	s.mergeData(pd)
+
+	s.dirty = false
+	s.logger.Debug("Dirty flag set to false after loading persisted data") // Debug log
+	if rewrite {
+		// Write the migrated or recovered data back, so the saved data is in the
+		// current format and readable again
+		s.fullSave = true
+		s.markDirty(0)
+	}
+	return nil
+}
+
+// errCorrupt is wrapped by the errors returned for saved data that cannot be
+// decoded, as opposed to data that cannot be read at all.
+var errCorrupt = errors.New("persisted data is corrupt")
+
+// recoverCorrupt moves the data saved in the backend, which readErr reported
+// as corrupt, aside under a .corrupt-<timestamp> suffix, and returns the data
+// of the newest backup that can be read instead, or no data if there is none.
+// Callers must hold s.mu.
+func (s *UserIPStorage) recoverCorrupt(readErr error) (persistData, error) {
+	backend, ok := s.backend.(quarantineBackend)
+	if !ok {
+		return persistData{}, readErr
+	}
+	ctx := context.Background()
+	suffix := ".corrupt-" + s.clock.Now().UTC().Format("20060102T150405Z")
+	quarantined, err := backend.Quarantine(ctx, suffix)
+	if err != nil {
+		return persistData{}, fmt.Errorf("%v, and it could not be moved aside: %v", readErr, err)
+	}
+	s.logger.Error("Persisted user IP data is corrupt, moved it aside",
+		zap.String("store", s.name),
+		zap.Stringer("backend", s.backend),
+		zap.String("quarantined_to", quarantined),
+		zap.Error(readErr))
+
+	for _, backup := range backend.Backups(ctx) {
+		pd, _, err := s.readBackend(backup)
+		if err != nil {
+			s.logger.Error("Backup of user IP data cannot be read either",
+				zap.String("store", s.name),
+				zap.Stringer("backup", backup),
+				zap.Error(err))
+			continue
+		}
+		s.logger.Error("Recovered user IP data from backup; changes saved after it are lost",
+			zap.String("store", s.name),
+			zap.Stringer("backup", backup),
+			zap.Int("user_count", len(pd.UserData)))
+		return pd, nil
+	}
+	s.logger.Error("No readable backup of user IP data, starting without the saved data",
+		zap.String("store", s.name),
+		zap.Stringer("backend", s.backend))
+	return persistData{}, nil
+}
+
+// quarantineJournal moves the journal, which replayErr reported as corrupt,
+// aside under a .corrupt-<timestamp> suffix. The entries before the corrupt
+// one have been replayed; those after it are lost, but kept in the moved file.
+// Callers must hold s.mu.
+func (s *UserIPStorage) quarantineJournal(replayErr error) error {
+	suffix := ".corrupt-" + s.clock.Now().UTC().Format("20060102T150405Z")
+	quarantined, err := s.journal.Quarantine(suffix)
+	if err != nil {
+		return fmt.Errorf("%v, and it could not be moved aside: %v", replayErr, err)
+	}
+	s.logger.Error("Journal is corrupt, moved it aside; changes recorded after the corrupt entry are lost",
+		zap.String("store", s.name),
+		zap.Stringer("journal", s.journal),
+		zap.String("quarantined_to", quarantined),
+		zap.Error(replayErr))
+	return nil
+}
+
+// Sync merges the data saved in the backend, which may have been changed by
+// other instances sharing it, into the data in memory, and schedules the next
+// periodic sync.
+func (s *UserIPStorage) Sync() error {
+	s.mu.Lock()
+	s.scheduleSync()
+	backend := s.backend
+	s.mu.Unlock()
+
+	// Read without holding the lock, so that tracking carries on meanwhile
+	pd, _, err := s.readBackend(backend)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mergeData(pd)
+	return nil
+}
 
-	// Write to a temporary file first
-	tempFile := s.persistPath + ".tmp"
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+// Import merges the data of the JSON file at path, as saved by the file
+// backend, into the store and saves the result in full to its bolt backend,
+// which records the import so that it is only done once. Returns false if the
+// file was imported before. The store's data must have been loaded.
+func (s *UserIPStorage) Import(path string) (bool, error) {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.importFile(path)
+}
+
+// importFile implements Import. Callers must hold s.persistMu and s.mu.
+func (s *UserIPStorage) importFile(path string) (bool, error) {
+	backend, ok := s.backend.(*boltBackend)
+	if !ok {
+		return false, fmt.Errorf("importing %s: the %s backend is not in use", path, backendBolt)
+	}
+	if done, err := backend.imported(path); err != nil || done {
+		return false, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+
+	pd, _, err := s.readBackend(&fileBackend{path: path})
+	if err != nil {
+		return false, fmt.Errorf("importing %s: %v", path, err)
+	}
+	// The data is written in full, so with the cache turned off, the users in
+	// the database are read first
+	if err := s.fillCache(); err != nil {
+		return false, fmt.Errorf("importing %s: %v", path, err)
+	}
+	s.mergeData(pd)
+	if err := s.write(backend, s.snapshot()); err != nil {
+		return false, fmt.Errorf("importing %s: %v", path, err)
+	}
+	s.markSaved()
+	s.evictCache(nil)
+
+	if err := backend.markImported(path, s.clock.Now().Unix()); err != nil {
+		return true, err
+	}
+	s.logger.Info("Imported user IP data",
+		zap.String("store", s.name),
+		zap.String("path", path),
+		zap.Stringer("backend", backend),
+		zap.Int("user_count", len(pd.UserData)))
+	return true, nil
+}
+
+// readBackend reads and decodes the data saved in backend, which is empty if
+// nothing was saved yet. Returns true if the saved data was written by an
+// older version, or is not encrypted with the current key, and should be
+// rewritten, an error wrapping errNewerVersion if
+// it was written by a newer one, and an error wrapping errCorrupt if it cannot
+// be decoded. It does not touch the data in
+// memory, so callers need not hold s.mu.
+func (s *UserIPStorage) readBackend(backend Backend) (persistData, bool, error) {
+	if records, ok := backend.(recordBackend); ok {
+		// The records are always in the current format
+		pd, err := records.Records(context.Background())
+		if err != nil {
+			s.logger.Error("Error loading persisted data", zap.Stringer("backend", backend), zap.Error(err))
+			return persistData{}, false, err
+		}
+		return pd, s.normalizeLoadedIPs(pd.UserData), nil
+	}
+	data, reseal, err := s.loadBackend(backend)
+	if err != nil || data == nil {
+		return persistData{}, false, err
+	}
+	return s.decodeData(backend, data, reseal)
+}
+
+// loadBackend reads the data saved in backend, decrypted if need be, which is
+// nil if nothing was saved yet. Returns true if the data is not encrypted with
+// the current key.
+func (s *UserIPStorage) loadBackend(backend Backend) ([]byte, bool, error) {
+	s.logger.Debug("Attempting to load data", zap.Stringer("backend", backend))
+	var data []byte
+	var reseal bool
+	var err error
+	if sealed, ok := backend.(*encryptedBackend); ok {
+		data, reseal, err = sealed.open(context.Background())
+	} else {
+		data, err = backend.Load(context.Background())
+	}
+	if err != nil {
+		s.logger.Error("Error loading persisted data", zap.Stringer("backend", backend), zap.Error(err))
+		return nil, false, err
+	}
+	if data == nil {
+		// Nothing was saved yet, nothing to load
+		s.logger.Debug("No persisted data found", zap.Stringer("backend", backend))
+		return nil, false, nil
+	}
+	s.logger.Debug("Successfully loaded persisted data", zap.Stringer("backend", backend), zap.Int("bytes_read", len(data)))
+	return data, reseal, nil
+}
+
+// decodeData decodes data read from backend, as described for readBackend.
+func (s *UserIPStorage) decodeData(backend Backend, data []byte, reseal bool) (persistData, bool, error) {
+	// Bring data written in an older format up to date
+	data, migrated, err := s.migrate(backend, data)
+	if err != nil {
+		return persistData{}, false, err
+	}
+
+	var pd persistData
+	if err := json.Unmarshal(data, &pd); err != nil {
+		s.logger.Error("Error unmarshalling persistence data", zap.Stringer("backend", backend), zap.Error(err))
+		return persistData{}, false, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	s.logger.Debug("Decoded persisted data", zap.Int("user_count", len(pd.UserData)), zap.Stringer("backend", backend))
+
+	// Bring addresses written by older versions into canonical form
+	normalized := s.normalizeLoadedIPs(pd.UserData)
+	if normalized {
+		s.logger.Info("Normalized IP addresses in persisted data", zap.Stringer("backend", backend))
+	}
+
+	if reseal {
+		s.logger.Info("Persisted data is not encrypted with the current key, will encrypt it with it", zap.Stringer("backend", backend))
+	}
+
+	return pd, migrated || normalized || reseal, nil
+}
+
+// mergeData merges data saved by any instance sharing the backend into the
+// data in memory. Every user keeps the union of the IPs recorded on either
+// side, an IP recorded on both keeps the newest last_seen, and the list is then
+// ordered most recently seen first and cut to maxIPsPerUser. IPs removed
+// through RemoveUser or RemoveUserIP on either side are not brought back.
+// Only the users whose IPs or removals pd changes are visited again, so a
+// merge that brings little new costs little more than reading pd.
+// Callers must hold s.mu.
+func (s *UserIPStorage) mergeData(pd persistData) {
+	touched := make(map[string]bool)
+	for user, ips := range pd.Removed {
+		for ip, at := range ips {
+			if s.recordRemoval(user, ip, at) {
+				touched[user] = true
+			}
+		}
+	}
+	for user, remote := range pd.UserData {
+		if local, exists := s.userData[user]; !exists || !coversIPs(local.IPs, remote.IPs) {
+			touched[user] = true
+		}
+	}
+
+	for user := range touched {
+		s.mergeUser(user, pd.UserData[user])
+	}
+
+	s.removeExpired()
+	s.pruneRemovals()
+}
+
+// mergeUser merges remote, the IPs saved for user, if any, into the user's
+// IPs in memory, drops those removed or expired, and updates the reverse
+// mapping and the expiry heap to match. Callers must hold s.mu.
+func (s *UserIPStorage) mergeUser(user string, remote *UserData) {
+	var before, ips []IPData
+	if local, exists := s.userData[user]; exists {
+		before = local.IPs
+		if remote != nil {
+			ips = mergeIPLists(local.IPs, remote.IPs)
+		} else {
+			ips = slices.Clone(local.IPs)
+		}
+	} else if remote != nil && !s.isExpired(remote) {
+		ips = slices.Clone(remote.IPs)
+	}
+
+	ips = slices.DeleteFunc(ips, func(ipData IPData) bool {
+		return s.isRemoved(user, ipData) || s.isIPExpired(ipData)
+	})
+	// Stable, so that IPs seen in the same second keep their MRU order
+	slices.SortStableFunc(ips, func(a, b IPData) int {
+		return cmp.Compare(b.LastSeen, a.LastSeen)
+	})
+	if uint64(len(ips)) > s.maxIPsPerUser {
+		ips = ips[:s.maxIPsPerUser]
+	}
+
+	for _, ipData := range before {
+		if !slices.ContainsFunc(ips, func(kept IPData) bool { return kept.IP == ipData.IP }) {
+			s.unlinkIP(ipData.IP, user)
+		}
+	}
+	for _, ipData := range ips {
+		s.linkIP(user, ipData)
+	}
+	if len(ips) == 0 {
+		delete(s.userData, user)
+	} else if local, exists := s.userData[user]; exists {
+		local.IPs = ips
+	} else {
+		s.userData[user] = &UserData{IPs: ips}
+	}
+	s.refreshUser(user)
+}
+
+// coversIPs returns true if local already holds every IP of remote, seen at
+// least as recently, so that merging remote into it changes nothing.
+func coversIPs(local, remote []IPData) bool {
+	for _, remoteIPData := range remote {
+		index := slices.IndexFunc(local, func(ipData IPData) bool { return ipData.IP == remoteIPData.IP })
+		if index == -1 || local[index].LastSeen < remoteIPData.LastSeen ||
+			(remoteIPData.FirstSeen != 0 && (local[index].FirstSeen == 0 || remoteIPData.FirstSeen < local[index].FirstSeen)) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeIPLists returns the union of local and remote, in the order of local
+// followed by the IPs only in remote. IPs in both are combined by mergeIPData.
+func mergeIPLists(local, remote []IPData) []IPData {
+	merged := slices.Clone(local)
+	for _, remoteIPData := range remote {
+		index := slices.IndexFunc(merged, func(ipData IPData) bool { return ipData.IP == remoteIPData.IP })
+		if index == -1 {
+			merged = append(merged, remoteIPData)
+			continue
+		}
+		mergeIPData(&merged[index], remoteIPData)
+	}
+	return merged
+}
+
+// mergeIPData combines two records of the same IP into ipData, keeping the
+// latest last_seen and the earliest known first_seen.
+func mergeIPData(ipData *IPData, other IPData) {
+	if other.LastSeen > ipData.LastSeen {
+		ipData.LastSeen = other.LastSeen
+		ipData.LastSeenISO = other.LastSeenISO
+	}
+	if other.FirstSeen != 0 && (ipData.FirstSeen == 0 || other.FirstSeen < ipData.FirstSeen) {
+		ipData.FirstSeen = other.FirstSeen
+	}
+}
+
+// normalizeLoadedIPs rewrites every stored IP into the form produced by
+// normalizeIP, dropping values that are not IP addresses and merging entries
+// that turn out to be the same address. The merged entry keeps the position of
+// its most recent spelling and the latest last_seen. Returns true if anything
+// changed.
+func (s *UserIPStorage) normalizeLoadedIPs(users map[string]*UserData) bool {
+	changed := false
+	for user, userData := range users {
+		ips := make([]IPData, 0, len(userData.IPs))
+		seen := make(map[string]int, len(userData.IPs))
+		for _, ipData := range userData.IPs {
+			canonicalIP, ok := normalizeIP(ipData.IP)
+			if !ok {
+				s.logger.Warn("Dropping invalid IP address from persisted data",
+					zap.String("user", user),
+					zap.String("ip", ipData.IP))
+				changed = true
+				continue
+			}
+			if canonicalIP != ipData.IP {
+				changed = true
+				ipData.IP = canonicalIP
+			}
+			if i, exists := seen[canonicalIP]; exists {
+				// Lists are newest-first, so the entry already kept is the most recent
+				mergeIPData(&ips[i], ipData)
+				changed = true
+				continue
+			}
+			seen[canonicalIP] = len(ips)
+			ips = append(ips, ipData)
+		}
+		if len(ips) == 0 && len(userData.IPs) > 0 {
+			// Every address of this user was invalid
+			delete(users, user)
+			continue
+		}
+		userData.IPs = ips
+	}
+	return changed
+}
+
+// Persist saves the user IP data to the backend. If force is false, it only persists if data has changed.
+// If the write fails, the changes stay pending and the writer retries them
+// after a delay that doubles with each consecutive failure.
+func (s *UserIPStorage) Persist(force bool) error {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	err := s.persist(force)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// The changes are still dirty, and nothing else may come along to
+		// flush them
+		s.failedWrites++
+		s.markDirty(max(s.newIPFlushDelay, retryDelay(s.failedWrites)))
+	} else {
+		s.failedWrites = 0
+	}
+	return err
+}
+
+// persist implements Persist. Callers must hold s.persistMu but not s.mu.
+func (s *UserIPStorage) persist(force bool) error {
+	s.mu.RLock()
+	dirty, backend, journal := s.dirty, s.backend, s.journal
+	s.mu.RUnlock()
+
+	if journal != nil {
+		return s.persistJournal(journal, backend)
+	}
+	if records, ok := backend.(recordBackend); ok {
+		return s.persistRecords(records)
+	}
+
+	// Only persist if data has changed AND we are not forcing a write
+	if !dirty && !force {
+		return nil
+	}
+	return s.save(backend)
+}
+
+// persistJournal appends the pending changes to the journal. Once the journal
+// is due for compaction, or the data changed in a way the journal does not
+// record (e.g. it was migrated on load), the data is saved in full instead and
+// the journal is emptied. Callers must hold s.persistMu but not s.mu.
+func (s *UserIPStorage) persistJournal(j *journal, backend Backend) error {
+	s.mu.Lock()
+	entries := s.takePending()
+	due := s.fullSave || j.Due(s.clock.Now().Unix(), s.journalMaxSize, int64(s.journalMaxAge/time.Second))
+	if !due && len(entries) == 0 {
+		dirty := s.dirty
+		s.mu.Unlock()
+		if !dirty {
+			return nil
+		}
+		due = true
+	} else if due {
+		s.mu.Unlock()
+	}
+
+	if due {
+		// The full save holds every change, including the pending ones
+		if err := s.save(backend); err != nil {
+			s.mu.Lock()
+			s.restorePending(entries)
+			s.mu.Unlock()
+			return err
+		}
+		if err := j.Reset(); err != nil {
+			return err
+		}
+		s.logger.Debug("Compacted journal", zap.Stringer("journal", j))
+		return nil
+	}
+
+	s.dirty = false
+	s.saving = true
+	s.stopFlushTimer()
+	s.mu.Unlock()
+
+	return s.writeChanges(entries, j.Append)
+}
+
+// persistRecords applies the pending changes to backend. If the data changed
+// in a way that is not recorded as changes, e.g. it was migrated on load, it
+// is saved in full instead. Callers must hold s.persistMu but not s.mu.
+func (s *UserIPStorage) persistRecords(backend recordBackend) error {
+	s.mu.Lock()
+	s.pruneRemovals()
+	entries := s.takePending()
+	if len(entries) == 0 && !s.fullSave && s.database() != nil {
+		// Every change is recorded as one, and the cache holds nothing else
+		s.dirty = false
+		s.stopFlushTimer()
+		s.mu.Unlock()
+		return nil
+	}
+	if len(entries) == 0 || s.fullSave {
+		dirty := s.dirty || s.fullSave
+		s.mu.Unlock()
+		if !dirty {
+			return nil
+		}
+		// The full save holds every change, including the pending ones
+		if err := s.save(backend); err != nil {
+			s.mu.Lock()
+			s.restorePending(entries)
+			s.mu.Unlock()
+			return err
+		}
+		return nil
+	}
+
+	s.dirty = false
+	s.saving = true
+	s.stopFlushTimer()
+	s.mu.Unlock()
+
+	err := s.writeChanges(entries, func(entries []journalEntry) error {
+		return backend.Apply(context.Background(), entries)
+	})
+	if err == nil {
+		// The database holds the changes now
+		s.mu.Lock()
+		s.evictCache(entries)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// writeChanges writes entries, the changes just taken from s.pending, with
+// write, which is called without holding s.mu, and then clears s.saving. If
+// the write fails, the changes are made pending again so that the next write
+// retries them. Callers must hold s.persistMu but not s.mu, and have set
+// s.saving.
+func (s *UserIPStorage) writeChanges(entries []journalEntry, write func([]journalEntry) error) error {
+	start := time.Now()
+	err := write(entries)
+
+	s.mu.Lock()
+	s.saving = false
+	if err != nil {
+		// Keep the changes pending, so that the next write retries them
+		s.restorePending(entries)
+		s.dirty = true
+	}
+	s.mu.Unlock()
+	if err != nil {
+		metrics.persistFailures.WithLabelValues(s.name).Inc()
+		return err
+	}
+	metrics.persistDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	metrics.lastPersist.WithLabelValues(s.name).SetToCurrentTime()
+	return nil
+}
+
+// restorePending makes entries, the changes taken from pending for a write
+// that failed, pending again ahead of those made since, so that the next
+// write retries them. Past maxPending, they are all dropped in favor of a full
+// save. Callers must hold s.mu.
+func (s *UserIPStorage) restorePending(entries []journalEntry) {
+	if len(entries) == 0 || s.fullSave {
+		return
+	}
+	s.pending = append(entries, s.pending...)
+	// The indexes moved; later bumps of the same IPs are added rather than
+	// replacing these
+	s.pendingBumps = nil
+	if len(s.pending) > maxPending && s.database() == nil {
+		s.dropPending()
+	}
+}
+
+// lockBackend locks backend against other writers sharing it, if it supports
+// that, and returns the function that unlocks it again.
+func (s *UserIPStorage) lockBackend(backend Backend) (func(), error) {
+	locker, ok := backend.(lockingBackend)
+	if !ok {
+		return func() {}, nil
+	}
+	if err := locker.Lock(context.Background()); err != nil {
+		return nil, fmt.Errorf("locking %s: %v", backend, err)
+	}
+	return func() {
+		if err := locker.Unlock(context.Background()); err != nil {
+			s.logger.Error("Failed to unlock backend",
+				zap.String("store", s.name),
+				zap.Stringer("backend", backend),
+				zap.Error(err))
+		}
+	}, nil
+}
+
+// save merges the data already saved in backend into the data in memory, so
+// that changes saved by other instances sharing it are kept, and writes the
+// result back. Only the merge and taking a snapshot of the result hold s.mu;
+// reading, encoding and writing do not, so a slow backend does not hold up
+// tracking. Changes made while the snapshot is written leave the data dirty
+// for the next write. Saved data that is corrupt is overwritten, while data
+// that cannot be read for any other reason, including encrypted data the
+// configured keys do not decrypt, is left alone and the save fails.
+// The saved data is not merged if it is still what this instance last wrote,
+// and not even read back if no other instance writes to backend. A backend
+// that can be locked against other writers is locked throughout.
+// Callers must hold s.persistMu but not s.mu.
+func (s *UserIPStorage) save(backend Backend) error {
+	unlock, err := s.lockBackend(backend)
+	if err != nil {
+		metrics.persistFailures.WithLabelValues(s.name).Inc()
 		return err
 	}
+	defer unlock()
+
+	var saved persistData
+	var readErr error
+	if records, ok := backend.(recordBackend); ok {
+		// The records are merged whatever they hold, as they are not read
+		// as a whole to compare
+		if !s.exclusive(backend) || s.lastSave.backend != backend.String() {
+			saved, _, readErr = s.readBackend(records)
+		}
+	} else if !s.exclusive(backend) || s.lastSave.backend != backend.String() {
+		var data []byte
+		var reseal bool
+		data, reseal, readErr = s.loadBackend(backend)
+		if readErr == nil && data != nil && !s.lastSave.matches(backend, data) {
+			saved, _, readErr = s.decodeData(backend, data, reseal)
+		}
+	}
+	if readErr != nil && !errors.Is(readErr, errCorrupt) {
+		// The data may be fine but out of reach for now, encrypted with keys
+		// that are not configured, or in a newer format whose additions
+		// overwriting it would lose
+		metrics.persistFailures.WithLabelValues(s.name).Inc()
+		return readErr
+	}
+
+	s.mu.Lock()
+	if readErr != nil {
+		// The data in memory is the best there is, so write it anyway
+		s.logger.Warn("Overwriting persisted data that is corrupt",
+			zap.String("store", s.name),
+			zap.Stringer("backend", backend),
+			zap.Error(readErr))
+	} else {
+		s.mergeData(saved)
+	}
+	if err := s.fillCache(); err != nil {
+		// Writing the cache alone would lose the users left out of it
+		s.mu.Unlock()
+		metrics.persistFailures.WithLabelValues(s.name).Inc()
+		return fmt.Errorf("reading user IP data from %s: %v", backend, err)
+	}
+	s.pruneRemovals()
+	pd := s.snapshot()
+	s.dirty = false
+	s.fullSave = false
+	s.saving = true
+	s.stopFlushTimer()
+	s.mu.Unlock()
+
+	err = s.write(backend, pd)
 
-	// Rename the temporary file to the actual file (atomic operation)
-	if err := os.Rename(tempFile, s.persistPath); err != nil {
+	s.mu.Lock()
+	s.saving = false
+	if err != nil {
+		// Keep the changes pending, so that the next write retries them
+		s.dirty = true
+		s.fullSave = true
+	} else {
+		s.evictCache(nil)
+	}
+	s.mu.Unlock()
+	if err != nil {
 		return err
 	}
+	s.logger.Debug("Dirty flag set to false after persisting") // Debug log
+	return nil
+}
+
+// exclusive returns true if no other instance writes to backend, so that its
+// saved data is whatever this instance last wrote: a file or bolt database
+// that is not synced with others. Callers must hold s.persistMu.
+func (s *UserIPStorage) exclusive(backend Backend) bool {
+	if sealed, ok := backend.(*encryptedBackend); ok {
+		backend = sealed.Backend
+	}
+	switch backend.(type) {
+	case *fileBackend, *boltBackend:
+		return s.syncInterval == 0
+	default:
+		return false
+	}
+}
+
+// savedVersion identifies the data last written to a backend.
+type savedVersion struct {
+	backend string
+	sum     [sha256.Size]byte
+}
+
+// matches returns true if data, read from backend, is the data last written
+// to it.
+func (v savedVersion) matches(backend Backend, data []byte) bool {
+	return v.backend != "" && v.backend == backend.String() && v.sum == sha256.Sum256(data)
+}
+
+// snapshot returns a copy of the data to persist, which stays consistent
+// while it is written without holding s.mu. Callers must hold s.mu.
+func (s *UserIPStorage) snapshot() persistData {
+	pd := persistData{
+		Version:  persistVersion,
+		UserData: make(map[string]*UserData, len(s.userData)),
+		Removed:  make(map[string]map[string]int64, len(s.removed)),
+	}
+	for user, userData := range s.userData {
+		pd.UserData[user] = userData.clone()
+	}
+	for user, ips := range s.removed {
+		pd.Removed[user] = maps.Clone(ips)
+	}
+	return pd
+}
+
+// write encodes pd and writes it to backend, recording the outcome in the
+// persistence metrics. The first write to an encrypted backend encrypts the
+// copies kept next to the data too. Callers must hold s.persistMu.
+func (s *UserIPStorage) write(backend Backend, pd persistData) error {
+	start := time.Now()
+
+	if records, ok := backend.(recordBackend); ok {
+		// The records are written as they are, without encoding the whole
+		if err := records.Replace(context.Background(), pd); err != nil {
+			metrics.persistFailures.WithLabelValues(s.name).Inc()
+			return err
+		}
+		s.lastSave = savedVersion{backend: backend.String()}
+		metrics.persistDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+		metrics.lastPersist.WithLabelValues(s.name).SetToCurrentTime()
+		return nil
+	}
 
-	s.dirty = false                                                    // Reset dirty flag after successful write
-	s.logger.Debug("Dirty flag set to false after persisting to disk") // Debug log
+	// Convert to JSON
+	data, err := json.MarshalIndent(pd, "", "  ")
+	if err == nil {
+		err = backend.Save(context.Background(), data)
+	}
+	if err != nil {
+		metrics.persistFailures.WithLabelValues(s.name).Inc()
+		return err
+	}
+	s.lastSave = savedVersion{backend: backend.String(), sum: sha256.Sum256(data)}
+	metrics.persistDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	metrics.persistSize.WithLabelValues(s.name).Set(float64(len(data)))
+	metrics.lastPersist.WithLabelValues(s.name).SetToCurrentTime()
+
+	// Once the data is encrypted with the current key, so are its backups
+	// and other copies, which may still hold it in plaintext
+	if sealed, ok := backend.(*encryptedBackend); ok && s.sealedCopies != sealed {
+		if err := sealed.sealCopies(context.Background()); err != nil {
+			// Tried again with the next write
+			s.logger.Error("Failed to encrypt copies of persisted data",
+				zap.String("store", s.name),
+				zap.Stringer("backend", backend),
+				zap.Error(err))
+		} else {
+			s.sealedCopies = sealed
+		}
+	}
 	return nil
 }
 
-// IsDirty returns true if the data has changed since the last persist.
+// size returns the number of tracked users and IPs. With the cache turned off,
+// they are counted in the database, so changes not written yet are left out.
+func (s *UserIPStorage) size() (int, int) {
+	s.mu.RLock()
+	users, database := len(s.userData), s.database()
+	s.mu.RUnlock()
+	if database == nil {
+		return users, s.view.len()
+	}
+	users, ips, err := database.counts()
+	if err != nil {
+		s.logger.Error("Failed to count users in the database",
+			zap.String("store", s.name),
+			zap.Stringer("backend", database),
+			zap.Error(err))
+	}
+	return users, ips
+}
+
+// IsDirty returns true if the data has changed since the last persist, or is
+// still being written.
 func (s *UserIPStorage) IsDirty() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.dirty
+	return s.dirty || s.saving
 }
 
-// cleanupExpiredUsers removes users whose data has expired based on TTL.
+// cleanupExpiredUsers removes IPs that have not been seen within ipTTL, and
+// users whose data has expired based on TTL, and schedules a single flush for
+// all of them.
 func (s *UserIPStorage) cleanupExpiredUsers() {
-	s.logger.Debug("Starting cleanup of expired users")
+	if s.removeExpired() > 0 {
+		// All removals in this pass are coalesced into one flush
+		s.markDirty(s.newIPFlushDelay)
+	}
+}
+
+// removeExpired removes the expired IPs and users, and returns how many were
+// removed. Only users whose deadline in the expiry heap has passed are
+// visited, so it costs O(log U) per user holding an expired entry, rather
+// than a pass over every user. Callers must hold s.mu.
+func (s *UserIPStorage) removeExpired() int {
+	now := s.clock.Now().Unix()
+	removed := 0
+	for {
+		email, at, ok := s.expiry.Peek()
+		if !ok || at >= now {
+			return removed
+		}
+		removed += s.expireUser(email)
+	}
+}
 
-	// Calculate the expiration timestamp
-	expireTime := s.clock.Now().Unix() - int64(s.userDataTTL)
-	s.logger.Debug("Calculated expiration time", zap.Int64("expire_time", expireTime))
+// expireUser removes the expired IPs of email, or the whole user if their data
+// has expired, updates their deadline in the expiry heap, and returns how many
+// IPs and users were removed. Callers must hold s.mu.
+func (s *UserIPStorage) expireUser(email string) int {
+	userData, exists := s.userData[email]
+	if !exists {
+		s.refreshUser(email)
+		return 0
+	}
 
-	// Check each user
-	for email, userData := range s.userData {
-		// Find the most recent IP timestamp for this user
-		mostRecentTime := int64(0)
-		for _, ipData := range userData.IPs {
-			if ipData.LastSeen > mostRecentTime {
-				mostRecentTime = ipData.LastSeen
+	removed := 0
+	if s.ipTTL > 0 {
+		ipsRemoved := 0
+		userData.IPs = slices.DeleteFunc(userData.IPs, func(ipData IPData) bool {
+			if !s.isIPExpired(ipData) {
+				return false
 			}
+			s.logger.Info("IP expired, removing it from user",
+				zap.String("user", email),
+				zap.String("ip", ipData.IP),
+				zap.Int64("last_seen", ipData.LastSeen))
+			s.unlinkIP(ipData.IP, email)
+			s.logChange(journalExpire, email, IPData{IP: ipData.IP})
+			ipsRemoved++
+			return true
+		})
+		metrics.ipExpirations.WithLabelValues(s.name).Add(float64(ipsRemoved))
+		removed += ipsRemoved
+		if len(userData.IPs) == 0 {
+			s.logger.Info("All IPs of user expired, removing user", zap.String("user", email))
+			s.dropUser(email)
+			return removed
 		}
+	}
 
-		s.logger.Debug("Checking user for expiration",
+	if s.isExpired(userData) {
+		s.logger.Info("User data expired, removing user",
 			zap.String("user", email),
-			zap.Int64("most_recent_ip_time", mostRecentTime),
-			zap.Int64("expire_time", expireTime))
+			zap.Int64("most_recent_activity", userData.lastSeen()),
+			zap.Int("ip_count", len(userData.IPs)))
+		for _, ipData := range userData.IPs {
+			s.unlinkIP(ipData.IP, email)
+		}
+		s.dropUser(email)
+		s.logChange(journalExpire, email, IPData{})
+		metrics.expirations.WithLabelValues(s.name).Inc()
+		return removed + 1
+	}
 
-		// If the user's most recent IP timestamp is older than the expiration time
-		if mostRecentTime < expireTime {
-			s.logger.Info("User data expired, removing user",
-				zap.String("user", email),
-				zap.Int64("most_recent_activity", mostRecentTime),
-				zap.Int("ip_count", len(userData.IPs)))
+	s.refreshUser(email)
+	return removed
+}
 
-			// Remove all IPs from the reverse mapping
-			for _, ipData := range userData.IPs {
-				s.logger.Debug("Removing IP from reverse mapping for expired user",
-					zap.String("user", email),
-					zap.String("ip", ipData.IP))
-				if users, exists := s.ipToUsers[ipData.IP]; exists {
-					delete(users, email)
-					if len(users) == 0 {
-						s.logger.Debug("Removing IP from global tracking (no remaining users)",
-							zap.String("ip", ipData.IP))
-						delete(s.ipToUsers, ipData.IP)
-					}
-				}
-			}
+// isIPExpired returns true if ipData was not seen within ipTTL. Callers must
+// hold s.mu.
+func (s *UserIPStorage) isIPExpired(ipData IPData) bool {
+	if s.ipTTL == 0 {
+		return false
+	}
+	return ipData.LastSeen < s.clock.Now().Unix()-int64(s.ipTTL)
+}
 
-			// Remove the user from the userData map
-			delete(s.userData, email)
+// isExpired returns true if none of the user's IPs was seen within the TTL.
+// Callers must hold s.mu.
+func (s *UserIPStorage) isExpired(userData *UserData) bool {
+	if s.userDataTTL == 0 {
+		return false
+	}
+	return userData.lastSeen() < s.clock.Now().Unix()-int64(s.userDataTTL)
+}
 
-			// Mark as dirty and trigger immediate write
-			s.dirty = true
-			go s.writeImmediately()
-		} else {
-			s.logger.Debug("User data not expired", zap.String("user", email))
+// expiresAt returns the Unix timestamp after which one of the user's IPs or
+// the user's data expires, and false if nothing the user has can expire.
+func (s storageConfig) expiresAt(userData *UserData) (int64, bool) {
+	if len(userData.IPs) == 0 || (s.userDataTTL == 0 && s.ipTTL == 0) {
+		return 0, false
+	}
+	oldest := userData.IPs[0].LastSeen
+	for _, ipData := range userData.IPs[1:] {
+		oldest = min(oldest, ipData.LastSeen)
+	}
+
+	at := int64(-1)
+	if s.ipTTL > 0 {
+		at = oldest + int64(s.ipTTL)
+	}
+	if s.userDataTTL > 0 {
+		userAt := userData.lastSeen() + int64(s.userDataTTL)
+		if at == -1 || userAt < at {
+			at = userAt
 		}
 	}
-	s.logger.Debug("Finished cleanup of expired users")
+	return at, true
+}
+
+// refreshUser updates the deadline of email in the expiry heap, and their
+// most recent last_seen in the reverse mapping, after their IPs changed,
+// dropping them from both if they are gone. Callers must hold s.mu.
+func (s *UserIPStorage) refreshUser(email string) {
+	userData, exists := s.userData[email]
+	if !exists {
+		s.expiry.Remove(email)
+		s.view.forget(email)
+		return
+	}
+	s.view.setLastSeen(email, userData.lastSeen())
+	at, ok := s.expiresAt(userData)
+	if !ok {
+		s.expiry.Remove(email)
+		return
+	}
+	s.expiry.Set(email, at)
+}
+
+// rebuildExpiry rebuilds the expiry heap from userData. Callers must hold s.mu.
+func (s *UserIPStorage) rebuildExpiry() {
+	s.expiry = expiryHeap{}
+	for email := range s.userData {
+		s.refreshUser(email)
+	}
+}
+
+// lastSeen returns the most recent last_seen of the user's IPs, or 0 if the
+// user has none.
+func (u *UserData) lastSeen() int64 {
+	lastSeen := int64(0)
+	for _, ipData := range u.IPs {
+		lastSeen = max(lastSeen, ipData.LastSeen)
+	}
+	return lastSeen
 }
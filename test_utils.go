@@ -2,12 +2,16 @@ package caddy_user_ip
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddytest"
 	"github.com/jonboulle/clockwork"
 )
@@ -76,29 +80,106 @@ func pollForUserData(t *testing.T, path, email string, timeout, interval time.Du
 	}
 }
 
+// waitForPersist waits until the storage has no unwritten changes, i.e. until
+// the background writer has flushed everything that was pending.
+func waitForPersist(t *testing.T, storage *UserIPStorage, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for storage.IsDirty() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for pending changes to be persisted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// unloadStores loads a config without any sites, which releases every store
+// held by the previous config. A store is destroyed (and its data dropped) once
+// its last reference is released.
+func unloadStores(t *testing.T) {
+	t.Helper()
+	live := false
+	stores.Range(func(key, value any) bool {
+		live = true
+		return false
+	})
+	if !live {
+		return
+	}
+	if err := caddy.Load([]byte(`{"admin":{"listen":"localhost:2999"}}`), false); err != nil {
+		t.Fatalf("Failed to unload previous config: %v", err)
+	}
+}
+
+// loadCaddyfile adapts caddyfile and loads it in place of the running config,
+// returning the error if loading fails. Unlike Tester.InitServer, it lets a
+// test expect a reload to fail.
+func loadCaddyfile(t *testing.T, caddyfile string) error {
+	t.Helper()
+	cfg, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(caddyfile), nil)
+	if err != nil {
+		t.Fatalf("Failed to adapt Caddyfile: %v", err)
+	}
+	return caddy.Load(cfg, true)
+}
+
+// getLiveStorage returns the named store of the running config, failing the
+// test if no loaded config uses it.
+func getLiveStorage(t *testing.T, name string) *UserIPStorage {
+	t.Helper()
+	storage := lookupStorage(name)
+	if storage == nil {
+		t.Fatalf("Expected store %q to be live", name)
+	}
+	return storage
+}
+
 // createTester initializes a new caddytest.Tester with a standard header
 // and the provided caddyfileFragment.
 func createTester(t *testing.T, caddyfileFragment string) *caddytest.Tester {
-	// Reset the singleton storage instance before each test to ensure test isolation.
-	resetStorage()
+	return createTesterWithOptions(t, "", caddyfileFragment)
+}
+
+// createTesterWithOptions is like createTester, but adds globalOptions to the
+// standard global options.
+func createTesterWithOptions(t *testing.T, globalOptions, caddyfileFragment string) *caddytest.Tester {
+	// Unload the previous test's config so that its stores are destroyed, to
+	// ensure test isolation.
+	unloadStores(t)
 
 	tester := caddytest.NewTester(t)
-	fullCaddyfile := `
+	tester.InitServer(fullTestCaddyfileWithOptions(globalOptions, caddyfileFragment), "caddyfile")
+	return tester
+}
+
+// fullTestCaddyfile prepends the standard global options used by all tests
+// to the provided caddyfileFragment.
+func fullTestCaddyfile(caddyfileFragment string) string {
+	return fullTestCaddyfileWithOptions("", caddyfileFragment)
+}
+
+// fullTestCaddyfileWithOptions is like fullTestCaddyfile, but adds
+// globalOptions to the standard global options.
+func fullTestCaddyfileWithOptions(globalOptions, caddyfileFragment string) string {
+	return `
   {
     admin localhost:2999
     http_port     9080
     https_port    9443
     grace_period  1ns
+    servers {
+      trusted_proxies static 127.0.0.1/8 ::1
+      trusted_proxies_strict
+      client_ip_headers X-Forwarded-For X-Real-IP
+    }
 		log {
 		  format console
 		}
 		debug
+` + globalOptions + `
   }
 
 ` + caddyfileFragment
-
-	tester.InitServer(fullCaddyfile, "caddyfile")
-	return tester
 }
 
 // createTempPersistFile creates a temporary file for persistence and returns its path.
@@ -181,3 +262,20 @@ func getFileModTime(t *testing.T, path string) (time.Time, error) {
 	}
 	return fileInfo.ModTime(), nil
 }
+
+// populateBenchmarkStorage configures storage without a backend or background
+// writer and fills it with users users of ipsPerUser IPs each. User n is
+// "user<n>@bench.test" and their IPs are benchmarkIP(n*ipsPerUser) onwards.
+func populateBenchmarkStorage(storage *UserIPStorage, users, ipsPerUser int) {
+	storage.storageConfig = storageConfig{maxIPsPerUser: uint64(ipsPerUser)}
+	for u := 0; u < users; u++ {
+		for i := 0; i < ipsPerUser; i++ {
+			storage.AddUserIP(fmt.Sprintf("user%d@bench.test", u), benchmarkIP(u*ipsPerUser+i))
+		}
+	}
+}
+
+// benchmarkIP returns the n-th IP address used by populateBenchmarkStorage.
+func benchmarkIP(n int) string {
+	return netip.AddrFrom4([4]byte{10, byte(n >> 16), byte(n >> 8), byte(n)}).String()
+}
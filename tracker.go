@@ -5,9 +5,10 @@ package caddy_user_ip
 
 import (
 	"fmt"
-	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"time"
 
 	"github.com/jonboulle/clockwork"
 
@@ -26,8 +27,17 @@ type UserIpTracking struct {
 	// Logger for the middleware
 	logger *zap.Logger
 
-	// Storage for user IPs
+	// Named storage for user IPs, shared across config reloads
 	storage *UserIPStorage
+
+	// Parsed form of TrustedProxies
+	trustedProxies []netip.Prefix
+
+	// Whether this instance holds a reference on the storage
+	acquired bool
+
+	// Bolt database this instance holds a reference on, if any
+	bolt *boltBackend
 }
 
 // CaddyModule returns the Caddy module information.
@@ -41,6 +51,21 @@ func (*UserIpTracking) CaddyModule() caddy.ModuleInfo {
 // Provision sets up the middleware.
 func (m *UserIpTracking) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger(m)
+
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
+	}
+
+	trustedProxies, err := parseTrustedProxies(m.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	m.trustedProxies = trustedProxies
+
+	if len(m.Identity) == 0 {
+		m.Identity = []string{defaultIdentity}
+	}
+
 	var clock clockwork.Clock
 	if testClockInject != nil {
 		clock = testClockInject
@@ -48,112 +73,285 @@ func (m *UserIpTracking) Provision(ctx caddy.Context) error {
 		clock = clockwork.NewRealClock()
 	}
 
-	// Get the singleton storage instance
-	m.storage = getStorage()
-
-	// Attempt to configure the singleton storage
-	wasConfigured := m.storage.Configure(m.PersistPath, m.MaxIpsPerUser, m.UserDataTTL, clock, m.logger)
-
-	if !wasConfigured {
-		m.logger.Warn("user_ip_tracking storage is already configured; ignoring subsequent configuration",
-			zap.String("persist_path", m.PersistPath),
-			zap.Uint64("max_ips_per_user", m.MaxIpsPerUser),
-			zap.Uint64("user_data_ttl", m.UserDataTTL))
-		return nil
+	persistInterval := time.Duration(m.PersistInterval)
+	if persistInterval <= 0 {
+		persistInterval = defaultPersistInterval
+	}
+	flushDelay := time.Duration(m.FlushDelay)
+	if flushDelay <= 0 {
+		flushDelay = defaultFlushDelay
+	}
+	newIPFlushDelay := time.Duration(m.NewIPFlushDelay)
+	syncInterval := time.Duration(m.SyncInterval)
+	if syncInterval == 0 && m.Backend == backendStorage {
+		syncInterval = defaultStorageSyncInterval
+	}
+	sweepInterval := time.Duration(m.SweepInterval)
+	if sweepInterval <= 0 {
+		sweepInterval = defaultSweepInterval
+	}
+	removalRetention := time.Duration(m.RemovalRetention)
+	if removalRetention <= 0 {
+		removalRetention = defaultRemovalRetention
+	}
+	// Without backups to fall back to, setting shared data aside would leave
+	// every instance with an empty store
+	strictLoad := m.Backend == backendStorage
+	if m.StrictLoad != nil {
+		strictLoad = *m.StrictLoad
 	}
-
-	m.logger.Info("UserIpTracking middleware configured",
-		zap.String("persist_path", m.PersistPath),
-		zap.Uint64("max_ips_per_user", m.MaxIpsPerUser),
-		zap.Uint64("user_data_ttl", m.UserDataTTL))
 
 	// Validate configuration
-	if m.PersistPath == "" {
-		return fmt.Errorf("persist_path is required")
+	backend, err := m.newBackend(ctx, clock)
+	if err != nil {
+		return err
 	}
 	if m.MaxIpsPerUser <= 0 {
 		return fmt.Errorf("max_ips_per_user must be greater than 0")
 	}
+	if m.ImportJSON != "" && m.bolt == nil {
+		return fmt.Errorf("import_json requires the %s backend", backendBolt)
+	}
+	uncached := m.Cache != nil && !*m.Cache
+	if uncached {
+		if m.bolt == nil {
+			return fmt.Errorf("cache off requires the %s backend", backendBolt)
+		}
+		if syncInterval > 0 {
+			// Other instances' changes would only reach the cache
+			return fmt.Errorf("cache off cannot be combined with sync_interval")
+		}
+	}
+	var changeLog *journal
+	if m.Journal {
+		if _, ok := backend.(*fileBackend); !ok {
+			return fmt.Errorf("journal requires the %s backend", backendFile)
+		}
+		if syncInterval > 0 {
+			return fmt.Errorf("journal cannot be combined with sync_interval")
+		}
+		changeLog = &journal{path: m.PersistPath + ".journal"}
+	}
+	if len(m.EncryptionKeys) > 0 {
+		if m.bolt != nil {
+			return fmt.Errorf("encryption_key is not supported by the %s backend", backendBolt)
+		}
+		if changeLog != nil {
+			// The journal would keep the changes in plaintext
+			return fmt.Errorf("journal cannot be combined with encryption_key")
+		}
+		keys, err := newEncryptionKeys(m.EncryptionKeys)
+		if err != nil {
+			return err
+		}
+		backend = &encryptedBackend{Backend: backend, keys: keys}
+	}
+	journalMaxSize := m.JournalMaxSize
+	if journalMaxSize <= 0 {
+		journalMaxSize = defaultJournalMaxSize
+	}
+	journalMaxAge := time.Duration(m.JournalMaxAge)
+	if journalMaxAge <= 0 {
+		journalMaxAge = defaultJournalMaxAge
+	}
 
-	// Load existing data from disk since we are the first to configure
-	if err := m.storage.LoadFromDisk(); err != nil {
-		m.logger.Error("Failed to load user IP data from disk",
-			zap.String("path", m.PersistPath),
-			zap.Error(err))
-		return fmt.Errorf("loading user IP data: %v", err)
+	// The app of this config, which applies the settings below once the config
+	// is running if the store is already live
+	appIface, err := ctx.App("user_ip")
+	if err != nil {
+		return fmt.Errorf("getting user_ip app: %v", err)
 	}
+	app := appIface.(*trackingApp)
 
-	m.logger.Info("Loaded user IP data from disk",
-		zap.String("path", m.PersistPath))
+	// Get the named storage instance, which outlives this config if the next
+	// one uses it too
+	storage, err := loadStorage(m.storeName())
+	if err != nil {
+		return fmt.Errorf("loading store %q: %v", m.storeName(), err)
+	}
+	m.storage = storage
+	m.acquired = true
+
+	first, err := m.storage.Configure(storageConfig{
+		backend:          backend,
+		maxIPsPerUser:    m.MaxIpsPerUser,
+		userDataTTL:      m.UserDataTTL,
+		ipTTL:            m.IPTTL,
+		persistInterval:  persistInterval,
+		flushDelay:       flushDelay,
+		newIPFlushDelay:  newIPFlushDelay,
+		syncInterval:     syncInterval,
+		sweepInterval:    sweepInterval,
+		removalRetention: removalRetention,
+		journal:          changeLog,
+		journalMaxSize:   journalMaxSize,
+		journalMaxAge:    journalMaxAge,
+		strictLoad:       strictLoad,
+		importJSON:       m.ImportJSON,
+		uncached:         uncached,
+	}, clock, m.logger, app)
+	if err != nil {
+		return fmt.Errorf("configuring store %q: %v", m.storeName(), err)
+	}
+	app.register(m.storeName())
+
+	m.logger.Info("UserIpTracking middleware configured",
+		zap.String("store", m.storeName()),
+		zap.Stringer("backend", backend),
+		zap.Uint64("max_ips_per_user", m.MaxIpsPerUser),
+		zap.Uint64("user_data_ttl", m.UserDataTTL),
+		zap.Uint64("ip_ttl", m.IPTTL),
+		zap.Duration("persist_interval", persistInterval),
+		zap.Duration("flush_delay", flushDelay),
+		zap.Duration("new_ip_flush_delay", newIPFlushDelay),
+		zap.Duration("sync_interval", syncInterval),
+		zap.Duration("sweep_interval", sweepInterval),
+		zap.Duration("removal_retention", removalRetention),
+		zap.Bool("journal", changeLog != nil),
+		zap.Bool("strict_load", strictLoad),
+		zap.Bool("cache", !uncached),
+		zap.Bool("encrypted", len(m.EncryptionKeys) > 0))
+
+	// Load existing data from the backend if we are the first to configure;
+	// otherwise the store is already live, either from the previous config,
+	// which hands it over once this one is running, or from another handler
+	// using the same store
+	if first {
+		if err := m.storage.Load(); err != nil {
+			m.logger.Error("Failed to load user IP data",
+				zap.Stringer("backend", backend),
+				zap.Error(err))
+			return fmt.Errorf("loading user IP data: %v", err)
+		}
+
+		m.logger.Info("Loaded user IP data",
+			zap.String("store", m.storeName()),
+			zap.Stringer("backend", backend))
+
+		if m.ImportJSON != "" {
+			if _, err := m.storage.Import(m.ImportJSON); err != nil {
+				return fmt.Errorf("importing user IP data: %v", err)
+			}
+		}
+	}
 
 	return nil
 }
 
+// newBackend returns the backend configured for the store.
+func (m *UserIpTracking) newBackend(ctx caddy.Context, clock clockwork.Clock) (Backend, error) {
+	switch m.Backend {
+	case "", backendFile:
+		if m.PersistPath == "" {
+			return nil, fmt.Errorf("persist_path is required")
+		}
+		if m.StorageKey != "" {
+			return nil, fmt.Errorf("storage_key is not used by the %s backend", backendFile)
+		}
+		backups := defaultBackups
+		if m.Backups != nil {
+			backups = *m.Backups
+		}
+		if backups < 0 {
+			return nil, fmt.Errorf("backups must not be negative")
+		}
+		backend := &fileBackend{path: m.PersistPath, backups: backups}
+		if m.SyncInterval > 0 {
+			// Other instances write to the file too
+			backend.watchInterval = fileWatchInterval
+			backend.clock = clock
+		}
+		return backend, nil
+
+	case backendStorage:
+		if m.PersistPath != "" {
+			return nil, fmt.Errorf("persist_path is not used by the %s backend", backendStorage)
+		}
+		if m.Backups != nil {
+			return nil, fmt.Errorf("backups is not used by the %s backend", backendStorage)
+		}
+		key := m.StorageKey
+		if key == "" {
+			key = "user_ip/" + m.storeName() + ".json"
+		}
+		return &storageBackend{storage: ctx.Storage(), key: key}, nil
+
+	case backendBolt:
+		if m.PersistPath == "" {
+			return nil, fmt.Errorf("persist_path is required")
+		}
+		if m.StorageKey != "" {
+			return nil, fmt.Errorf("storage_key is not used by the %s backend", backendBolt)
+		}
+		if m.Backups != nil {
+			return nil, fmt.Errorf("backups is not used by the %s backend", backendBolt)
+		}
+		backend, err := openBoltBackend(m.PersistPath)
+		if err != nil {
+			return nil, err
+		}
+		m.bolt = backend
+		return backend, nil
+
+	default:
+		return nil, fmt.Errorf("unknown backend %q", m.Backend)
+	}
+}
+
+// storeName returns the name of the store this handler tracks IPs in.
+func (m *UserIpTracking) storeName() string {
+	if m.Store == "" {
+		return defaultStoreName
+	}
+	return m.Store
+}
+
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m *UserIpTracking) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Check for the X-Token-User-Email header
-	email := r.Header.Get("X-Token-User-Email")
+	// Resolve the user's identity
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	email := m.resolveIdentity(repl)
 	if email == "" {
 		// No authenticated user, just pass through
-		m.logger.Debug("No X-Token-User-Email header, skipping IP tracking")
+		m.logger.Debug("No user identity found, skipping IP tracking", zap.Strings("identity", m.Identity))
 		return next.ServeHTTP(w, r)
 	}
 
 	// Extract the client IP address
-	clientIP := getClientIP(r)
+	clientIP := getClientIP(r, m.trustedProxies)
+	if clientIP == "" {
+		m.logger.Debug("No valid client IP found, skipping IP tracking",
+			zap.String("email", email),
+			zap.String("remote_addr", r.RemoteAddr))
+		return next.ServeHTTP(w, r)
+	}
 
 	// Add the IP to the user's list
 	ipAdded := m.storage.AddUserIP(email, clientIP)
 
-	// Dump the contents of the storage for debugging
-	m.storage.mu.RLock()
-	var users []string
-	for user := range m.storage.userData {
-		users = append(users, user)
-	}
-	var ips []string
-	for ip := range m.storage.ipToUsers {
-		ips = append(ips, ip)
-	}
-	m.storage.mu.RUnlock()
-
-	// Log the IP tracking
-	m.logger.Debug("Tracked user IP",
-		zap.String("email", email),
-		zap.String("ip", clientIP),
-		zap.Bool("new_ip", ipAdded),
-		zap.Strings("known_users", users),
-		zap.Strings("known_ips", ips))
+	// Publish the IP's users for the rest of the route
+	setPlaceholders(r, m.storage.GetEntriesInNetwork(clientIP, 0, 0))
 
+	if m.logger.Core().Enabled(zap.DebugLevel) {
+		m.logger.Debug("Tracked user IP",
+			zap.String("email", email),
+			zap.String("ip", clientIP),
+			zap.Bool("new_ip", ipAdded))
+	}
 
 	// Continue with the request
 	return next.ServeHTTP(w, r)
 }
 
-// getClientIP extracts the client IP address from the request.
-func getClientIP(r *http.Request) string {
-	// Check for X-Forwarded-For header first
-	forwardedFor := r.Header.Get("X-Forwarded-For")
-	if forwardedFor != "" {
-		// X-Forwarded-For can contain multiple IPs, use the first one
-		forwardedIPs := strings.Split(forwardedFor, ",")
-		return strings.TrimSpace(forwardedIPs[0])
-	}
-
-	// Check for X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
-	}
-
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// If there's an error, just return the RemoteAddr as is
-		return r.RemoteAddr
+// resolveIdentity evaluates the identity expressions in order and returns the
+// first non-empty result, or an empty string if none resolve.
+func (m *UserIpTracking) resolveIdentity(repl *caddy.Replacer) string {
+	for _, expr := range m.Identity {
+		if identity := strings.TrimSpace(repl.ReplaceAll(expr, "")); identity != "" {
+			return identity
+		}
 	}
-
-	return ip
+	return ""
 }
 
 // Interface guards
@@ -165,16 +363,28 @@ var (
 
 // Cleanup is called when the module is unloaded.
 func (m *UserIpTracking) Cleanup() error {
-	// Perform final persistence on shutdown
-	m.logger.Info("Performing final persistence on shutdown")
-	if err := m.storage.PersistToDisk(true); err != nil {
-		m.logger.Error("Failed to perform final persistence on shutdown",
-			zap.String("path", m.storage.persistPath),
-			zap.Error(err))
-	} else {
-		m.logger.Info("Final persistence on shutdown complete")
+	// Drop our reference on the store, unless provisioning did not get as far
+	// as loading it. During a config reload the new config already holds one,
+	// so the store and its writer stay alive; otherwise the store stops its
+	// writer and performs a final persistence.
+	if m.acquired {
+		m.acquired = false
+		if err := releaseStorage(m.storeName()); err != nil {
+			m.logger.Error("Failed to release store",
+				zap.String("store", m.storeName()),
+				zap.Error(err))
+		}
+	}
+
+	// Only after the store, whose final persistence may still need it
+	if m.bolt != nil {
+		if err := m.bolt.Close(); err != nil {
+			m.logger.Error("Failed to close bolt database",
+				zap.Stringer("backend", m.bolt),
+				zap.Error(err))
+		}
+		m.bolt = nil
 	}
 
 	return nil
 }
-
@@ -4,9 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
 	"testing"
 	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 )
 
 // TestBasicHandler provides a simple example of how to write an HTTP test
@@ -85,19 +90,32 @@ func TestBasicIPTracking(t *testing.T) {
 	}
 }
 
-// TestIPExtractionLogic tests the correct extraction of IPs from headers and RemoteAddr.
+// TestIPExtractionLogic tests the correct extraction of IPs from headers and RemoteAddr,
+// and that forwarding headers cannot be used to spoof the client IP.
 func TestIPExtractionLogic(t *testing.T) {
 	persistPath := createTempPersistFile(t)
 
 	fakeClock := setupFakeClock(t)
 
+	// The default route trusts the loopback peer and the 1.1.1.1 proxy.
+	// The /untrusted route trusts a range that does not contain the loopback peer.
 	tester := createTester(t, `
     localhost:9080 {
+        route /untrusted {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                user_data_ttl 3600
+                trusted_proxies 192.0.2.0/24
+            }
+            respond "OK"
+        }
         route {
             user_ip_tracking {
                 persist_path `+persistPath+`
                 max_ips_per_user 5
                 user_data_ttl 3600
+                trusted_proxies 127.0.0.1/8 ::1 1.1.1.1
             }
             respond "OK"
         }
@@ -177,10 +195,27 @@ func TestIPExtractionLogic(t *testing.T) {
 		t.Errorf("Scenario C: Expected status code 200, but got %d", respC.StatusCode)
 	}
 
+	// Scenario D (spoofed X-Forwarded-For prefix):
+	// The client prepends 6.6.6.6 itself; only hops appended by trusted proxies count,
+	// so the rightmost untrusted hop (4.4.4.4) is the client.
+	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user-d@example.com", "6.6.6.6, 4.4.4.4, 1.1.1.1", "")
+
+	// Scenario E (untrusted peer):
+	// The loopback peer is not a trusted proxy for this route, so its headers are ignored.
+	sendTestRequest(t, tester, "GET", "http://localhost:9080/untrusted", "user-e@example.com", "6.6.6.6", "6.6.6.6")
+
+	// Scenario F (spoofed X-Forwarded-For behind a malformed hop):
+	// The walk stops at the hop that is not an address, rather than skipping it
+	// to reach the forged 6.6.6.6, and falls back to the peer.
+	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user-f@example.com", "6.6.6.6, junk, 1.1.1.1", "")
+
 	// Poll until data is persisted for all users
 	persistedUserDataA := pollForUserData(t, persistPath, "user-a@example.com", 2*time.Second, 10*time.Millisecond)
 	persistedUserDataB := pollForUserData(t, persistPath, "user-b@example.com", 2*time.Second, 10*time.Millisecond)
 	persistedUserDataC := pollForUserData(t, persistPath, "user-c@example.com", 2*time.Second, 10*time.Millisecond)
+	persistedUserDataD := pollForUserData(t, persistPath, "user-d@example.com", 2*time.Second, 10*time.Millisecond)
+	persistedUserDataE := pollForUserData(t, persistPath, "user-e@example.com", 2*time.Second, 10*time.Millisecond)
+	persistedUserDataF := pollForUserData(t, persistPath, "user-f@example.com", 2*time.Second, 10*time.Millisecond)
 
 	// Assertions: Check the content of the persisted file for each scenario
 
@@ -228,6 +263,32 @@ func TestIPExtractionLogic(t *testing.T) {
 	// We can't reliably assert the exact RemoteAddr IP here without more complex test setup,
 	// so we'll just check that an IP was recorded.
 
+	// Scenario D
+	userDataD, existsD := persistedUserDataD["user-d@example.com"]
+	if !existsD {
+		t.Fatalf("Expected user 'user-d@example.com' in persisted data, but not found")
+	}
+	if len(userDataD.IPs) != 1 || userDataD.IPs[0].IP != "4.4.4.4" {
+		t.Errorf("Scenario D: Expected user 'user-d@example.com' to have IP ['4.4.4.4'], but got %v", userDataD.IPs)
+	}
+
+	// Scenario E
+	userDataE, existsE := persistedUserDataE["user-e@example.com"]
+	if !existsE {
+		t.Fatalf("Expected user 'user-e@example.com' in persisted data, but not found")
+	}
+	if len(userDataE.IPs) != 1 || userDataE.IPs[0].IP == "6.6.6.6" {
+		t.Errorf("Scenario E: Expected user 'user-e@example.com' to have the peer IP, not the spoofed header IP, but got %v", userDataE.IPs)
+	}
+
+	// Scenario F
+	userDataF, existsF := persistedUserDataF["user-f@example.com"]
+	if !existsF {
+		t.Fatalf("Expected user 'user-f@example.com' in persisted data, but not found")
+	}
+	if len(userDataF.IPs) != 1 || userDataF.IPs[0].IP == "6.6.6.6" || userDataF.IPs[0].IP == "1.1.1.1" {
+		t.Errorf("Scenario F: Expected user 'user-f@example.com' to have the peer IP, not a header IP, but got %v", userDataF.IPs)
+	}
 }
 
 // TestMissingEmailHeader ensures no tracking occurs if the X-Token-User-Email header is absent.
@@ -279,6 +340,76 @@ func TestMissingEmailHeader(t *testing.T) {
 	}
 }
 
+// TestConfigurableIdentity verifies that the identity option resolves users from
+// placeholder expressions in order, with the first non-empty value winning.
+func TestConfigurableIdentity(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+
+	setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                user_data_ttl 3600
+                identity {header.Remote-User} {http.request.header.X-Forwarded-Email}
+            }
+            respond "OK"
+        }
+    }
+  `)
+
+	sendWithHeaders := func(xff string, headers map[string]string) {
+		req, err := http.NewRequest("GET", "http://localhost:9080/", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("X-Forwarded-For", xff)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := tester.Client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		// Ignoring error in test cleanup
+		_ = resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, but got %d", resp.StatusCode)
+		}
+	}
+
+	// Only the second expression resolves
+	sendWithHeaders("1.1.1.1", map[string]string{"X-Forwarded-Email": "forwarded@example.com"})
+
+	// Both resolve; the first one wins
+	sendWithHeaders("2.2.2.2", map[string]string{
+		"Remote-User":       "remote@example.com",
+		"X-Forwarded-Email": "ignored@example.com",
+	})
+
+	// The default header is not consulted once identity is configured
+	sendWithHeaders("3.3.3.3", map[string]string{"X-Token-User-Email": "token@example.com"})
+
+	pollForUserData(t, persistPath, "forwarded@example.com", 2*time.Second, 10*time.Millisecond)
+	persistedUserData := pollForUserData(t, persistPath, "remote@example.com", 2*time.Second, 10*time.Millisecond)
+
+	if userData := persistedUserData["forwarded@example.com"]; len(userData.IPs) != 1 || userData.IPs[0].IP != "1.1.1.1" {
+		t.Errorf("Expected user 'forwarded@example.com' to have IP ['1.1.1.1'], but got %v", userData.IPs)
+	}
+	if userData := persistedUserData["remote@example.com"]; len(userData.IPs) != 1 || userData.IPs[0].IP != "2.2.2.2" {
+		t.Errorf("Expected user 'remote@example.com' to have IP ['2.2.2.2'], but got %v", userData.IPs)
+	}
+	if _, exists := persistedUserData["ignored@example.com"]; exists {
+		t.Errorf("Expected user 'ignored@example.com' not to be tracked when an earlier identity resolves")
+	}
+	if _, exists := persistedUserData["token@example.com"]; exists {
+		t.Errorf("Expected user 'token@example.com' not to be tracked when identity is configured")
+	}
+}
+
 // TestMaxIPsLimit confirms that adding more IPs than max_ips_per_user correctly evicts the oldest IP.
 func TestMaxIPsLimit(t *testing.T) {
 	persistPath := createTempPersistFile(t)
@@ -384,6 +515,7 @@ func TestDuplicateIPHandling(t *testing.T) {
 
 	// Advance clock by the periodic persistence interval to trigger persistence
 	fakeClock.Advance(5 * time.Minute)
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
 
 	// Poll until data is persisted after the second request
 	persistedUserDataAfterSecond := pollForUserData(t, persistPath, "test@example.com", 2*time.Second, 10*time.Millisecond)
@@ -572,12 +704,15 @@ func TestAddUserIPDirtyFlagPersistFalse(t *testing.T) {
 	fakeClock.Advance(1 * time.Second)
 
 	// Action 2: Send identical HTTP GET request (X-Token-User-Email: user1@test.com, Source IP: 1.1.1.1).
-	// In the new schema, this should update the IP's timestamp and trigger persistence.
+	// In the new schema, this should update the IP's timestamp and schedule a delayed write.
 	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
 
-	// Wait briefly. Record file mod time/content (State 2).
+	// Timestamp-only changes are written once the flush delay (1 minute by default) elapses.
+	fakeClock.Advance(time.Minute)
+
+	// Wait for the write. Record file mod time/content (State 2).
 	// We expect a write because the timestamp was updated.
-	time.Sleep(100 * time.Millisecond) // Give async goroutine a chance to write
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
 	modTimeState2, err2 := getFileModTime(t, persistPath)
 	if err2 != nil {
 		t.Fatalf("Failed to get file mod time after action 2: %v", err2)
@@ -671,8 +806,9 @@ func TestWriteOnDuplicateIP(t *testing.T) {
 	fakeClock.Advance(10 * time.Second)
 
 	// Action: Send HTTP GET request with the same user and IP.
-	// This should update the timestamp and trigger an immediate write.
+	// This should update the timestamp and schedule a write once the flush delay elapses.
 	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
+	fakeClock.Advance(time.Minute)
 
 	// Poll for the file modification time to change.
 	timeout := time.After(2 * time.Second)
@@ -710,6 +846,66 @@ AROUND:
 	}
 }
 
+// TestTimestampUpdatesAreCoalesced verifies that repeated sightings of a known IP
+// do not write to disk individually, but are flushed together once flush_delay elapses.
+func TestTimestampUpdatesAreCoalesced(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                flush_delay 30s
+            }
+            respond "OK"
+        }
+    }
+  `)
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// A new IP is flushed right away
+	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
+	pollForUserData(t, persistPath, "user1@test.com", 2*time.Second, 10*time.Millisecond)
+	waitForPersist(t, storage, 2*time.Second)
+	modTimeBefore, err := getFileModTime(t, persistPath)
+	if err != nil {
+		t.Fatalf("Failed to get file mod time: %v", err)
+	}
+
+	// Several timestamp-only updates within the flush delay
+	for i := 0; i < 5; i++ {
+		fakeClock.Advance(5 * time.Second)
+		sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
+	}
+	expectedLastSeen := fakeClock.Now().Unix()
+
+	// Nothing should have been written yet
+	time.Sleep(100 * time.Millisecond)
+	if !storage.IsDirty() {
+		t.Fatalf("Expected timestamp updates to be pending before the flush delay elapses")
+	}
+	modTimeDuring, err := getFileModTime(t, persistPath)
+	if err != nil {
+		t.Fatalf("Failed to get file mod time: %v", err)
+	}
+	if !modTimeDuring.Equal(modTimeBefore) {
+		t.Errorf("Expected no write before the flush delay elapses, but the file was modified")
+	}
+
+	// The first update was 25 seconds ago; 5 more seconds reaches its deadline.
+	// Later updates must not have pushed the deadline back.
+	fakeClock.Advance(5 * time.Second)
+	waitForPersist(t, storage, 2*time.Second)
+
+	userData := readPersistedData(t, persistPath)["user1@test.com"]
+	if userData == nil || len(userData.IPs) != 1 || userData.IPs[0].LastSeen != expectedLastSeen {
+		t.Errorf("Expected a single flush with last_seen %d, but got %v", expectedLastSeen, userData)
+	}
+}
+
 // TestPeriodicPersistToDiskForcesWrite verifies that the periodic persister uses PersistToDisk(true)
 // and writes to disk even if the dirty flag is false.
 func TestPeriodicPersistToDiskForcesWrite(t *testing.T) {
@@ -734,9 +930,7 @@ func TestPeriodicPersistToDiskForcesWrite(t *testing.T) {
 		t.Fatalf("Failed to write initial persistence file: %v", err)
 	}
 
-	// Configure persist_interval to a testable value (e.g., 1 second).
-	// Note: The actual interval in tracker.go is hardcoded to 5 minutes currently.
-	// We will rely on advancing the fake clock to trigger it.
+	// Configure persist_interval to a testable value; the loop is driven by the fake clock.
 	tester := createTester(t, `
     localhost:9080 {
         route {
@@ -744,6 +938,7 @@ func TestPeriodicPersistToDiskForcesWrite(t *testing.T) {
                 persist_path `+persistPath+`
                 max_ips_per_user 5
                 user_data_ttl 3600
+                persist_interval 2m
             }
             respond "OK"
         }
@@ -751,20 +946,33 @@ func TestPeriodicPersistToDiskForcesWrite(t *testing.T) {
   `)
 
 	// Action 1: Send HTTP GET request with header X-Token-User-Email: user1@test.com (Source IP: 1.1.1.1).
-	// AddUserIP should return false, dirty remains false. PersistToDisk(false) is called but shouldn't write.
+	// This only bumps the timestamp of a known IP.
 	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
 
-	// Manually add a new user to the storage. This will set the dirty flag.
-	// This change is in memory but not yet persisted by ServeHTTP's async call
-	// because the initial request didn't set the dirty flag.
-	getStorage().AddUserIP("user2@test.com", "2.2.2.2")
+	// Flush the change made by the request, so that the only remaining
+	// writes come from the periodic loop.
+	storage := getLiveStorage(t, defaultStoreName)
+	fakeClock.Advance(time.Minute)
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Manually add a new user to the storage without marking it dirty or
+	// triggering a write. Only a forced periodic write will persist it.
+	storage.mu.Lock()
+	storage.userData["user2@test.com"] = &UserData{
+		IPs: []IPData{{IP: "2.2.2.2", LastSeen: fakeClock.Now().Unix()}},
+	}
+	storage.linkIP("user2@test.com", storage.userData["user2@test.com"].IPs[0])
+	storage.mu.Unlock()
+
+	if _, exists := readPersistedData(t, persistPath)["user2@test.com"]; exists {
+		t.Fatalf("Expected user 'user2@test.com' not to be persisted before the persist interval elapses")
+	}
 
-	// Advance the FakeClock by slightly more than the default persistInterval (5 minutes).
+	// Advance the FakeClock by slightly more than the configured persist_interval.
 	// This should trigger the periodic persister, which forces a write of the current state (including user2).
-	fakeClock.Advance(5*time.Minute + time.Second)
+	fakeClock.Advance(2*time.Minute + time.Second)
 
-	// Poll until data for the new us
-	// er is persisted. This confirms the periodic write occurred.
+	// Poll until data for the new user is persisted. This confirms the periodic write occurred.
 	persistedData := pollForUserData(t, persistPath, "user2@test.com", 2*time.Second, 10*time.Millisecond)
 
 	// Assertion 1: Should contain user1@test.com with the correct IP.
@@ -791,6 +999,537 @@ func TestPeriodicPersistToDiskForcesWrite(t *testing.T) {
 	}
 }
 
+// TestPersistLoopSurvivesReload verifies that reloading the config keeps the same
+// store with exactly one background persist loop running, and that it keeps
+// persisting afterwards.
+func TestPersistLoopSurvivesReload(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	// Caddy skips reloads of an unchanged config, so each one responds differently
+	caddyfile := func(reload int) string {
+		return fmt.Sprintf(`
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path %s
+                max_ips_per_user 5
+                persist_interval 1m
+            }
+            respond "OK %d"
+        }
+    }
+  `, persistPath, reload)
+	}
+	tester := createTester(t, caddyfile(0))
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Reload the config a few times; each reload provisions a new handler
+	// before cleaning up the old one.
+	for i := 1; i <= 3; i++ {
+		tester.InitServer(fullTestCaddyfile(caddyfile(i)), "caddyfile")
+	}
+
+	if live := getLiveStorage(t, defaultStoreName); live != storage {
+		t.Fatalf("Expected reloads to keep the same store instance")
+	}
+	refs, _ := stores.References(defaultStoreName)
+	storage.mu.RLock()
+	running := storage.stopPersist != nil
+	storage.mu.RUnlock()
+	if refs != 1 || !running {
+		t.Fatalf("Expected one reference and a running persist loop after reloads, got refs=%d running=%v", refs, running)
+	}
+
+	// The surviving loop should still persist on schedule
+	storage.mu.Lock()
+	storage.userData["user1@test.com"] = &UserData{
+		IPs: []IPData{{IP: "1.1.1.1", LastSeen: fakeClock.Now().Unix()}},
+	}
+	storage.linkIP("user1@test.com", storage.userData["user1@test.com"].IPs[0])
+	storage.mu.Unlock()
+
+	fakeClock.Advance(time.Minute + time.Second)
+	pollForUserData(t, persistPath, "user1@test.com", 2*time.Second, 10*time.Millisecond)
+}
+
+// TestNamedStores verifies that handlers naming different stores keep separate
+// user sets and files, and that matchers only match IPs from the store they name.
+func TestNamedStores(t *testing.T) {
+	adminsPath := createTempPersistFile(t)
+	usersPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route /admin {
+            user_ip_tracking {
+                store admins
+                persist_path `+adminsPath+`
+                max_ips_per_user 1
+            }
+            respond "OK"
+        }
+        route /app {
+            user_ip_tracking {
+                store users
+                persist_path `+usersPath+`
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+        route /check {
+            @admin_ip user_ip store admins
+            @user_ip user_ip {
+                store users
+            }
+            respond @admin_ip "Admin" 201
+            respond @user_ip "User" 202
+            respond "Unknown" 404
+        }
+        route /check_cel {
+            @admin_ip `+"`user_ip('*', 'admins')`"+`
+            respond @admin_ip "Admin" 201
+            respond "Unknown" 404
+        }
+    }
+  `)
+
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/admin", "admin@test.com", "1.1.1.1", "")
+	_ = resp.Body.Close()
+	resp = sendTestRequest(t, tester, "GET", "http://localhost:9080/app", "user@test.com", "2.2.2.2", "")
+	_ = resp.Body.Close()
+
+	for ip, want := range map[string]int{"1.1.1.1": 201, "2.2.2.2": 202, "3.3.3.3": 404} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", ip, "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Expected status code %d for IP %s, but got %d", want, ip, resp.StatusCode)
+		}
+	}
+
+	// The CEL matcher names its store too
+	for ip, want := range map[string]int{"1.1.1.1": 201, "2.2.2.2": 404} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check_cel", "", ip, "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Expected status code %d for IP %s from the CEL matcher, but got %d", want, ip, resp.StatusCode)
+		}
+	}
+
+	// Each store persists to its own file
+	adminsData := pollForUserData(t, adminsPath, "admin@test.com", 2*time.Second, 10*time.Millisecond)
+	usersData := pollForUserData(t, usersPath, "user@test.com", 2*time.Second, 10*time.Millisecond)
+	if _, exists := adminsData["user@test.com"]; exists {
+		t.Errorf("Expected 'user@test.com' not to be persisted in the admins store")
+	}
+	if _, exists := usersData["admin@test.com"]; exists {
+		t.Errorf("Expected 'admin@test.com' not to be persisted in the users store")
+	}
+
+	// Each store keeps its own settings
+	if got := getLiveStorage(t, "admins").maxIPsPerUser; got != 1 {
+		t.Errorf("Expected the admins store to keep 1 IP per user, got %d", got)
+	}
+	if got := getLiveStorage(t, "users").maxIPsPerUser; got != 5 {
+		t.Errorf("Expected the users store to keep 5 IPs per user, got %d", got)
+	}
+}
+
+// TestStoreSettingsConflict verifies that handlers of one config that share a
+// store may repeat its settings, but fail the config if they differ, rather
+// than silently sharing data meant to be kept apart.
+func TestStoreSettingsConflict(t *testing.T) {
+	firstPath := createTempPersistFile(t)
+	secondPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	caddyfile := func(path string) string {
+		return `
+    localhost:9080 {
+        route /first {
+            user_ip_tracking {
+                persist_path ` + firstPath + `
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+        route /second {
+            user_ip_tracking {
+                persist_path ` + path + `
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `
+	}
+
+	// Action 1: Both handlers use the same settings
+	tester := createTester(t, caddyfile(firstPath))
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/second", "user1@test.com", "1.1.1.1", "")
+	_ = resp.Body.Close()
+
+	// Assertion 1: They share the store
+	pollForUserData(t, firstPath, "user1@test.com", 2*time.Second, 10*time.Millisecond)
+
+	// Action 2: The handlers omit the store name, but not the same persist_path
+	unloadStores(t)
+	err := loadCaddyfile(t, fullTestCaddyfile(caddyfile(secondPath)))
+
+	// Assertion 2: The config fails to load, and the second path is not used
+	if err == nil {
+		t.Fatalf("Expected a config whose handlers set up a store differently to fail")
+	}
+	if _, err := os.Stat(secondPath); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing at the second persist path, got err=%v", err)
+	}
+}
+
+// TestReloadTrimsIPLists verifies that lowering max_ips_per_user on a config reload
+// trims the existing lists, and that the dropped IPs no longer match.
+func TestReloadTrimsIPLists(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	caddyfile := func(maxIPs int) string {
+		return fmt.Sprintf(`
+    localhost:9080 {
+        route / {
+            user_ip_tracking {
+                persist_path %s
+                max_ips_per_user %d
+            }
+            respond "OK"
+        }
+        route /check {
+            @user_ip user_ip
+            respond @user_ip "Matched" 200
+            respond "Unmatched" 404
+        }
+    }
+  `, persistPath, maxIPs)
+	}
+	tester := createTester(t, caddyfile(3))
+
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", ip, "")
+		_ = resp.Body.Close()
+	}
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
+
+	// Action: Reload with a lower limit
+	tester.InitServer(fullTestCaddyfile(caddyfile(1)), "caddyfile")
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
+
+	// Assertion 1: Only the most recent IP is kept on disk
+	persistedData := readPersistedData(t, persistPath)
+	userData, exists := persistedData["user1@test.com"]
+	if !exists {
+		t.Fatalf("Expected user 'user1@test.com' in persisted data after reload, but not found")
+	}
+	if len(userData.IPs) != 1 || userData.IPs[0].IP != "3.3.3.3" {
+		t.Errorf("Expected user 'user1@test.com' to have IPs ['3.3.3.3'] after reload, but got %v", userData.IPs)
+	}
+
+	// Assertion 2: Only the kept IP still matches
+	for ip, want := range map[string]int{"1.1.1.1": 404, "2.2.2.2": 404, "3.3.3.3": 200} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", ip, "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Expected status code %d for IP %s after reload, but got %d", want, ip, resp.StatusCode)
+		}
+	}
+}
+
+// TestReloadAppliesUserDataTTL verifies that setting user_data_ttl on a config reload
+// expires inactive users immediately, without waiting for the next new IP.
+func TestReloadAppliesUserDataTTL(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	caddyfile := func(ttl int) string {
+		return fmt.Sprintf(`
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path %s
+                max_ips_per_user 5
+                user_data_ttl %d
+            }
+            respond "OK"
+        }
+    }
+  `, persistPath, ttl)
+	}
+	tester := createTester(t, caddyfile(0))
+
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
+	_ = resp.Body.Close()
+	fakeClock.Advance(20 * time.Minute)
+	resp = sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user2@test.com", "2.2.2.2", "")
+	_ = resp.Body.Close()
+	pollForUserData(t, persistPath, "user2@test.com", 2*time.Second, 10*time.Millisecond)
+
+	// Action: Reload with a 10 minute TTL; user1 has been inactive for 20 minutes
+	tester.InitServer(fullTestCaddyfile(caddyfile(600)), "caddyfile")
+	storage := getLiveStorage(t, defaultStoreName)
+	waitForPersist(t, storage, 2*time.Second)
+
+	if ips := storage.GetIPsForUser("user1@test.com"); len(ips) != 0 {
+		t.Errorf("Expected user 'user1@test.com' to be expired after reload, but has IPs %v", ips)
+	}
+	if storage.HasIP("1.1.1.1") {
+		t.Errorf("Expected IP '1.1.1.1' to be untracked after reload")
+	}
+
+	persistedData := readPersistedData(t, persistPath)
+	if _, exists := persistedData["user1@test.com"]; exists {
+		t.Errorf("Expected user 'user1@test.com' to be removed from persisted data after reload")
+	}
+	if _, exists := persistedData["user2@test.com"]; !exists {
+		t.Errorf("Expected user 'user2@test.com' to remain in persisted data after reload")
+	}
+}
+
+// TestReloadMovesPersistPath verifies that changing persist_path on a config reload
+// moves the data to the new file and removes the old one.
+func TestReloadMovesPersistPath(t *testing.T) {
+	oldPath := createTempPersistFile(t)
+	newPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	caddyfile := func(path string) string {
+		return `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path ` + path + `
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `
+	}
+	tester := createTester(t, caddyfile(oldPath))
+
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
+	_ = resp.Body.Close()
+	pollForUserData(t, oldPath, "user1@test.com", 2*time.Second, 10*time.Millisecond)
+
+	// Action: Reload with a new persist_path
+	tester.InitServer(fullTestCaddyfile(caddyfile(newPath)), "caddyfile")
+
+	// Assertion 1: The data is at the new path as soon as the reload completes
+	persistedData := readPersistedData(t, newPath)
+	if _, exists := persistedData["user1@test.com"]; !exists {
+		t.Fatalf("Expected user 'user1@test.com' at the new persist path after reload, but not found")
+	}
+
+	// Assertion 2: The old file is gone
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the old persist file to be removed after reload, got err=%v", err)
+	}
+
+	// Assertion 3: Later changes are written to the new path
+	resp = sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user2@test.com", "2.2.2.2", "")
+	_ = resp.Body.Close()
+	pollForUserData(t, newPath, "user2@test.com", 2*time.Second, 10*time.Millisecond)
+}
+
+// TestFailedReloadKeepsStore verifies that the settings of a config that fails
+// to load are never applied: the store keeps its data, its limits and its
+// persist path, and the old config keeps saving to it.
+func TestFailedReloadKeepsStore(t *testing.T) {
+	oldPath := createTempPersistFile(t)
+	newPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+oldPath+`
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `)
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", ip, "")
+		_ = resp.Body.Close()
+	}
+	pollForUserData(t, oldPath, "user1@test.com", 2*time.Second, 10*time.Millisecond)
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Action: Reload with a new persist_path and a lower limit, along with a
+	// handler that fails to provision after them
+	err := loadCaddyfile(t, fullTestCaddyfile(`
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+newPath+`
+                max_ips_per_user 1
+            }
+            user_ip_tracking {
+                store other
+                persist_path `+newPath+`.other
+                max_ips_per_user 0
+            }
+            respond "OK"
+        }
+    }
+  `))
+
+	// Assertion 1: The reload failed
+	if err == nil {
+		t.Fatalf("Expected the reload to fail")
+	}
+
+	// Assertion 2: The store kept its data and settings
+	if live := getLiveStorage(t, defaultStoreName); live != storage {
+		t.Fatalf("Expected the failed reload to keep the same store instance")
+	}
+	if ips := storage.GetIPsForUser("user1@test.com"); len(ips) != 2 {
+		t.Errorf("Expected user1@test.com to keep 2 IPs, but got %v", ips)
+	}
+	if storage.maxIPsPerUser != 5 {
+		t.Errorf("Expected max_ips_per_user to stay 5, but got %d", storage.maxIPsPerUser)
+	}
+
+	// Assertion 3: Nothing was moved
+	if userData := readPersistedData(t, oldPath)["user1@test.com"]; userData == nil || len(userData.IPs) != 2 {
+		t.Errorf("Expected user1@test.com to keep 2 IPs at the old persist path, but got %+v", userData)
+	}
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing at the new persist path, got err=%v", err)
+	}
+
+	// Assertion 4: The old config keeps saving to the old path
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user2@test.com", "3.3.3.3", "")
+	_ = resp.Body.Close()
+	pollForUserData(t, oldPath, "user2@test.com", 2*time.Second, 10*time.Millisecond)
+}
+
+// TestIPNormalization verifies that equivalent spellings of an address are stored as
+// one canonical entry, and that values that are not IP addresses are never stored.
+func TestIPNormalization(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                trusted_proxies 127.0.0.1/8 ::1
+            }
+            respond "OK"
+        }
+    }
+  `)
+
+	// Action: The same IPv4 address as a mapped IPv6 address, bare, and with a port
+	for _, xff := range []string{"::ffff:1.2.3.4", "1.2.3.4", "1.2.3.4:5678"} {
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", xff, "")
+		_ = resp.Body.Close()
+	}
+	// Action: An upper-case IPv6 address with a zone, and a junk value
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user2@test.com", "2001:DB8::1%eth0", "")
+	_ = resp.Body.Close()
+	resp = sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user3@test.com", "unknown", "")
+	_ = resp.Body.Close()
+
+	storage := getLiveStorage(t, defaultStoreName)
+	if ips := storage.GetIPsForUser("user1@test.com"); len(ips) != 1 || ips[0] != "1.2.3.4" {
+		t.Errorf("Expected user 'user1@test.com' to have IPs ['1.2.3.4'], but got %v", ips)
+	}
+	if ips := storage.GetIPsForUser("user2@test.com"); len(ips) != 1 || ips[0] != "2001:db8::1" {
+		t.Errorf("Expected user 'user2@test.com' to have IPs ['2001:db8::1'], but got %v", ips)
+	}
+	// The junk hop is skipped, leaving the (trusted) peer as the client
+	if ips := storage.GetIPsForUser("user3@test.com"); len(ips) != 1 || ips[0] != "127.0.0.1" {
+		t.Errorf("Expected user 'user3@test.com' to have IPs ['127.0.0.1'], but got %v", ips)
+	}
+
+	// Lookups normalize too
+	if !storage.HasIP("::FFFF:1.2.3.4") {
+		t.Errorf("Expected '::FFFF:1.2.3.4' to be found as '1.2.3.4'")
+	}
+	if storage.HasIP("unknown") {
+		t.Errorf("Expected 'unknown' not to be found")
+	}
+}
+
+// TestLoadFromDiskNormalizesIPs verifies that a persisted file written before IPs were
+// normalized is loaded in canonical form and written back.
+func TestLoadFromDiskNormalizesIPs(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	setupFakeClock(t)
+
+	// Setup: A file with non-canonical, duplicate and invalid entries
+	initialData := `{
+  "user_data": {
+    "user1@test.com": {
+      "ips": [
+        {"ip": "::ffff:1.2.3.4", "last_seen": 200},
+        {"ip": "2001:DB8::1", "last_seen": 150},
+        {"ip": "1.2.3.4", "last_seen": 300},
+        {"ip": "unknown", "last_seen": 100}
+      ]
+    },
+    "user2@test.com": {
+      "ips": [
+        {"ip": "not-an-ip", "last_seen": 100}
+      ]
+    }
+  }
+}`
+	if err := os.WriteFile(persistPath, []byte(initialData), 0644); err != nil {
+		t.Fatalf("Failed to write initial data: %v", err)
+	}
+
+	createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+            }
+            respond "OK"
+        }
+    }
+  `)
+
+	storage := getLiveStorage(t, defaultStoreName)
+	waitForPersist(t, storage, 2*time.Second)
+
+	persistedData := readPersistedData(t, persistPath)
+	userData, exists := persistedData["user1@test.com"]
+	if !exists {
+		t.Fatalf("Expected user 'user1@test.com' in persisted data, but not found")
+	}
+	if len(userData.IPs) != 2 {
+		t.Fatalf("Expected user 'user1@test.com' to have 2 IPs after normalization, but got %v", userData.IPs)
+	}
+	if userData.IPs[0].IP != "1.2.3.4" || userData.IPs[0].LastSeen != 300 {
+		t.Errorf("Expected first IP to be '1.2.3.4' last seen at 300, but got %+v", userData.IPs[0])
+	}
+	if userData.IPs[1].IP != "2001:db8::1" {
+		t.Errorf("Expected second IP to be '2001:db8::1', but got %+v", userData.IPs[1])
+	}
+	if _, exists := persistedData["user2@test.com"]; exists {
+		t.Errorf("Expected user 'user2@test.com', whose only IP is invalid, to be dropped")
+	}
+
+	if !storage.HasIP("1.2.3.4") || !storage.HasIP("2001:db8::1") {
+		t.Errorf("Expected the normalized IPs to be tracked")
+	}
+}
+
 // TestCleanupExpiredUsersSetsDirtyFlag verifies that when AddUserIP triggers cleanupExpiredUsers
 // (due to TTL), and users are actually removed, the dirty flag is set, leading to a write by PersistToDisk(false).
 func TestCleanupExpiredUsersSetsDirtyFlag(t *testing.T) {
@@ -838,6 +1577,251 @@ func TestCleanupExpiredUsersSetsDirtyFlag(t *testing.T) {
 	}
 }
 
+// TestIPTTL verifies that an IP not seen within ip_ttl is removed from its user and
+// stops matching, while the user's recent IPs are kept.
+func TestIPTTL(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route / {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                ip_ttl 100
+            }
+            respond "OK"
+        }
+        route /check {
+            @user_ip user_ip
+            respond @user_ip "Matched" 200
+            respond "Unmatched" 404
+        }
+    }
+  `)
+
+	// Setup: user1 uses 1.1.1.1, then 2.2.2.2 a minute later
+	fakeClock.Advance(10 * time.Second)
+	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
+	fakeClock.Advance(time.Minute)
+	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "2.2.2.2", "")
+
+	storage := getLiveStorage(t, defaultStoreName)
+	if !storage.HasIP("1.1.1.1") {
+		t.Fatalf("Expected IP '1.1.1.1' to be kept while younger than ip_ttl")
+	}
+
+	// Action: Another minute later, user1 shows up from a third IP. 1.1.1.1 was
+	// last seen 120 seconds ago, 2.2.2.2 only 60 seconds ago.
+	fakeClock.Advance(time.Minute)
+	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "3.3.3.3", "")
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: Only the stale IP is gone, from the user and from matching
+	if got := storage.GetIPsForUser("user1@test.com"); !slices.Equal(got, []string{"3.3.3.3", "2.2.2.2"}) {
+		t.Errorf("Expected user1@test.com to have IPs ['3.3.3.3', '2.2.2.2'], but got %v", got)
+	}
+	resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", "1.1.1.1", "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected expired IP '1.1.1.1' not to match, but got status code %d", resp.StatusCode)
+	}
+	userData := readPersistedData(t, persistPath)["user1@test.com"]
+	if userData == nil || len(userData.IPs) != 2 {
+		t.Errorf("Expected user1@test.com to be persisted with 2 IPs, but got %+v", userData)
+	}
+}
+
+// TestExpirySweeper verifies that an expired user stops matching right away,
+// and is removed by the periodic sweep even though no new IP is ever seen.
+func TestExpirySweeper(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route / {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                user_data_ttl 60
+                sweep_interval 10m
+            }
+            respond "OK"
+        }
+        route /check {
+            @user_ip user_ip
+            respond @user_ip "Matched" 200
+            respond "Unmatched" 404
+        }
+    }
+  `)
+	matches := func(ip string) bool {
+		t.Helper()
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/check", "", ip, "")
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+
+	// Setup: user1 is seen once
+	fakeClock.Advance(10 * time.Second)
+	sendTestRequest(t, tester, "GET", "http://localhost:9080/", "user1@test.com", "1.1.1.1", "")
+	storage := getLiveStorage(t, defaultStoreName)
+	waitForPersist(t, storage, 2*time.Second)
+	if !matches("1.1.1.1") {
+		t.Fatalf("Expected IP '1.1.1.1' to match while user1 is active")
+	}
+
+	// Action: The TTL elapses, but the next sweep is not due yet
+	fakeClock.Advance(2 * time.Minute)
+
+	// Assert: The expired user no longer matches, although it was not removed yet
+	if matches("1.1.1.1") {
+		t.Errorf("Expected IP '1.1.1.1' of the expired user not to match")
+	}
+	if _, exists := storage.GetUser("user1@test.com"); !exists {
+		t.Fatalf("Expected user1@test.com to be kept until the next sweep")
+	}
+
+	// Action: Let the sweep interval elapse
+	fakeClock.Advance(10 * time.Minute)
+
+	// Assert: The sweep removed the user, and the removal is persisted
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, exists := storage.GetUser("user1@test.com"); !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for the sweep to remove user1@test.com")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForPersist(t, storage, 2*time.Second)
+	if _, exists := readPersistedData(t, persistPath)["user1@test.com"]; exists {
+		t.Errorf("Expected the swept user1@test.com to be removed from persisted data")
+	}
+}
+
+// TestExpiryOrder verifies that a cleanup removes exactly the IPs and users
+// whose TTL has passed, whichever of ip_ttl and user_data_ttl comes first.
+func TestExpiryOrder(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	tester := createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                ip_ttl 60
+                user_data_ttl 45
+                sweep_interval 1h
+            }
+            respond "OK"
+        }
+    }
+  `)
+	trackAt := func(at int64, email, ip string) {
+		t.Helper()
+		fakeClock.Advance(time.Duration(at-fakeClock.Now().Unix()) * time.Second)
+		resp := sendTestRequest(t, tester, "GET", "http://localhost:9080/", email, ip, "")
+		_ = resp.Body.Close()
+	}
+	storage := getLiveStorage(t, defaultStoreName)
+
+	// Setup: user1 is seen from two IPs, user2 from one
+	trackAt(10, "user1@test.com", "1.1.1.1")
+	trackAt(30, "user1@test.com", "3.3.3.3")
+	trackAt(40, "user2@test.com", "2.2.2.2")
+
+	// Action: A new IP triggers a cleanup after 1.1.1.1 outlived ip_ttl
+	trackAt(75, "user3@test.com", "4.4.4.4")
+
+	// Assert: Only the stale IP is gone
+	if got := storage.GetIPsForUser("user1@test.com"); !slices.Equal(got, []string{"3.3.3.3"}) {
+		t.Errorf("Expected user1@test.com to have IPs ['3.3.3.3'], but got %v", got)
+	}
+	if got := storage.GetIPsForUser("user2@test.com"); !slices.Equal(got, []string{"2.2.2.2"}) {
+		t.Errorf("Expected user2@test.com to have IPs ['2.2.2.2'], but got %v", got)
+	}
+
+	// Action: Another cleanup after user1 and user2 outlived user_data_ttl
+	trackAt(90, "user3@test.com", "5.5.5.5")
+	waitForPersist(t, storage, 2*time.Second)
+
+	// Assert: Both users are gone, while user3 keeps every IP
+	if got := storage.GetUsers(); len(got) != 1 || got["user3@test.com"] == nil {
+		t.Errorf("Expected only user3@test.com to be left, but got %v", got)
+	}
+	if got := storage.GetIPsForUser("user3@test.com"); !slices.Equal(got, []string{"5.5.5.5", "4.4.4.4"}) {
+		t.Errorf("Expected user3@test.com to have IPs ['5.5.5.5', '4.4.4.4'], but got %v", got)
+	}
+	if storage.HasIP("3.3.3.3") || storage.HasIP("2.2.2.2") {
+		t.Errorf("Expected the IPs of the expired users not to be tracked")
+	}
+	persistedData := readPersistedData(t, persistPath)
+	if len(persistedData) != 1 || persistedData["user3@test.com"] == nil {
+		t.Errorf("Expected only user3@test.com to be persisted, but got %v", persistedData)
+	}
+}
+
+// TestLoadSkipsExpiredEntries verifies that users and IPs that expired while
+// the server was down are not loaded.
+func TestLoadSkipsExpiredEntries(t *testing.T) {
+	persistPath := createTempPersistFile(t)
+	fakeClock := setupFakeClock(t)
+
+	// Setup: A file with an expired user, and an active user with an expired IP
+	initialData := `{
+  "user_data": {
+    "old@test.com": {
+      "ips": [
+        {"ip": "1.1.1.1", "last_seen": 100}
+      ]
+    },
+    "active@test.com": {
+      "ips": [
+        {"ip": "2.2.2.2", "last_seen": 900},
+        {"ip": "3.3.3.3", "last_seen": 200}
+      ]
+    }
+  }
+}`
+	if err := os.WriteFile(persistPath, []byte(initialData), 0644); err != nil {
+		t.Fatalf("Failed to write initial data: %v", err)
+	}
+	fakeClock.Advance(1000 * time.Second)
+
+	createTester(t, `
+    localhost:9080 {
+        route {
+            user_ip_tracking {
+                persist_path `+persistPath+`
+                max_ips_per_user 5
+                user_data_ttl 600
+                ip_ttl 600
+            }
+            respond "OK"
+        }
+    }
+  `)
+
+	// Assert: Only the active user's recent IP is loaded
+	storage := getLiveStorage(t, defaultStoreName)
+	if _, exists := storage.GetUser("old@test.com"); exists {
+		t.Errorf("Expected the expired old@test.com not to be loaded")
+	}
+	if got := storage.GetIPsForUser("active@test.com"); !slices.Equal(got, []string{"2.2.2.2"}) {
+		t.Errorf("Expected active@test.com to have IPs ['2.2.2.2'], but got %v", got)
+	}
+	if storage.HasIP("1.1.1.1") || storage.HasIP("3.3.3.3") {
+		t.Errorf("Expected the expired IPs not to be tracked")
+	}
+}
+
 // TestUserIPTracking_MRU verifies the Most Recently Used (MRU) behavior of the user_ip_tracking middleware.
 // Seeing an existing IP should move it to the front of the user's list.
 func TestUserIPTracking_MRU(t *testing.T) {
@@ -895,6 +1879,7 @@ func TestUserIPTracking_MRU(t *testing.T) {
 
 	// Advance clock by the periodic persistence interval to trigger persistence
 	fakeClock.Advance(5 * time.Minute)
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
 
 	// Poll until data is persisted after the fourth request
 	persistedUserDataMRU := pollForUserData(t, persistPath, testUserEmail, 2*time.Second, 10*time.Millisecond)
@@ -982,6 +1967,7 @@ func TestUserIPTracking_MRU_MiddleIP(t *testing.T) {
 
 	// Advance clock by the periodic persistence interval to trigger persistence
 	fakeClock.Advance(5 * time.Minute)
+	waitForPersist(t, getLiveStorage(t, defaultStoreName), 2*time.Second)
 
 	// Poll until data is persisted after the fifth request
 	persistedUserDataMRU := pollForUserData(t, persistPath, testUserEmail, 2*time.Second, 10*time.Millisecond)
@@ -1009,3 +1995,30 @@ func TestUserIPTracking_MRU_MiddleIP(t *testing.T) {
 		t.Errorf("MRU state: Expected LastSeen timestamp to be %d, but got %d", expectedLastSeen, userDataMRU.IPs[0].LastSeen)
 	}
 }
+
+// BenchmarkServeHTTP measures tracking a known user's known IP against a large
+// store, which must not cost more as the store grows.
+func BenchmarkServeHTTP(b *testing.B) {
+	const users, ipsPerUser = 50000, 5
+	storage := newUserIPStorage("bench_serve_http")
+	populateBenchmarkStorage(storage, users, ipsPerUser)
+	handler := &UserIpTracking{
+		Config:  Config{Identity: []string{defaultIdentity}},
+		logger:  zap.NewNop(),
+		storage: storage,
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Token-User-Email", fmt.Sprintf("user%d@bench.test", users/2))
+	req.RemoteAddr = benchmarkIP(users/2*ipsPerUser) + ":12345"
+	caddyhttp.NewTestReplacer(req)
+	w := httptest.NewRecorder()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := handler.ServeHTTP(w, req, next); err != nil {
+			b.Fatalf("ServeHTTP failed: %v", err)
+		}
+	}
+}